@@ -20,6 +20,8 @@
 package main
 
 import (
+	"net/http"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/snapcore/snapd/store"
@@ -42,15 +44,40 @@ func main() {
 	repo := store.NewUbuntuStoreSnapRepository(nil, "")
 
 	imgDataOrigin := si.NewClient(httpClient)
-	imgDataTarget := cloud.NewClient(cliExecutor)
-	imgDriver := image.NewUDFQcow2(cliExecutor, repo)
+	imgDataTarget := getImgDataTarget(parsedFlags.Backend, cliExecutor)
+	imgDriver := getImgDriver(parsedFlags.Driver, cliExecutor, repo, httpClient)
+
+	snapDataOrigin := image.NewStorePollster(repo, httpClient)
+	imgVerifier := image.NewQEMUVerifier(cliExecutor)
 
-	runner := runner.NewRunner(imgDataOrigin, imgDataTarget, imgDriver)
+	runner := runner.NewRunner(imgDataOrigin, imgDataTarget, imgDriver, snapDataOrigin, imgVerifier)
 	if err := runner.Exec(parsedFlags); err != nil {
 		log.Fatal(err.Error())
 	}
 }
 
+func getImgDataTarget(backend string, cliExecutor cli.Commander) image.PollsterWriter {
+	switch backend {
+	case "cli":
+		return cloud.NewClient(cliExecutor)
+	case "api":
+		return cloud.NewGlanceClient(&http.Client{}, cloud.NewCredentialsFromEnv())
+	}
+	log.Fatalf("Unknown backend %s", backend)
+	return nil
+}
+
+func getImgDriver(driver string, cliExecutor cli.Commander, repo *store.SnapUbuntuStoreRepository, httpClient web.Getter) image.Driver {
+	switch driver {
+	case "udf":
+		return image.NewUDFQcow2(cliExecutor, repo, httpClient)
+	case "ubuntu-image":
+		return image.NewUbuntuImage(cliExecutor, repo, httpClient)
+	}
+	log.Fatalf("Unknown driver %s", driver)
+	return nil
+}
+
 func setLogLevel(lvl string) {
 	if level, err := log.ParseLevel(lvl); err != nil {
 		log.Printf("Unknown log level %s, setting to info", lvl)
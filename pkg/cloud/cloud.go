@@ -19,11 +19,13 @@
 
 // Package cloud manages the interaction with the cloud provider, currently only
 // OpenStack is supported. It knows how to query the highest published version
-// of the snappy image for a given release and channel and to upload new images
+// of the snappy image for a given release and channel and to upload new images,
+// either through the openstack command line client or talking directly to the
+// Keystone and Glance REST APIs
 package cloud
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strconv"
@@ -38,13 +40,19 @@ import (
 )
 
 const (
-	baseImageName          = "ubuntu-core/%s/ubuntu-"
-	imageNamePrefixPattern = baseImageName + "%s-snappy-core-%s-%s"
-	imageNameSufix         = "disk1.img"
-	errVerNotFoundPattern  = "Version not found for release %s, channel %s and arch %s"
-	imageListCmd           = "openstack image list --private --property status=active"
+	baseImageName         = imageNameRoot + "%s/" + imageNameDistro
+	imageNameSufix        = "disk1.img"
+	errVerNotFoundPattern = "Version not found for release %s, channel %s and arch %s"
+	imageListCmd          = "openstack image list --private --property status=active --long -f json"
+	allImageListCmd       = "openstack image list --private --long -f json"
+	imageShowCmd          = "openstack image show -f json"
+	serverListCmd         = "openstack server list --long -f json"
+	activeStatus          = "active"
 )
 
+// incompleteStatuses are the statuses of the images whose upload didn't finish
+var incompleteStatuses = map[string]bool{"queued": true, "saving": true}
+
 // Client is the implementation of Clouder that interacts with the provider
 type Client struct {
 	cli cli.Commander
@@ -55,6 +63,99 @@ func NewClient(cli cli.Commander) *Client {
 	return &Client{cli}
 }
 
+// cliImage is the representation of an image in the JSON output of the
+// openstack image list command, it doesn't include the creation time nor the
+// properties of the image
+type cliImage struct {
+	ID     string  `json:"ID"`
+	Name   string  `json:"Name"`
+	Status string  `json:"Status"`
+	Size   int64   `json:"Size"`
+	Tags   cliTags `json:"Tags"`
+}
+
+// cliImageDetails holds the fields of the JSON output of the openstack image
+// show command missing in the image list
+type cliImageDetails struct {
+	CreatedAt  string        `json:"created_at"`
+	Properties cliProperties `json:"properties"`
+}
+
+// cliServer is the representation of a server in the JSON output of the
+// openstack server list command
+type cliServer struct {
+	ImageID string `json:"Image ID"`
+}
+
+func (i *cliImage) record() image.Record {
+	return image.Record{
+		ID:     i.ID,
+		Name:   i.Name,
+		Status: strings.ToLower(i.Status),
+		Tags:   i.Tags,
+		Size:   i.Size,
+	}
+}
+
+// cliProperties holds the image properties, depending on its version the
+// openstack client outputs them as a JSON object or as a string of the form
+// key1='value1', key2='value2'
+type cliProperties map[string]string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (p *cliProperties) UnmarshalJSON(data []byte) error {
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err == nil {
+		*p = make(cliProperties)
+		for key, value := range object {
+			(*p)[key] = fmt.Sprint(value)
+		}
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*p = parseProperties(str)
+	return nil
+}
+
+// cliTags holds the image tags, depending on its version the openstack client
+// outputs them as a JSON list or as a comma separated string
+type cliTags []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (t *cliTags) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*t = list
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	*t = nil
+	for _, tag := range strings.Split(str, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+func parseProperties(str string) cliProperties {
+	properties := make(cliProperties)
+	for _, item := range strings.Split(str, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		properties[parts[0]] = strings.Trim(parts[1], "'")
+	}
+	return properties
+}
+
 // ErrVersionNotFound is the type error returned when there are no images for a given
 // release, channel and arch
 type ErrVersionNotFound struct{ release, channel, arch string }
@@ -72,25 +173,25 @@ func (e *ErrVersionNotFound) Error() string {
 // GetLatestVersion returns the highest version of the custom images for the given
 // release, channel and arch, -1 if none is found, and the eventual error
 func (c *Client) GetLatestVersion(options *flags.Options) (ver int, err error) {
-	imageIDs, err := c.extractVersionsFromList(*options)
-	if err != nil {
-		return 0, err
-	}
-	version, err := extractVersion(imageIDs[0])
-	if err != nil {
-		return 0, err
-	}
-	return version, nil
+	return latestVersion(c, *options)
 }
 
 // Create makes the call to create the new image given a file path with the local image
 // and the required bits for making up the image name
 func (c *Client) Create(path string, options *flags.Options, version int) (err error) {
+	format, err := image.FormatFor(options)
+	if err != nil {
+		return
+	}
+	if err = CheckProperties(options.Properties); err != nil {
+		return
+	}
 	imageID := GetImageID(options, version)
 
 	log.Debugf("Creating image %s from file %s", imageID, path)
 
-	command := []string{"openstack", "image", "create", "--disk-format", "qcow2", "--file", path}
+	command := []string{"openstack", "image", "create",
+		"--disk-format", format.Name, "--container-format", format.ContainerFormat, "--file", path}
 	if options.Properties != "" {
 		for _, property := range strings.Split(options.Properties, ",") {
 			flag := []string{"--property", property}
@@ -98,70 +199,178 @@ func (c *Client) Create(path string, options *flags.Options, version int) (err e
 		}
 	}
 	command = append(command, imageID)
-	_, err = c.cli.ExecCommand(command...)
+	if _, err = c.cli.ExecCommand(command...); err != nil {
+		if deleteErr := c.deleteIncomplete(imageID); deleteErr != nil {
+			log.Errorf("Error removing incomplete image %s: %s", imageID, deleteErr)
+		}
+	}
 	return
 }
 
 // extractVersionsFromList returns a list of image names that match the given
 // release, channel and arch sorted in descendant version number order
-func (c *Client) extractVersionsFromList(options flags.Options) ([]string, error) {
-	options.Release = removeDot(options.Release)
-	var imageIDs sort.StringSlice
-	imageIDs, err := c.getImageList(imgTemplate(&options))
+func (c *Client) extractVersionsFromList(options flags.Options) ([]image.Record, error) {
+	return sortedVersions(c, options)
+}
+
+// imageLister is implemented by the backends that know how to retrieve the
+// records of the private images, either the active ones or all of them
+type imageLister interface {
+	getImages() (images []image.Record, err error)
+}
+
+// imageDetailer is implemented by the backends whose image list lacks the
+// creation time and properties of the images, they are retrieved for each of
+// the given images
+type imageDetailer interface {
+	addDetails(images []image.Record) error
+}
+
+// addDetails completes the given records if l doesn't list all their fields
+func addDetails(l imageLister, images []image.Record) error {
+	if d, ok := l.(imageDetailer); ok {
+		return d.addDetails(images)
+	}
+	return nil
+}
+
+// latestVersion returns the version of the newest image in the list returned by
+// l for the given release, channel and arch
+func latestVersion(l imageLister, options flags.Options) (ver int, err error) {
+	images, err := sortedVersions(l, options)
 	if err != nil {
-		return imageIDs, err
+		return 0, err
 	}
-	if len(imageIDs) > 0 {
-		sort.Sort(sort.Reverse(imageIDs[:]))
-		return imageIDs, nil
+	version, err := extractVersion(images[0].Name)
+	if err != nil {
+		return 0, err
 	}
-	return []string{}, NewErrVersionNotFound(&options)
+	return version, nil
 }
 
-// getImageList returns a list of image IDs that match a given pattern
-func (c *Client) getImageList(pattern string) (imagelist []string, err error) {
-	/* list is of the form:
-	| 08763be0-3b3d-41e3-b5b0-08b9006fc1d7 | smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-build0-loader |
-	| 842949c6-225b-4ad0-81b7-98de2b818eed | smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-kernel        |
-	| 762d5ce2-fbc2-4685-8d6c-71249d19df9e | ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-202-disk1.img                                  |
-	*/
-	list, err := c.cli.ExecCommand(strings.Fields(imageListCmd)...)
+// sortedVersions returns the images listed by l that match the given
+// release, channel and arch sorted in descendant version number order
+func sortedVersions(l imageLister, options flags.Options) ([]image.Record, error) {
+	list, err := getImageList(l, fmt.Sprintf(baseImageName, options.ImageType))
 	if err != nil {
-		return []string{}, err
+		return list, err
 	}
+	var images []image.Record
+	series := newImageName(&options, "")
+	for _, item := range list {
+		if inSeries(item.Name, series) {
+			images = append(images, item)
+		}
+	}
+	if len(images) > 0 {
+		if err = addDetails(l, images); err != nil {
+			return nil, err
+		}
+		sort.Sort(sort.Reverse(ByVersion(images)))
+		return images, nil
+	}
+	return []image.Record{}, NewErrVersionNotFound(&options)
+}
 
-	reader := strings.NewReader(list)
-	scanner := bufio.NewScanner(reader)
-
-	var imageIDs []string
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, pattern) {
-			fields := strings.Fields(line)
-			imageIDs = append(imageIDs, fields[3])
+// getImageList returns the active images listed by l whose name starts with
+// the given prefix
+func getImageList(l imageLister, prefix string) (images []image.Record, err error) {
+	list, err := l.getImages()
+	if err != nil {
+		return []image.Record{}, err
+	}
+	for _, item := range list {
+		if item.Status == activeStatus && strings.HasPrefix(item.Name, prefix) {
+			images = append(images, item)
 		}
 	}
-	return imageIDs, nil
+	return images, nil
 }
 
-func imgTemplate(options *flags.Options) (pattern string) {
-	channel := image.GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel)
-	return fmt.Sprintf(imageNamePrefixPattern, options.ImageType, options.Release, options.Arch, channel)
+// inSeries checks if the given image name belongs to the image type, release,
+// arch and channel of series
+func inSeries(name string, series *ImageName) bool {
+	parsed, err := ParseImageName(name)
+	return err == nil && parsed.Suffix == imageNameSufix && parsed.sameSeries(series)
+}
+
+// ByVersion implements sort.Interface for sorting image records by the version
+// in their names, the creation time is used as a tiebreaker
+type ByVersion []image.Record
+
+func (b ByVersion) Len() int      { return len(b) }
+func (b ByVersion) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b ByVersion) Less(i, j int) bool {
+	if cmp := CompareVersions(recordVersion(b[i]), recordVersion(b[j])); cmp != 0 {
+		return cmp < 0
+	}
+	return b[i].CreatedAt.Before(b[j].CreatedAt)
+}
+
+func recordVersion(record image.Record) string {
+	if name, err := ParseImageName(record.Name); err == nil {
+		return name.Version
+	}
+	return ""
+}
+
+// getImages returns the records of the private active images as reported by
+// the JSON output of the openstack client
+func (c *Client) getImages() (images []image.Record, err error) {
+	return c.listImages(imageListCmd)
+}
+
+// getAllImages returns the records of the private images regardless of their status
+func (c *Client) getAllImages() (images []image.Record, err error) {
+	return c.listImages(allImageListCmd)
+}
+
+func (c *Client) listImages(cmd string) (images []image.Record, err error) {
+	output, err := c.cli.ExecCommand(strings.Fields(cmd)...)
+	if err != nil {
+		return nil, err
+	}
+	var list []cliImage
+	if err = json.Unmarshal([]byte(output), &list); err != nil {
+		return nil, err
+	}
+	for _, item := range list {
+		images = append(images, item.record())
+	}
+	return images, nil
+}
+
+// addDetails sets the creation time and properties of the given records from
+// the output of openstack image show, the image list doesn't include them
+func (c *Client) addDetails(images []image.Record) error {
+	for i := range images {
+		output, err := c.cli.ExecCommand(append(strings.Fields(imageShowCmd), images[i].ID)...)
+		if err != nil {
+			return err
+		}
+		var details cliImageDetails
+		if err = json.Unmarshal([]byte(output), &details); err != nil {
+			return err
+		}
+		images[i].CreatedAt, _ = time.Parse(time.RFC3339, details.CreatedAt)
+		images[i].Properties = details.Properties
+	}
+	return nil
 }
 
 // Returns the version contained in imageID, which is of the form:
 // ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-100-disk1.img,
 // in this case it should return 100
 func extractVersion(imageID string) (ver int, err error) {
-	parts := strings.Split(imageID, "-")
-	return strconv.Atoi(parts[7])
+	name, err := ParseImageName(imageID)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(name.Version)
 }
 
 // GetImageID returns the image name for the given parameters
 func GetImageID(options *flags.Options, version int) (name string) {
-	options.Release = removeDot(options.Release)
-	imageNamePrefix := imgTemplate(options)
-
 	finalVersion := strconv.Itoa(version)
 	// The numeric version makes sense for system-image based images, on all-snaps
 	// the version of the image, if any, should be determined by the versions of
@@ -169,21 +378,36 @@ func GetImageID(options *flags.Options, version int) (name string) {
 	// version == 0 means all-snaps, and we replace it by a timestamp so that we are
 	// able to sort images by date
 	if version == 0 {
-		finalVersion = time.Now().Format("20060102150405.000000")
+		finalVersion = time.Now().Format(timestampVersionLayout)
 	}
 
-	return fmt.Sprintf("%s-%s-%s", imageNamePrefix, finalVersion, imageNameSufix)
+	return newImageName(options, finalVersion).Format()
 }
 
-// Delete calls the cli command to remove the given images
-func (c *Client) Delete(images ...string) (err error) {
-	_, err = c.cli.ExecCommand(append([]string{"openstack", "image", "delete"}, images...)...)
+// Delete calls the cli command to remove the images with the given UUIDs
+func (c *Client) Delete(ids ...string) (err error) {
+	_, err = c.cli.ExecCommand(append([]string{"openstack", "image", "delete"}, ids...)...)
+	if err == nil {
+		log.Infof("Removed images %s", strings.Join(ids, " "))
+	}
 	return
 }
 
-// GetVersions returns a descending ordered list (newer first) of image names for the given parameters
-func (c *Client) GetVersions(options *flags.Options) (imageNames []string, err error) {
-	return c.extractVersionsFromList(*options)
+// AddTag calls the cli command to add the given tag to the image with the given UUID
+func (c *Client) AddTag(id, tag string) (err error) {
+	_, err = c.cli.ExecCommand("openstack", "image", "set", "--tag", tag, id)
+	return
+}
+
+// RemoveTag calls the cli command to remove the given tag from the image with the given UUID
+func (c *Client) RemoveTag(id, tag string) (err error) {
+	_, err = c.cli.ExecCommand("openstack", "image", "unset", "--tag", tag, id)
+	return
+}
+
+// GetVersions returns a descending ordered list (newer first) of images for the given parameters
+func (c *Client) GetVersions(options *flags.Options) (images []image.Record, err error) {
+	return sortedVersions(c, *options)
 }
 
 // Purge asks the glance endpoint to remove all the custom images present.
@@ -191,12 +415,83 @@ func (c *Client) GetVersions(options *flags.Options) (imageNames []string, err e
 // the instances from images created with the previous one won't be accessible
 // any more
 func (c *Client) Purge(options *flags.Options) error {
-	imageName := fmt.Sprintf(baseImageName, options.ImageType)
-	images, err := c.getImageList(imageName)
+	images, err := getImageList(c, fmt.Sprintf(baseImageName, options.ImageType))
+	if err != nil || len(images) == 0 {
+		return err
+	}
+	return c.Delete(recordIDs(images)...)
+}
+
+// List returns all the custom images of the given image type, these are the
+// ones removed by Purge
+func (c *Client) List(options *flags.Options) ([]image.Record, error) {
+	images, err := getImageList(c, fmt.Sprintf(baseImageName, options.ImageType))
+	if err != nil {
+		return nil, err
+	}
+	return images, c.addDetails(images)
+}
+
+// deleteIncomplete removes the images with the given name left in queued or
+// saving status by a failed upload. The openstack client doesn't report the
+// UUID of the image when the upload fails, the name is unique for each attempt
+func (c *Client) deleteIncomplete(name string) error {
+	list, err := c.getAllImages()
 	if err != nil {
 		return err
 	}
-	return c.Delete(images...)
+	var ids []string
+	for _, item := range list {
+		if item.Name == name && incompleteStatuses[item.Status] {
+			ids = append(ids, item.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return c.Delete(ids...)
+}
+
+// GetImagesInUse returns the UUIDs of the images used by the servers of the project
+func (c *Client) GetImagesInUse() (ids []string, err error) {
+	output, err := c.cli.ExecCommand(strings.Fields(serverListCmd)...)
+	if err != nil {
+		return nil, err
+	}
+	var servers []cliServer
+	if err = json.Unmarshal([]byte(output), &servers); err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		if server.ImageID != "" {
+			ids = append(ids, server.ImageID)
+		}
+	}
+	return ids, nil
+}
+
+// CheckProperties returns ErrReservedProperty if any of the given comma separated
+// key=value image properties would override a core attribute of the image
+func CheckProperties(properties string) error {
+	if properties == "" {
+		return nil
+	}
+	for _, property := range strings.Split(properties, ",") {
+		key := strings.TrimSpace(strings.SplitN(property, "=", 2)[0])
+		if glanceCoreAttributes[key] {
+			return &ErrReservedProperty{key: key}
+		}
+	}
+	return nil
+}
+
+// recordIDs returns the UUIDs of the given images
+func recordIDs(images []image.Record) []string {
+	ids := make([]string, len(images))
+	for i, item := range images {
+		ids[i] = item.ID
+	}
+	return ids
 }
 
 func removeDot(in string) string {
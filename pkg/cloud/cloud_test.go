@@ -20,14 +20,22 @@
 package cloud
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"gopkg.in/check.v1"
 
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
 )
 
 const (
@@ -36,25 +44,31 @@ const (
 	testDefaultArch      = "amd64"
 	testDefaultImageType = "custom"
 	testImageVersion     = 198
-	baseCompleteResponse = `| 06c12690-08ef-4a9b-aaa6-6e8249bcfef8 | ubuntu-released/ubuntu-oneiric-11.10-amd64-server-20130509-disk1.img                                 |
-| 8fa0213b-e598-473f-bb33-901281063395 | smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003                                          |
-| 56e4a037-887f-4e8c-8e9f-edad2060232b | smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003-ramdisk                                  |
-| cc3fff76-6e86-4bab-93a4-74c45cf3d078 | smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003-kernel                                   |
+	baseCompleteResponse = `[
+{"ID": "06c12690-08ef-4a9b-aaa6-6e8249bcfef8", "Name": "ubuntu-released/ubuntu-oneiric-11.10-amd64-server-20130509-disk1.img", "Status": "active"},
+{"ID": "8fa0213b-e598-473f-bb33-901281063395", "Name": "smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003", "Status": "active"},
+{"ID": "56e4a037-887f-4e8c-8e9f-edad2060232b", "Name": "smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003-ramdisk", "Status": "active"},
+{"ID": "cc3fff76-6e86-4bab-93a4-74c45cf3d078", "Name": "smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003-kernel", "Status": "active"},
 %s
-| f5eca345-3d7c-480d-a5de-3057ef1c5e82 | smoser-cloud-images/ubuntu-hardy-8.04-i386-server-20121003                                           |
-| 45a240bc-f3c7-4e2f-99b5-7761dabd67c2 | smoser-cloud-images/ubuntu-hardy-8.04-i386-server-20121003-ramdisk                                   |
-| 1e2111f6-7f02-4d07-bec2-229c8dd30559 | smoser-cloud-images/ubuntu-hardy-8.04-i386-server-20121003-kernel                                    |
-| 47537aad-dcdb-422e-9302-2f874f88f216 | quantal-desktop-amd64                                                                                |
+{"ID": "f5eca345-3d7c-480d-a5de-3057ef1c5e82", "Name": "smoser-cloud-images/ubuntu-hardy-8.04-i386-server-20121003", "Status": "active"},
+{"ID": "45a240bc-f3c7-4e2f-99b5-7761dabd67c2", "Name": "smoser-cloud-images/ubuntu-hardy-8.04-i386-server-20121003-ramdisk", "Status": "active"},
+{"ID": "1e2111f6-7f02-4d07-bec2-229c8dd30559", "Name": "smoser-cloud-images/ubuntu-hardy-8.04-i386-server-20121003-kernel", "Status": "active"},
+{"ID": "47537aad-dcdb-422e-9302-2f874f88f216", "Name": "quantal-desktop-amd64", "Status": "active"},
 %s
 %s
-| f3618134-0151-48a2-8964-42574322fd52 | precise-desktop-amd64                                                                                |
-| 762d5ce2-fbc2-4685-8d6c-71249d19df9e | ubuntu-core/devel/ubuntu-1504-snappy-core-amd64-edge-20151020-disk1.img                              |
-| 08763be0-3b3d-41e3-b5b0-08b9006fc1d7 | smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-build0-loader |
-| 842949c6-225b-4ad0-81b7-98de2b818eed | smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-kernel        |
-| bf412075-2c8d-4753-8d19-4e502cf57d8d | None                                                                                                 |
+{"ID": "f3618134-0151-48a2-8964-42574322fd52", "Name": "precise-desktop-amd64", "Status": "active"},
+{"ID": "762d5ce2-fbc2-4685-8d6c-71249d19df9e", "Name": "ubuntu-core/devel/ubuntu-1504-snappy-core-amd64-edge-20151020-disk1.img", "Status": "active"},
+{"ID": "08763be0-3b3d-41e3-b5b0-08b9006fc1d7", "Name": "smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-build0-loader", "Status": "active"},
+{"ID": "842949c6-225b-4ad0-81b7-98de2b818eed", "Name": "smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-kernel", "Status": "active"},
+{"ID": "bf412075-2c8d-4753-8d19-4e502cf57d8d", "Name": "None", "Status": "active"},
 %s
-`
-	baseResponse = "| 762d5ce2-fbc2-4685-8d6c-71249d19df9e | %s                        |"
+{"ID": "a1b2c3d4-0000-4000-8000-000000000000", "Name": "ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-300-disk1.img", "Status": "queued"}
+]`
+	baseResponse     = `{"ID": "%s", "Name": "%s", "Disk Format": "qcow2", "Container Format": "bare", "Size": 1024, "Checksum": "de0fed7e8e0d4e4d5d5bd27d3b2e8a13", "Status": "active", "Visibility": "private", "Protected": false, "Project": "0d4e3c9a1b1f4d8c9f1e2a3b4c5d6e7f", "Tags": ""},`
+	baseDetails      = `{"checksum": "de0fed7e8e0d4e4d5d5bd27d3b2e8a13", "container_format": "bare", "created_at": %[3]q, "disk_format": "qcow2", "file": "/v2/images/%[1]s/file", "id": %[1]q, "min_disk": 0, "min_ram": 0, "name": %[2]q, "owner": "0d4e3c9a1b1f4d8c9f1e2a3b4c5d6e7f", "properties": %[4]s, "protected": false, "schema": "/v2/schemas/image", "size": 1024, "status": "active", "tags": "", "updated_at": %[3]q, "virtual_size": null, "visibility": "private"}`
+	testCreatedAt    = "2016-06-14T12:00:00Z"
+	testProperties   = `"property1='value1', property2='value2'"`
+	testShowCmdStart = imageShowCmd + " "
 )
 
 type cloudSuite struct {
@@ -67,16 +81,39 @@ type fakeCliCommander struct {
 	execCommandCalls map[string]int
 	output           string
 	err              bool
+	// failingCmd makes fail the commands starting with it
+	failingCmd string
+	// details holds the output of openstack image show for the given UUIDs,
+	// for the rest it is built from the image list in output
+	details map[string]string
 }
 
 func (f *fakeCliCommander) ExecCommand(cmds ...string) (output string, err error) {
-	f.execCommandCalls[strings.Join(cmds, " ")]++
-	if f.err {
+	cmd := strings.Join(cmds, " ")
+	f.execCommandCalls[cmd]++
+	if f.err || (f.failingCmd != "" && strings.HasPrefix(cmd, f.failingCmd)) {
 		err = fmt.Errorf("exec error")
 	}
+	if strings.HasPrefix(cmd, testShowCmdStart) {
+		return f.showOutput(strings.TrimPrefix(cmd, testShowCmdStart)), err
+	}
 	return f.output, err
 }
 
+func (f *fakeCliCommander) showOutput(id string) string {
+	if details, ok := f.details[id]; ok {
+		return details
+	}
+	var list []cliImage
+	json.Unmarshal([]byte(f.output), &list)
+	for _, item := range list {
+		if item.ID == id {
+			return fmt.Sprintf(baseDetails, id, item.Name, testCreatedAt, testProperties)
+		}
+	}
+	return "{}"
+}
+
 var _ = check.Suite(&cloudSuite{})
 
 func Test(t *testing.T) { check.TestingT(t) }
@@ -96,21 +133,23 @@ func (s *cloudSuite) SetUpTest(c *check.C) {
 		ImageType:     testDefaultImageType,
 	}
 	s.cli.execCommandCalls = make(map[string]int)
-	s.cli.output = fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, testImageVersion))
+	s.cli.output = singleResponse(imageLine(getImageID(s.defaultOptions, testImageVersion)))
 	s.cli.err = false
+	s.cli.failingCmd = ""
+	s.cli.details = make(map[string]string)
 }
 
 func (s *cloudSuite) TestGetLatestVersionQueriesGlance(c *check.C) {
 	s.subject.GetLatestVersion(s.defaultOptions)
 
-	c.Assert(s.cli.execCommandCalls["openstack image list --private --property status=active"], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls["openstack image list --private --property status=active --long -f json"], check.Equals, 1)
 }
 
 func (s *cloudSuite) TestGetLatestVersionReturnsTheLatestVersion(c *check.C) {
 	version := 100
-	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version))
-	versionPlusOneLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version+1))
-	versionPlusTwoLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version+2))
+	versionLine := imageLine(getImageID(s.defaultOptions, version))
+	versionPlusOneLine := imageLine(getImageID(s.defaultOptions, version+1))
+	versionPlusTwoLine := imageLine(getImageID(s.defaultOptions, version+2))
 
 	testCases := []struct {
 		glanceOutput    string
@@ -146,7 +185,7 @@ func (s *cloudSuite) TestGetLatestVersionReturnsGlanceError(c *check.C) {
 }
 
 func (s *cloudSuite) TestGetLatestVersionReturnsVersionNumberError(c *check.C) {
-	s.cli.output = "| 762d5ce2-fbc2-4685-8d6c-71249d19df9e | ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-10f-disk1.img |"
+	s.cli.output = singleResponse(imageLine("ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-10f-disk1.img"))
 
 	_, err := s.subject.GetLatestVersion(s.defaultOptions)
 
@@ -167,7 +206,7 @@ func (s *cloudSuite) TestGetLatestVersionReturnsVersionNotFoundError(c *check.C)
 func (s *cloudSuite) TestGetLatestVersionRemovesDotFromRelease(c *check.C) {
 	expectedVersion := 100
 	s.defaultOptions.Release = "1604"
-	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, expectedVersion))
+	versionLine := imageLine(getImageID(s.defaultOptions, expectedVersion))
 	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", "", "")
 	version, _ := s.subject.GetLatestVersion(s.defaultOptions)
 
@@ -182,7 +221,7 @@ func (s *cloudSuite) TestCreateCallsGlance(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	imageName := getImageID(s.defaultOptions, version)
-	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file %s %s", path, imageName)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --container-format bare --file %s %s", path, imageName)
 
 	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
 }
@@ -196,7 +235,7 @@ func (s *cloudSuite) TestCreateWithOneProperty(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	imageName := getImageID(s.defaultOptions, testImageVersion)
-	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file %s --property %s %s",
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --container-format bare --file %s --property %s %s",
 		path, testProperty, imageName)
 	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
 }
@@ -211,10 +250,40 @@ func (s *cloudSuite) TestCreateWithMultipleProperties(c *check.C) {
 
 	expectedProperties := "--property testproperty1='testvalue1' --property testproperty2='testvalue2' --property testproperty3='testvalue3'"
 	imageName := getImageID(s.defaultOptions, testImageVersion)
-	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file %s %s %s",	path, expectedProperties, imageName)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --container-format bare --file %s %s %s", path, expectedProperties, imageName)
 	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
 }
 
+func (s *cloudSuite) TestCreateUsesImageFormat(c *check.C) {
+	s.defaultOptions.ImageFormat = "vhd"
+	path := "mypath"
+	err := s.subject.Create(path, s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.IsNil)
+
+	imageName := getImageID(s.defaultOptions, testImageVersion)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format vhd --container-format bare --file %s %s", path, imageName)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestCreateReturnsUnknownFormatError(c *check.C) {
+	s.defaultOptions.ImageFormat = "iso"
+
+	err := s.subject.Create("mypath", s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.FitsTypeOf, &image.ErrUnknownFormat{})
+	c.Assert(s.cli.execCommandCalls, check.HasLen, 0)
+}
+
+func (s *cloudSuite) TestCreateReturnsErrReservedProperty(c *check.C) {
+	s.defaultOptions.Properties = "testproperty='testvalue',name=myname"
+
+	err := s.subject.Create("mypath", s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.FitsTypeOf, &ErrReservedProperty{})
+	c.Assert(err.Error(), check.Equals, "error property name is a reserved image attribute")
+	c.Assert(s.cli.execCommandCalls, check.HasLen, 0)
+}
 
 func (s *cloudSuite) TestCreateReturnsError(c *check.C) {
 	s.cli.err = true
@@ -289,18 +358,18 @@ func (s *cloudSuite) TestDeleteReturnsCliError(c *check.C) {
 	c.Assert(err, check.NotNil)
 }
 
-func (s *cloudSuite) TestGetVersionsReturnsImageNames(c *check.C) {
+func (s *cloudSuite) TestGetVersionsReturnsImageIDs(c *check.C) {
 	version := 100
-	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version))
+	versionLine := imageLine(getImageID(s.defaultOptions, version))
 	versionID := getIDFromGlanceResponse(versionLine)
-	versionPlusOneLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version+1))
+	versionPlusOneLine := imageLine(getImageID(s.defaultOptions, version+1))
 	versionPlusOneID := getIDFromGlanceResponse(versionPlusOneLine)
-	versionPlusTwoLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version+2))
+	versionPlusTwoLine := imageLine(getImageID(s.defaultOptions, version+2))
 	versionPlusTwoID := getIDFromGlanceResponse(versionPlusTwoLine)
 
 	testCases := []struct {
-		glanceOutput       string
-		expectedImageNames []string
+		glanceOutput     string
+		expectedImageIDs []string
 	}{
 		{fmt.Sprintf(baseCompleteResponse, "", "", "", ""),
 			[]string{}},
@@ -319,7 +388,7 @@ func (s *cloudSuite) TestGetVersionsReturnsImageNames(c *check.C) {
 		s.cli.output = item.glanceOutput
 		imageList, _ := s.subject.GetVersions(s.defaultOptions)
 
-		c.Check(testEq(imageList, item.expectedImageNames), check.Equals, true)
+		c.Check(testEq(recordIDs(imageList), item.expectedImageIDs), check.Equals, true)
 	}
 }
 
@@ -341,13 +410,13 @@ func (s *cloudSuite) TestGetVersionsReturnsGlanceError(c *check.C) {
 func (s *cloudSuite) TestGetLatestVersionsRemovesDotFromRelease(c *check.C) {
 	version := 100
 	s.defaultOptions.Release = "1604"
-	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version))
+	versionLine := imageLine(getImageID(s.defaultOptions, version))
 	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", "", "")
 	list, _ := s.subject.GetVersions(s.defaultOptions)
 
 	expected := getIDFromGlanceResponse(versionLine)
 
-	c.Assert(testEq(list, []string{expected}), check.Equals, true)
+	c.Assert(testEq(recordIDs(list), []string{expected}), check.Equals, true)
 }
 
 func (s *cloudSuite) TestPurgeCallsCliForListing(c *check.C) {
@@ -365,27 +434,25 @@ func (s *cloudSuite) TestPurgeReturnsListingError(c *check.C) {
 
 func (s *cloudSuite) TestPurgeCallsCliForDeleting(c *check.C) {
 	version := 100
-	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version))
+	versionLine := imageLine(getImageID(s.defaultOptions, version))
 	versionID := getIDFromGlanceResponse(versionLine)
 	s.defaultOptions.Release = testDefaultRelease + "-plusOneRelease"
 	s.defaultOptions.OSChannel = testDefaultChannel + "-plusOneChannel"
 	s.defaultOptions.KernelChannel = testDefaultChannel + "-plusOneChannel"
 	s.defaultOptions.GadgetChannel = testDefaultChannel + "-plusOneChannel"
-	versionPlusOneLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version+1))
+	versionPlusOneLine := imageLine(getImageID(s.defaultOptions, version+1))
 	versionPlusOneID := getIDFromGlanceResponse(versionPlusOneLine)
 	s.defaultOptions.Release = testDefaultRelease + "-plusTwoRelease"
 	s.defaultOptions.OSChannel = testDefaultChannel + "-plusTwoChannel"
 	s.defaultOptions.KernelChannel = testDefaultChannel + "-plusTwoChannel"
 	s.defaultOptions.GadgetChannel = testDefaultChannel + "-plusTwoChannel"
-	versionPlusTwoLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version+2))
+	versionPlusTwoLine := imageLine(getImageID(s.defaultOptions, version+2))
 	versionPlusTwoID := getIDFromGlanceResponse(versionPlusTwoLine)
 
 	testCases := []struct {
 		glanceOutput       string
 		expectedImageNames []string
 	}{
-		{fmt.Sprintf(baseCompleteResponse, "", "", "", ""),
-			[]string{}},
 		{fmt.Sprintf(baseCompleteResponse, versionLine, "", "", ""),
 			[]string{versionID}},
 		{fmt.Sprintf(baseCompleteResponse, versionLine, versionPlusOneLine, "", ""),
@@ -407,6 +474,16 @@ func (s *cloudSuite) TestPurgeCallsCliForDeleting(c *check.C) {
 	}
 }
 
+func (s *cloudSuite) TestPurgeDoesNotDeleteWithoutImages(c *check.C) {
+	s.cli.output = "[]"
+
+	err := s.subject.Purge(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls, check.HasLen, 1)
+	c.Assert(s.cli.execCommandCalls["openstack image delete"], check.Equals, 0)
+}
+
 func (s *cloudSuite) TestPurgeReturnsCliError(c *check.C) {
 	s.cli.err = true
 
@@ -418,6 +495,276 @@ func (s *cloudSuite) TestPurgeReturnsCliError(c *check.C) {
 	c.Assert(s.cli.execCommandCalls[unexpectedCall], check.Equals, 0)
 }
 
+func (s *cloudSuite) TestListReturnsAllCustomImages(c *check.C) {
+	versionLine := imageLine(getImageID(s.defaultOptions, 100))
+	s.defaultOptions.Release = "15.04"
+	otherReleaseLine := imageLine(getImageID(s.defaultOptions, 101))
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", otherReleaseLine, "")
+
+	images, err := s.subject.List(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(recordIDs(images), check.DeepEquals,
+		[]string{getIDFromGlanceResponse(versionLine), getIDFromGlanceResponse(otherReleaseLine)})
+	c.Assert(images[0].CreatedAt, check.Equals, time.Date(2016, 6, 14, 12, 0, 0, 0, time.UTC))
+	c.Assert(s.cli.execCommandCalls[imageListCmd], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls[testShowCmdStart+getIDFromGlanceResponse(versionLine)], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls[testShowCmdStart+getIDFromGlanceResponse(otherReleaseLine)], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestPurgeDoesNotQueryImageDetails(c *check.C) {
+	s.subject.Purge(s.defaultOptions)
+
+	c.Assert(s.cli.execCommandCalls[testShowCmdStart+getIDFromGlanceResponse(imageLine(getImageID(s.defaultOptions, testImageVersion)))], check.Equals, 0)
+}
+
+func (s *cloudSuite) TestCreateRemovesTheImageOfTheFailedUpload(c *check.C) {
+	s.cli.failingCmd = "openstack image create"
+	failedLine := strings.Replace(imageLine(getImageID(s.defaultOptions, testImageVersion)), `"active"`, `"queued"`, 1)
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, failedLine, "", "", "")
+
+	err := s.subject.Create("mypath", s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.cli.execCommandCalls[allImageListCmd], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls["openstack image delete "+getIDFromGlanceResponse(failedLine)], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls["openstack image delete a1b2c3d4-0000-4000-8000-000000000000"], check.Equals, 0)
+}
+
+func (s *cloudSuite) TestCreateDoesNotDeleteActiveImagesOnFailure(c *check.C) {
+	s.cli.failingCmd = "openstack image create"
+
+	err := s.subject.Create("mypath", s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.cli.execCommandCalls[allImageListCmd], check.Equals, 1)
+	c.Assert(len(s.cli.execCommandCalls), check.Equals, 2)
+}
+
+func (s *cloudSuite) TestCreateReturnsUploadErrorWhenListingFails(c *check.C) {
+	s.cli.err = true
+
+	err := s.subject.Create("mypath", s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.cli.execCommandCalls[allImageListCmd], check.Equals, 1)
+	c.Assert(len(s.cli.execCommandCalls), check.Equals, 2)
+}
+
+func (s *cloudSuite) TestAddTagCallsCli(c *check.C) {
+	err := s.subject.AddTag("myid", "promoted")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls["openstack image set --tag promoted myid"], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestRemoveTagCallsCli(c *check.C) {
+	err := s.subject.RemoveTag("myid", "promoted")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls["openstack image unset --tag promoted myid"], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestAddTagReturnsCliError(c *check.C) {
+	s.cli.err = true
+
+	err := s.subject.AddTag("myid", "promoted")
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *cloudSuite) TestGetVersionsReturnsImageNames(c *check.C) {
+	versionLine := imageLine(getImageID(s.defaultOptions, 100))
+	versionPlusOneLine := imageLine(getImageID(s.defaultOptions, 101))
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, versionPlusOneLine, "", "")
+
+	imageList, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(imageList, check.HasLen, 2)
+	c.Assert(imageList[0].Name, check.Equals, getImageID(s.defaultOptions, 101))
+	c.Assert(imageList[1].Name, check.Equals, getImageID(s.defaultOptions, 100))
+}
+
+func (s *cloudSuite) TestDeleteLogsRemovedUUIDs(c *check.C) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	err := s.subject.Delete("uuid1", "uuid2")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(buf.String(), "uuid1 uuid2"), check.Equals, true)
+}
+
+func (s *cloudSuite) TestGetVersionsIgnoresNonActiveImages(c *check.C) {
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, "", "", "", "")
+
+	_, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrVersionNotFound{})
+}
+
+func (s *cloudSuite) TestGetVersionsDoesNotMatchOtherChannelsWithCommonPrefix(c *check.C) {
+	otherOptions := *s.defaultOptions
+	otherOptions.OSChannel = testDefaultChannel + "-other"
+	otherLine := imageLine(getImageID(&otherOptions, 100))
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, otherLine, "", "", "")
+
+	_, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrVersionNotFound{})
+}
+
+func (s *cloudSuite) TestGetVersionsMatchesChannelsWithDashes(c *check.C) {
+	s.defaultOptions.OSChannel = testDefaultChannel + "-other"
+	s.defaultOptions.KernelChannel = testDefaultChannel + "-other"
+	s.defaultOptions.GadgetChannel = testDefaultChannel + "-other"
+	versionLine := imageLine(getImageID(s.defaultOptions, 100))
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", "", "")
+
+	images, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(recordIDs(images), check.DeepEquals, []string{getIDFromGlanceResponse(versionLine)})
+}
+
+func (s *cloudSuite) TestGetVersionsMatchesTimestampVersions(c *check.C) {
+	name := strings.Replace(getImageID(s.defaultOptions, 0), "-0-", "-20160614120000.000000-", 1)
+	versionLine := imageLine(name)
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", "", "")
+
+	images, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(images, check.HasLen, 1)
+	c.Assert(images[0].Name, check.Equals, name)
+}
+
+func (s *cloudSuite) TestGetVersionsSortsVersionsNumerically(c *check.C) {
+	versionLine := imageLine(getImageID(s.defaultOptions, 99))
+	versionPlusOneLine := imageLine(getImageID(s.defaultOptions, 100))
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, versionPlusOneLine, "", "")
+
+	images, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(recordIDs(images), check.DeepEquals,
+		[]string{getIDFromGlanceResponse(versionPlusOneLine), getIDFromGlanceResponse(versionLine)})
+}
+
+func (s *cloudSuite) TestGetLatestVersionComparesVersionsNumerically(c *check.C) {
+	s.cli.output = fmt.Sprintf(baseCompleteResponse,
+		imageLine(getImageID(s.defaultOptions, 99)), imageLine(getImageID(s.defaultOptions, 100)), "", "")
+
+	version, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(version, check.Equals, 100)
+}
+
+func (s *cloudSuite) TestGetVersionsUsesCreationTimeAsTiebreaker(c *check.C) {
+	name := getImageID(s.defaultOptions, 100)
+	s.cli.output = fmt.Sprintf(`[
+{"ID": "older", "Name": %[1]q, "Status": "active"},
+{"ID": "newer", "Name": %[1]q, "Status": "active"},
+{"ID": "oldest", "Name": %[1]q, "Status": "active"}
+]`, name)
+	s.cli.details["older"] = fmt.Sprintf(baseDetails, "older", name, "2016-06-14T12:00:00Z", "{}")
+	s.cli.details["newer"] = fmt.Sprintf(baseDetails, "newer", name, "2016-06-15T12:00:00Z", "{}")
+	s.cli.details["oldest"] = fmt.Sprintf(baseDetails, "oldest", name, "2016-06-13T12:00:00Z", "{}")
+
+	images, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(recordIDs(images), check.DeepEquals, []string{"newer", "older", "oldest"})
+}
+
+func (s *cloudSuite) TestGetImagesDecodesRecords(c *check.C) {
+	images, err := s.subject.getImages()
+
+	c.Assert(err, check.IsNil)
+	c.Assert(images, check.HasLen, 1)
+	c.Assert(images[0].ID, check.Equals, getIDFromGlanceResponse(imageLine(getImageID(s.defaultOptions, testImageVersion))))
+	c.Assert(images[0].Name, check.Equals, getImageID(s.defaultOptions, testImageVersion))
+	c.Assert(images[0].Status, check.Equals, "active")
+	c.Assert(images[0].Size, check.Equals, int64(1024))
+}
+
+func (s *cloudSuite) TestGetVersionsQueriesImageDetails(c *check.C) {
+	id := getIDFromGlanceResponse(imageLine(getImageID(s.defaultOptions, testImageVersion)))
+
+	images, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[testShowCmdStart+id], check.Equals, 1)
+	c.Assert(images[0].CreatedAt, check.Equals, time.Date(2016, 6, 14, 12, 0, 0, 0, time.UTC))
+	c.Assert(images[0].Properties, check.DeepEquals, map[string]string{"property1": "value1", "property2": "value2"})
+}
+
+func (s *cloudSuite) TestGetVersionsDecodesObjectProperties(c *check.C) {
+	name := getImageID(s.defaultOptions, testImageVersion)
+	s.cli.output = fmt.Sprintf(`[{"ID": "myid", "Name": %q, "Status": "active"}]`, name)
+	s.cli.details["myid"] = fmt.Sprintf(baseDetails, "myid", name, testCreatedAt, `{"property1": "value1", "os_hidden": false}`)
+
+	images, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(images[0].Properties, check.DeepEquals, map[string]string{"property1": "value1", "os_hidden": "false"})
+}
+
+func (s *cloudSuite) TestGetVersionsReturnsImageDetailsDecodingError(c *check.C) {
+	s.cli.details[getIDFromGlanceResponse(imageLine(getImageID(s.defaultOptions, testImageVersion)))] = "not json"
+
+	_, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *cloudSuite) TestGetImagesReturnsDecodingError(c *check.C) {
+	s.cli.output = "| 762d5ce2-fbc2-4685-8d6c-71249d19df9e | not json |"
+
+	_, err := s.subject.getImages()
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *cloudSuite) TestGetImagesDecodesTags(c *check.C) {
+	s.cli.output = `[{"ID": "id1", "Name": "name1", "Status": "active", "Tags": "pinned, other"},
+{"ID": "id2", "Name": "name2", "Status": "active", "Tags": ["pinned"]}]`
+
+	images, err := s.subject.getImages()
+
+	c.Assert(err, check.IsNil)
+	c.Assert(images[0].Tags, check.DeepEquals, []string{"pinned", "other"})
+	c.Assert(images[1].Tags, check.DeepEquals, []string{"pinned"})
+}
+
+func (s *cloudSuite) TestGetImagesInUseQueriesServers(c *check.C) {
+	s.cli.output = "[]"
+
+	s.subject.GetImagesInUse()
+
+	c.Assert(s.cli.execCommandCalls["openstack server list --long -f json"], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestGetImagesInUseReturnsImageIDs(c *check.C) {
+	s.cli.output = `[{"ID": "server1", "Image ID": "id1"}, {"ID": "server2", "Image ID": ""}, {"ID": "server3", "Image ID": "id3"}]`
+
+	ids, err := s.subject.GetImagesInUse()
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []string{"id1", "id3"})
+}
+
+func (s *cloudSuite) TestGetImagesInUseReturnsCliError(c *check.C) {
+	s.cli.err = true
+
+	_, err := s.subject.GetImagesInUse()
+
+	c.Assert(err, check.NotNil)
+}
+
 func (s *cloudSuite) TestExtractVersionsFromListDoNotModifyRelease(c *check.C) {
 	expectedRelease := "15.04"
 	s.defaultOptions.Release = expectedRelease
@@ -427,11 +774,34 @@ func (s *cloudSuite) TestExtractVersionsFromListDoNotModifyRelease(c *check.C) {
 	c.Assert(s.defaultOptions.Release, check.Equals, expectedRelease)
 }
 
+func (s *cloudSuite) TestGetImageIDDoesNotModifyRelease(c *check.C) {
+	s.defaultOptions.Release = "15.04"
+
+	imageID := GetImageID(s.defaultOptions, testImageVersion)
+
+	c.Assert(s.defaultOptions.Release, check.Equals, "15.04")
+	c.Assert(strings.Contains(imageID, "-1504-"), check.Equals, true)
+}
+
 func getIDFromGlanceResponse(response string) string {
 	// response is of the form:
-	// | 762d5ce2-fbc2-4685-8d6c-71249d19df9e | ubuntu-core/custom/ubuntu-%s-snappy-core-%s-%s-%d-disk1.img                        |
-	items := strings.Fields(response)
-	return items[3]
+	// {"ID": "762d5ce2-fbc2-4685-8d6c-71249d19df9e", "Name": "ubuntu-core/custom/ubuntu-%s-snappy-core-%s-%s-%d-disk1.img", ...},
+	var item cliImage
+	json.Unmarshal([]byte(strings.TrimSuffix(response, ",")), &item)
+	return item.ID
+}
+
+// imageLine returns an entry of the image list for the given name, with an
+// UUID derived from it
+func imageLine(name string) string {
+	sum := md5.Sum([]byte(name))
+	h := hex.EncodeToString(sum[:])
+	uuid := strings.Join([]string{h[0:8], h[8:12], h[12:16], h[16:20], h[20:32]}, "-")
+	return fmt.Sprintf(baseResponse, uuid, name)
+}
+
+func singleResponse(response string) string {
+	return "[" + strings.TrimSuffix(response, ",") + "]"
 }
 
 func testEq(a, b []string) bool {
@@ -0,0 +1,589 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+const (
+	defaultDomainName    = "Default"
+	imageServiceType     = "image"
+	computeServiceType   = "compute"
+	publicInterface      = "public"
+	glanceImagesPath     = "/v2/images"
+	glanceListQuery      = "?visibility=private&status=active"
+	errGlanceStatusFmt   = "%s %s returned unexpected status %d"
+	errEndpointNotFound  = "%s service endpoint not found in catalog for region %q"
+	errMissingCredential = "missing OpenStack credential %s"
+	errReservedProperty  = "error property %s is a reserved image attribute"
+)
+
+// Credentials holds the data required to authenticate against Keystone
+type Credentials struct {
+	AuthURL, Username, Password,
+	ProjectName, UserDomainName, ProjectDomainName,
+	RegionName string
+}
+
+// NewCredentialsFromEnv returns the Credentials defined by the usual OS_* environment
+// variables
+func NewCredentialsFromEnv() *Credentials {
+	projectName := os.Getenv("OS_PROJECT_NAME")
+	if projectName == "" {
+		projectName = os.Getenv("OS_TENANT_NAME")
+	}
+	return &Credentials{
+		AuthURL:           os.Getenv("OS_AUTH_URL"),
+		Username:          os.Getenv("OS_USERNAME"),
+		Password:          os.Getenv("OS_PASSWORD"),
+		ProjectName:       projectName,
+		UserDomainName:    envWithDefault("OS_USER_DOMAIN_NAME", defaultDomainName),
+		ProjectDomainName: envWithDefault("OS_PROJECT_DOMAIN_NAME", defaultDomainName),
+		RegionName:        os.Getenv("OS_REGION_NAME"),
+	}
+}
+
+// ErrMissingCredential is the type of the error returned when a required
+// credential is not set
+type ErrMissingCredential struct {
+	name string
+}
+
+func (e *ErrMissingCredential) Error() string {
+	return fmt.Sprintf(errMissingCredential, e.name)
+}
+
+// ErrGlanceStatus is the type of the error returned when Keystone or Glance reply
+// with an unexpected HTTP status code
+type ErrGlanceStatus struct {
+	method, url string
+	status      int
+}
+
+func (e *ErrGlanceStatus) Error() string {
+	return fmt.Sprintf(errGlanceStatusFmt, e.method, e.url, e.status)
+}
+
+// ErrReservedProperty is the type of the error returned when one of the given
+// image properties would override a core attribute of the image
+type ErrReservedProperty struct {
+	key string
+}
+
+func (e *ErrReservedProperty) Error() string {
+	return fmt.Sprintf(errReservedProperty, e.key)
+}
+
+// ErrEndpointNotFound is the type of the error returned when the service catalog
+// doesn't include a public endpoint of the required service for the configured region
+type ErrEndpointNotFound struct {
+	service, region string
+}
+
+func (e *ErrEndpointNotFound) Error() string {
+	return fmt.Sprintf(errEndpointNotFound, e.service, e.region)
+}
+
+// GlanceClient is an implementation of PollsterWriter that talks directly to the
+// Keystone v3 and Glance v2 REST APIs
+type GlanceClient struct {
+	httpClient                       *http.Client
+	credentials                      *Credentials
+	token, endpoint, computeEndpoint string
+	// authMutex serializes the authentication of concurrent requests
+	authMutex sync.Mutex
+}
+
+// NewGlanceClient is the GlanceClient constructor
+func NewGlanceClient(httpClient *http.Client, credentials *Credentials) *GlanceClient {
+	return &GlanceClient{httpClient: httpClient, credentials: credentials}
+}
+
+// glanceImage is the Glance v2 representation of an image, the custom properties
+// are stored as top level attributes
+type glanceImage map[string]interface{}
+
+// glanceCoreAttributes are the attributes of glanceImage that are not custom properties
+var glanceCoreAttributes = map[string]bool{
+	"id": true, "name": true, "status": true, "visibility": true, "protected": true,
+	"checksum": true, "owner": true, "size": true, "virtual_size": true, "min_ram": true,
+	"min_disk": true, "disk_format": true, "container_format": true, "created_at": true,
+	"updated_at": true, "tags": true, "self": true, "file": true, "schema": true,
+	"locations": true, "direct_url": true,
+}
+
+// novaServer is the Nova representation of a server, image is an empty string
+// instead of an object for the servers booted from volume
+type novaServer struct {
+	Image interface{} `json:"image"`
+}
+
+type novaServerList struct {
+	Servers []novaServer `json:"servers"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"servers_links"`
+}
+
+func (g glanceImage) record() image.Record {
+	record := image.Record{
+		ID:         g.stringValue("id"),
+		Name:       g.stringValue("name"),
+		Status:     g.stringValue("status"),
+		Properties: make(map[string]string),
+	}
+	record.CreatedAt, _ = time.Parse(time.RFC3339, g.stringValue("created_at"))
+	if tags, ok := g["tags"].([]interface{}); ok {
+		for _, tag := range tags {
+			record.Tags = append(record.Tags, fmt.Sprint(tag))
+		}
+	}
+	if size, ok := g["size"].(float64); ok {
+		record.Size = int64(size)
+	}
+	for key, value := range g {
+		if str, ok := value.(string); ok && !glanceCoreAttributes[key] {
+			record.Properties[key] = str
+		}
+	}
+	return record
+}
+
+func (g glanceImage) stringValue(key string) string {
+	str, _ := g[key].(string)
+	return str
+}
+
+type glanceImageList struct {
+	Images []glanceImage `json:"images"`
+	Next   string        `json:"next"`
+}
+
+type catalogEntry struct {
+	Type      string `json:"type"`
+	Endpoints []struct {
+		Interface string `json:"interface"`
+		Region    string `json:"region"`
+		RegionID  string `json:"region_id"`
+		URL       string `json:"url"`
+	} `json:"endpoints"`
+}
+
+type tokenResponse struct {
+	Token struct {
+		Catalog []catalogEntry `json:"catalog"`
+	} `json:"token"`
+}
+
+// GetLatestVersion returns the highest version of the custom images for the given
+// release, channel and arch and the eventual error
+func (g *GlanceClient) GetLatestVersion(options *flags.Options) (ver int, err error) {
+	return latestVersion(g, *options)
+}
+
+// GetVersions returns a descending ordered list (newer first) of images for the given parameters
+func (g *GlanceClient) GetVersions(options *flags.Options) (images []image.Record, err error) {
+	return sortedVersions(g, *options)
+}
+
+// Create registers a new image in Glance and uploads the contents of the given path to it,
+// the image registered is removed if the upload fails
+func (g *GlanceClient) Create(path string, options *flags.Options, version int) (err error) {
+	format, err := image.FormatFor(options)
+	if err != nil {
+		return
+	}
+	if err = CheckProperties(options.Properties); err != nil {
+		return
+	}
+	imageID := GetImageID(options, version)
+
+	log.Debugf("Creating image %s from file %s", imageID, path)
+
+	request := map[string]string{
+		"name":             imageID,
+		"disk_format":      format.Name,
+		"container_format": format.ContainerFormat,
+		"visibility":       "private",
+	}
+	if options.Properties != "" {
+		for _, property := range strings.Split(options.Properties, ",") {
+			parts := strings.SplitN(property, "=", 2)
+			if len(parts) == 2 {
+				request[parts[0]] = parts[1]
+			}
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	var created glanceImage
+	if err = g.do("POST", glanceImagesPath, "application/json", bytes.NewReader(body), http.StatusCreated, &created); err != nil {
+		return
+	}
+
+	id := created.stringValue("id")
+	if err = g.uploadFile(id, path); err != nil {
+		if deleteErr := g.Delete(id); deleteErr != nil {
+			log.Errorf("Error removing incomplete image %s: %s", id, deleteErr)
+		}
+	}
+	return
+}
+
+// uploadFile sends the contents of the given path to the image with the given UUID
+func (g *GlanceClient) uploadFile(id, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	log.Debugf("Uploading %s to image %s", path, id)
+	return g.do("PUT", glanceImagesPath+"/"+id+"/file", "application/octet-stream", file, http.StatusNoContent, nil)
+}
+
+// Delete removes the images with the given UUIDs
+func (g *GlanceClient) Delete(ids ...string) (err error) {
+	for _, id := range ids {
+		if err = g.do("DELETE", glanceImagesPath+"/"+id, "", nil, http.StatusNoContent, nil); err != nil {
+			return
+		}
+		log.Infof("Removed image %s", id)
+	}
+	return
+}
+
+// AddTag adds the given tag to the image with the given UUID
+func (g *GlanceClient) AddTag(id, tag string) error {
+	return g.do("PUT", glanceImagesPath+"/"+id+"/tags/"+tag, "", nil, http.StatusNoContent, nil)
+}
+
+// RemoveTag removes the given tag from the image with the given UUID
+func (g *GlanceClient) RemoveTag(id, tag string) error {
+	return g.do("DELETE", glanceImagesPath+"/"+id+"/tags/"+tag, "", nil, http.StatusNoContent, nil)
+}
+
+// Purge removes all the custom images present. Use with care!
+func (g *GlanceClient) Purge(options *flags.Options) error {
+	images, err := g.List(options)
+	if err != nil {
+		return err
+	}
+	return g.Delete(recordIDs(images)...)
+}
+
+// List returns all the custom images of the given image type
+func (g *GlanceClient) List(options *flags.Options) ([]image.Record, error) {
+	return getImageList(g, fmt.Sprintf(baseImageName, options.ImageType))
+}
+
+// getImages returns the records of all the private active images
+func (g *GlanceClient) getImages() (images []image.Record, err error) {
+	return g.listImages(glanceListQuery)
+}
+
+// listImages follows the pagination links of the Glance image list with the
+// given query and returns the records of the images
+func (g *GlanceClient) listImages(query string) (images []image.Record, err error) {
+	next := glanceImagesPath + query
+	for next != "" {
+		var page glanceImageList
+		if err = g.do("GET", next, "", nil, http.StatusOK, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Images {
+			images = append(images, item.record())
+		}
+		next = page.Next
+	}
+	return
+}
+
+// GetImagesInUse returns the UUIDs of the images used by the servers of the project
+func (g *GlanceClient) GetImagesInUse() (ids []string, err error) {
+	if err = g.authenticate(); err != nil {
+		return
+	}
+	if g.computeEndpoint == "" {
+		return nil, &ErrEndpointNotFound{service: computeServiceType, region: g.credentials.RegionName}
+	}
+	next := g.computeEndpoint + "/servers/detail"
+	for next != "" {
+		var page novaServerList
+		if err = g.doURL("GET", next, "", nil, http.StatusOK, &page); err != nil {
+			return nil, err
+		}
+		for _, server := range page.Servers {
+			if ref, ok := server.Image.(map[string]interface{}); ok {
+				if id, ok := ref["id"].(string); ok {
+					ids = append(ids, id)
+				}
+			}
+		}
+		next = ""
+		for _, link := range page.Links {
+			if link.Rel == "next" {
+				next = link.Href
+			}
+		}
+	}
+	return
+}
+
+// do executes an authenticated request against the image endpoint, checks the
+// returned status and, if out is not nil, decodes the JSON response in it
+func (g *GlanceClient) do(method, path, contentType string, body io.ReadSeeker, expectedStatus int, out interface{}) error {
+	if err := g.authenticate(); err != nil {
+		return err
+	}
+	return g.doURL(method, g.endpoint+path, contentType, body, expectedStatus, out)
+}
+
+// doURL executes an authenticated request against the given URL, the client
+// must be already authenticated. If the token is rejected, because it has expired
+// during a long run, a new one is requested and the request is replayed once
+func (g *GlanceClient) doURL(method, requestURL, contentType string, body io.ReadSeeker, expectedStatus int, out interface{}) error {
+	token := g.currentToken()
+	err := g.send(method, requestURL, token, contentType, body, expectedStatus, out)
+	if statusErr, ok := err.(*ErrGlanceStatus); !ok || statusErr.status != http.StatusUnauthorized {
+		return err
+	}
+	log.Debugf("Token rejected by %s %s, authenticating again", method, requestURL)
+	if err = g.reauthenticate(token); err != nil {
+		return err
+	}
+	if body != nil {
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return g.send(method, requestURL, g.currentToken(), contentType, body, expectedStatus, out)
+}
+
+func (g *GlanceClient) send(method, requestURL, token, contentType string, body io.ReadSeeker, expectedStatus int, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		// the HTTP client closes the body, it's kept open for replaying the request
+		reader = ioutil.NopCloser(body)
+	}
+	req, err := http.NewRequest(method, requestURL, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		return &ErrGlanceStatus{method: method, url: requestURL, status: resp.StatusCode}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// authenticate requests a token if the client doesn't have one yet
+func (g *GlanceClient) authenticate() error {
+	g.authMutex.Lock()
+	defer g.authMutex.Unlock()
+	if g.token != "" {
+		return nil
+	}
+	return g.requestToken()
+}
+
+// reauthenticate discards the given rejected token and requests a new one,
+// unless a concurrent request has already replaced it
+func (g *GlanceClient) reauthenticate(rejected string) error {
+	g.authMutex.Lock()
+	defer g.authMutex.Unlock()
+	if g.token != rejected {
+		return nil
+	}
+	g.token = ""
+	return g.requestToken()
+}
+
+func (g *GlanceClient) currentToken() string {
+	g.authMutex.Lock()
+	defer g.authMutex.Unlock()
+	return g.token
+}
+
+// requestToken requests a project scoped token from Keystone v3 and extracts the
+// image and compute endpoints from the service catalog. Only the image endpoint
+// is required, the compute one is just needed for checking the images in use.
+// It must be called with authMutex held
+func (g *GlanceClient) requestToken() error {
+	if err := g.checkCredentials(); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(g.authRequest())
+	if err != nil {
+		return err
+	}
+	tokensURL := keystoneV3URL(g.credentials.AuthURL) + "/auth/tokens"
+	resp, err := g.httpClient.Post(tokensURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return &ErrGlanceStatus{method: "POST", url: tokensURL, status: resp.StatusCode}
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var token tokenResponse
+	if err = json.Unmarshal(content, &token); err != nil {
+		return err
+	}
+	if g.endpoint != "" {
+		// the endpoints are kept from the first authentication, the requests
+		// in flight use them without holding authMutex
+		g.token = resp.Header.Get("X-Subject-Token")
+		return nil
+	}
+	endpoint, err := findEndpoint(token.Token.Catalog, imageServiceType, g.credentials.RegionName)
+	if err != nil {
+		return err
+	}
+	g.endpoint = normalizeEndpoint(endpoint)
+	if computeEndpoint, err := findEndpoint(token.Token.Catalog, computeServiceType, g.credentials.RegionName); err == nil {
+		g.computeEndpoint = strings.TrimSuffix(computeEndpoint, "/")
+	}
+	g.token = resp.Header.Get("X-Subject-Token")
+	return nil
+}
+
+func (g *GlanceClient) checkCredentials() error {
+	required := []struct{ name, value string }{
+		{"OS_AUTH_URL", g.credentials.AuthURL},
+		{"OS_USERNAME", g.credentials.Username},
+		{"OS_PASSWORD", g.credentials.Password},
+		{"OS_PROJECT_NAME", g.credentials.ProjectName},
+	}
+	for _, item := range required {
+		if item.value == "" {
+			return &ErrMissingCredential{name: item.name}
+		}
+	}
+	return nil
+}
+
+func (g *GlanceClient) authRequest() map[string]interface{} {
+	return map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     g.credentials.Username,
+						"password": g.credentials.Password,
+						"domain":   map[string]string{"name": g.credentials.UserDomainName},
+					},
+				},
+			},
+			"scope": map[string]interface{}{
+				"project": map[string]interface{}{
+					"name":   g.credentials.ProjectName,
+					"domain": map[string]string{"name": g.credentials.ProjectDomainName},
+				},
+			},
+		},
+	}
+}
+
+// findEndpoint returns the public endpoint of the given service type for the given
+// region, if region is empty the first public endpoint of the service is returned
+func findEndpoint(catalog []catalogEntry, serviceType, region string) (string, error) {
+	for _, entry := range catalog {
+		if entry.Type != serviceType {
+			continue
+		}
+		for _, endpoint := range entry.Endpoints {
+			if endpoint.Interface != publicInterface {
+				continue
+			}
+			if region == "" || endpoint.Region == region || endpoint.RegionID == region {
+				return endpoint.URL, nil
+			}
+		}
+	}
+	return "", &ErrEndpointNotFound{service: serviceType, region: region}
+}
+
+// normalizeEndpoint removes the trailing slash and version path that some
+// deployments include in the catalog, so that the API paths can be appended
+func normalizeEndpoint(endpoint string) string {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	return strings.TrimSuffix(endpoint, "/v2")
+}
+
+// keystoneV3URL returns the v3 base URL given the configured OS_AUTH_URL, which
+// may point to the v2.0 API or to the unversioned root
+func keystoneV3URL(authURL string) string {
+	authURL = strings.TrimSuffix(authURL, "/")
+	if u, err := url.Parse(authURL); err == nil {
+		switch {
+		case strings.HasSuffix(u.Path, "/v3"):
+			return authURL
+		case strings.HasSuffix(u.Path, "/v2.0"):
+			return strings.TrimSuffix(authURL, "/v2.0") + "/v3"
+		}
+	}
+	return authURL + "/v3"
+}
+
+func envWithDefault(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
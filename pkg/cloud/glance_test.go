@@ -0,0 +1,542 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+const (
+	testToken    = "testtoken"
+	testRegion   = "testregion"
+	testUsername = "testuser"
+	testPassword = "testpassword"
+	testProject  = "testproject"
+)
+
+var _ = check.Suite(&glanceSuite{})
+
+type glanceSuite struct {
+	server         *httptest.Server
+	subject        *GlanceClient
+	defaultOptions *flags.Options
+
+	mu         sync.Mutex
+	calls      map[string]int
+	images     []glanceImage
+	pageSize   int
+	authStatus int
+	failPath   string
+	authBody   map[string]interface{}
+	created    map[string]interface{}
+	uploaded   string
+	servers    []string
+	// token is the one issued and accepted, it is replaced by newToken
+	// when the request given in expireOn is received
+	token, expireOn string
+}
+
+func (s *glanceSuite) SetUpTest(c *check.C) {
+	s.calls = make(map[string]int)
+	s.images = []glanceImage{}
+	s.pageSize = 0
+	s.authStatus = http.StatusCreated
+	s.failPath = ""
+	s.authBody = nil
+	s.created = nil
+	s.uploaded = ""
+	s.servers = []string{}
+	s.token = testToken
+	s.expireOn = ""
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.subject = NewGlanceClient(&http.Client{}, &Credentials{
+		AuthURL:           s.server.URL + "/v2.0",
+		Username:          testUsername,
+		Password:          testPassword,
+		ProjectName:       testProject,
+		UserDomainName:    defaultDomainName,
+		ProjectDomainName: defaultDomainName,
+		RegionName:        testRegion,
+	})
+	s.defaultOptions = &flags.Options{
+		Release:       testDefaultRelease,
+		OSChannel:     testDefaultChannel,
+		KernelChannel: testDefaultChannel,
+		GadgetChannel: testDefaultChannel,
+		Arch:          testDefaultArch,
+		ImageType:     testDefaultImageType,
+	}
+}
+
+func (s *glanceSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *glanceSuite) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[r.Method+" "+r.URL.Path]++
+
+	if r.URL.Path == s.failPath {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Path == "/v3/auth/tokens" {
+		s.handleAuth(w, r)
+		return
+	}
+	if r.Method+" "+r.URL.Path == s.expireOn {
+		s.token = "newtoken"
+		s.expireOn = ""
+	}
+	if r.Header.Get("X-Auth-Token") != s.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.URL.Path == glanceImagesPath:
+		s.handleList(w, r)
+	case r.Method == "POST" && r.URL.Path == glanceImagesPath:
+		json.NewDecoder(r.Body).Decode(&s.created)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id": "new-image-id", "name": %q, "status": "queued"}`, s.created["name"])
+	case r.Method == "PUT" && strings.Contains(r.URL.Path, "/tags/"):
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/file"):
+		content, _ := ioutil.ReadAll(r.Body)
+		s.uploaded = string(content)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && r.URL.Path == "/compute/servers/detail":
+		s.handleServers(w, r)
+	case r.Method == "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *glanceSuite) handleAuth(w http.ResponseWriter, r *http.Request) {
+	json.NewDecoder(r.Body).Decode(&s.authBody)
+	w.Header().Set("X-Subject-Token", s.token)
+	w.WriteHeader(s.authStatus)
+	fmt.Fprintf(w, `{"token": {"catalog": [
+	{"type": "compute", "endpoints": [{"interface": "public", "region": %[2]q, "url": "%[1]s/compute/"}]},
+	{"type": "image", "endpoints": [
+		{"interface": "internal", "region": %[2]q, "url": "http://internal.invalid"},
+		{"interface": "public", "region": "anotherregion", "url": "http://anotherregion.invalid"},
+		{"interface": "public", "region": %[2]q, "url": "%[1]s/"}
+	]}]}}`, s.server.URL, testRegion)
+}
+
+func (s *glanceSuite) handleList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	status := query.Get("status")
+	images := []glanceImage{}
+	for _, item := range s.images {
+		if status == "" || item["status"] == status {
+			images = append(images, item)
+		}
+	}
+	start := 0
+	if marker := query.Get("marker"); marker != "" {
+		fmt.Sscanf(marker, "%d", &start)
+	}
+	query.Del("marker")
+	end := len(images)
+	if s.pageSize > 0 && start+s.pageSize < end {
+		end = start + s.pageSize
+	}
+	page := glanceImageList{Images: images[start:end]}
+	if end < len(images) {
+		page.Next = fmt.Sprintf("%s?%s&marker=%d", glanceImagesPath, query.Encode(), end)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func (s *glanceSuite) handleServers(w http.ResponseWriter, r *http.Request) {
+	// one server per page, the ones booted from volume have an empty image
+	start := 0
+	if marker := r.URL.Query().Get("marker"); marker != "" {
+		fmt.Sscanf(marker, "%d", &start)
+	}
+	if start >= len(s.servers) {
+		fmt.Fprint(w, `{"servers": []}`)
+		return
+	}
+	image := `""`
+	if s.servers[start] != "" {
+		image = fmt.Sprintf(`{"id": %q}`, s.servers[start])
+	}
+	fmt.Fprintf(w, `{"servers": [{"id": "server%d", "image": %s}], "servers_links": [{"rel": "next", "href": "%s/compute/servers/detail?marker=%d"}]}`,
+		start, image, s.server.URL, start+1)
+}
+
+func (s *glanceSuite) addImage(id string, version int) {
+	s.images = append(s.images, glanceImage{
+		"id": id, "name": getImageID(s.defaultOptions, version), "status": "active",
+		"size": 1024, "created_at": "2016-06-14T12:00:00Z", "disk_format": "qcow2", "myproperty": "myvalue"})
+}
+
+func (s *glanceSuite) TestGetLatestVersionAuthenticatesOnce(c *check.C) {
+	s.addImage("id1", 100)
+
+	s.subject.GetLatestVersion(s.defaultOptions)
+	s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(s.calls["POST /v3/auth/tokens"], check.Equals, 1)
+	c.Assert(s.calls["GET "+glanceImagesPath], check.Equals, 2)
+}
+
+func (s *glanceSuite) TestConcurrentRequestsAuthenticateOnce(c *check.C) {
+	s.addImage("id1", 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.subject.GetLatestVersion(s.defaultOptions)
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(s.calls["POST /v3/auth/tokens"], check.Equals, 1)
+	c.Assert(s.calls["GET "+glanceImagesPath], check.Equals, 5)
+}
+
+func (s *glanceSuite) TestExpiredTokenIsRenewed(c *check.C) {
+	s.addImage("id1", 100)
+	s.subject.GetLatestVersion(s.defaultOptions)
+	s.expireOn = "GET " + glanceImagesPath
+
+	ver, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ver, check.Equals, 100)
+	c.Assert(s.calls["POST /v3/auth/tokens"], check.Equals, 2)
+	c.Assert(s.calls["GET "+glanceImagesPath], check.Equals, 3)
+}
+
+func (s *glanceSuite) TestExpiredTokenReplaysUpload(c *check.C) {
+	tmpFile, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString("image contents")
+	tmpFile.Close()
+	s.expireOn = "PUT " + glanceImagesPath + "/new-image-id/file"
+
+	err = s.subject.Create(tmpFile.Name(), s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.calls["POST /v3/auth/tokens"], check.Equals, 2)
+	c.Assert(s.calls["PUT "+glanceImagesPath+"/new-image-id/file"], check.Equals, 2)
+	c.Assert(s.uploaded, check.Equals, "image contents")
+}
+
+func (s *glanceSuite) TestRejectedRenewedTokenReturnsStatusError(c *check.C) {
+	s.subject.GetLatestVersion(s.defaultOptions)
+	s.token = "othertoken"
+	s.authStatus = http.StatusUnauthorized
+
+	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+	c.Assert(s.calls["POST /v3/auth/tokens"], check.Equals, 2)
+}
+
+func (s *glanceSuite) TestAuthenticationSendsCredentials(c *check.C) {
+	s.subject.GetLatestVersion(s.defaultOptions)
+
+	auth := s.authBody["auth"].(map[string]interface{})
+	user := auth["identity"].(map[string]interface{})["password"].(map[string]interface{})["user"].(map[string]interface{})
+	project := auth["scope"].(map[string]interface{})["project"].(map[string]interface{})
+
+	c.Assert(user["name"], check.Equals, testUsername)
+	c.Assert(user["password"], check.Equals, testPassword)
+	c.Assert(project["name"], check.Equals, testProject)
+}
+
+func (s *glanceSuite) TestAuthenticationReturnsStatusError(c *check.C) {
+	s.authStatus = http.StatusUnauthorized
+
+	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+}
+
+func (s *glanceSuite) TestAuthenticationReturnsEndpointNotFoundError(c *check.C) {
+	s.subject.credentials.RegionName = "unknownregion"
+
+	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrEndpointNotFound{})
+}
+
+func (s *glanceSuite) TestAuthenticationReturnsMissingCredentialError(c *check.C) {
+	s.subject.credentials.Password = ""
+
+	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrMissingCredential{})
+	c.Assert(err.Error(), check.Equals, fmt.Sprintf(errMissingCredential, "OS_PASSWORD"))
+	c.Assert(s.calls["POST /v3/auth/tokens"], check.Equals, 0)
+}
+
+func (s *glanceSuite) TestGetLatestVersionReturnsTheLatestVersion(c *check.C) {
+	s.addImage("id1", 100)
+	s.addImage("id2", 102)
+	s.addImage("id3", 101)
+
+	ver, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ver, check.Equals, 102)
+}
+
+func (s *glanceSuite) TestGetLatestVersionReturnsVersionNotFoundError(c *check.C) {
+	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrVersionNotFound{})
+}
+
+func (s *glanceSuite) TestGetVersionsFollowsPagination(c *check.C) {
+	s.pageSize = 2
+	for i := 0; i < 5; i++ {
+		s.addImage(fmt.Sprintf("id%d", i), 100+i)
+	}
+
+	list, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.HasLen, 5)
+	c.Assert(list[0].Name, check.Equals, getImageID(s.defaultOptions, 104))
+	c.Assert(list[0].ID, check.Equals, "id4")
+	c.Assert(s.calls["GET "+glanceImagesPath], check.Equals, 3)
+}
+
+func (s *glanceSuite) TestGetVersionsReturnsListError(c *check.C) {
+	s.failPath = glanceImagesPath
+
+	_, err := s.subject.GetVersions(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+}
+
+func (s *glanceSuite) TestCreateRegistersAndUploadsImage(c *check.C) {
+	tmpFile, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString("image contents")
+	tmpFile.Close()
+	s.defaultOptions.Properties = "property1=value1,property2=value2"
+
+	err = s.subject.Create(tmpFile.Name(), s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.created["name"], check.Equals, getImageID(s.defaultOptions, testImageVersion))
+	c.Assert(s.created["disk_format"], check.Equals, "qcow2")
+	c.Assert(s.created["container_format"], check.Equals, "bare")
+	c.Assert(s.created["property1"], check.Equals, "value1")
+	c.Assert(s.created["property2"], check.Equals, "value2")
+	c.Assert(s.calls["PUT "+glanceImagesPath+"/new-image-id/file"], check.Equals, 1)
+	c.Assert(s.uploaded, check.Equals, "image contents")
+}
+
+func (s *glanceSuite) TestCreateReturnsErrReservedProperty(c *check.C) {
+	for _, properties := range []string{"name=myname", "property1=value1,visibility=public", "disk_format=raw"} {
+		s.defaultOptions.Properties = properties
+
+		err := s.subject.Create("mypath", s.defaultOptions, testImageVersion)
+
+		c.Check(err, check.FitsTypeOf, &ErrReservedProperty{})
+	}
+	c.Assert(s.calls["POST "+glanceImagesPath], check.Equals, 0)
+}
+
+func (s *glanceSuite) TestCreateUsesImageFormat(c *check.C) {
+	tmpFile, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+	s.defaultOptions.ImageFormat = "vmdk"
+
+	err = s.subject.Create(tmpFile.Name(), s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.created["disk_format"], check.Equals, "vmdk")
+	c.Assert(s.created["container_format"], check.Equals, "bare")
+}
+
+func (s *glanceSuite) TestCreateReturnsRegisterError(c *check.C) {
+	s.failPath = glanceImagesPath
+
+	err := s.subject.Create("mypath", s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+}
+
+func (s *glanceSuite) TestDeleteRemovesImagesByUUID(c *check.C) {
+	err := s.subject.Delete("id1", "id3")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id1"], check.Equals, 1)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id3"], check.Equals, 1)
+	c.Assert(s.calls["GET "+glanceImagesPath], check.Equals, 0)
+}
+
+func (s *glanceSuite) TestDeleteReturnsError(c *check.C) {
+	s.failPath = glanceImagesPath + "/id1"
+
+	err := s.subject.Delete("id1", "id2")
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id2"], check.Equals, 0)
+}
+
+func (s *glanceSuite) TestAddTagTagsImage(c *check.C) {
+	err := s.subject.AddTag("id1", "promoted")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.calls["PUT "+glanceImagesPath+"/id1/tags/promoted"], check.Equals, 1)
+}
+
+func (s *glanceSuite) TestRemoveTagUntagsImage(c *check.C) {
+	err := s.subject.RemoveTag("id1", "promoted")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id1/tags/promoted"], check.Equals, 1)
+}
+
+func (s *glanceSuite) TestAddTagReturnsError(c *check.C) {
+	s.failPath = glanceImagesPath + "/id1/tags/promoted"
+
+	err := s.subject.AddTag("id1", "promoted")
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+}
+
+func (s *glanceSuite) TestPurgeRemovesAllCustomImages(c *check.C) {
+	s.addImage("id1", 100)
+	s.images = append(s.images, glanceImage{"id": "id2", "name": "precise-desktop-amd64", "status": "active"})
+	s.defaultOptions.Release = "15.04"
+	s.addImage("id3", 102)
+
+	err := s.subject.Purge(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id1"], check.Equals, 1)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id2"], check.Equals, 0)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id3"], check.Equals, 1)
+}
+
+func (s *glanceSuite) TestListReturnsAllCustomImages(c *check.C) {
+	s.addImage("id1", 100)
+	s.images = append(s.images, glanceImage{"id": "id2", "name": "precise-desktop-amd64", "status": "active"})
+	s.defaultOptions.Release = "15.04"
+	s.addImage("id3", 102)
+
+	images, err := s.subject.List(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(recordIDs(images), check.DeepEquals, []string{"id1", "id3"})
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id1"], check.Equals, 0)
+}
+
+func (s *glanceSuite) TestCreateRemovesTheImageOfTheFailedUpload(c *check.C) {
+	tmpFile, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+	s.addImage("id1", 100)
+	s.images[0]["status"] = "queued"
+	s.failPath = glanceImagesPath + "/new-image-id/file"
+
+	err = s.subject.Create(tmpFile.Name(), s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/new-image-id"], check.Equals, 1)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/id1"], check.Equals, 0)
+	c.Assert(s.calls["GET "+glanceImagesPath], check.Equals, 0)
+}
+
+func (s *glanceSuite) TestCreateRemovesTheImageWhenTheFileCannotBeOpened(c *check.C) {
+	err := s.subject.Create("/non/existing/path", s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.calls["DELETE "+glanceImagesPath+"/new-image-id"], check.Equals, 1)
+}
+
+func (s *glanceSuite) TestGetImagesDecodesRecords(c *check.C) {
+	s.addImage("id1", 100)
+
+	images, err := s.subject.getImages()
+
+	c.Assert(err, check.IsNil)
+	c.Assert(images, check.HasLen, 1)
+	c.Assert(images[0].ID, check.Equals, "id1")
+	c.Assert(images[0].Name, check.Equals, getImageID(s.defaultOptions, 100))
+	c.Assert(images[0].Status, check.Equals, "active")
+	c.Assert(images[0].Size, check.Equals, int64(1024))
+	c.Assert(images[0].CreatedAt, check.Equals, time.Date(2016, 6, 14, 12, 0, 0, 0, time.UTC))
+	c.Assert(images[0].Properties, check.DeepEquals, map[string]string{"myproperty": "myvalue"})
+}
+
+func (s *glanceSuite) TestGetImagesInUseFollowsPagination(c *check.C) {
+	s.servers = []string{"id1", "", "id3"}
+
+	ids, err := s.subject.GetImagesInUse()
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ids, check.DeepEquals, []string{"id1", "id3"})
+	c.Assert(s.calls["GET /compute/servers/detail"], check.Equals, 4)
+}
+
+func (s *glanceSuite) TestGetImagesInUseReturnsError(c *check.C) {
+	s.failPath = "/compute/servers/detail"
+
+	_, err := s.subject.GetImagesInUse()
+
+	c.Assert(err, check.FitsTypeOf, &ErrGlanceStatus{})
+}
+
+func (s *glanceSuite) TestKeystoneV3URL(c *check.C) {
+	testCases := []struct {
+		authURL, expected string
+	}{
+		{"http://keystone:5000/v2.0", "http://keystone:5000/v3"},
+		{"http://keystone:5000/v2.0/", "http://keystone:5000/v3"},
+		{"http://keystone:5000/v3", "http://keystone:5000/v3"},
+		{"http://keystone:5000", "http://keystone:5000/v3"},
+	}
+	for _, item := range testCases {
+		c.Check(keystoneV3URL(item.authURL), check.Equals, item.expected)
+	}
+}
@@ -0,0 +1,181 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+const (
+	imageNameRoot   = "ubuntu-core/"
+	imageNameDistro = "ubuntu-"
+	imageNameCore   = "-snappy-core-"
+
+	// timestampVersionLayout is the format of the versions of the all-snaps images
+	timestampVersionLayout = "20060102150405.000000"
+)
+
+// kinds of image versions, in ascending order
+const (
+	unknownVersion = iota
+	siVersion
+	timestampVersion
+)
+
+// ImageName holds the parts of the name of an image created by the tool, which
+// is of the form:
+// ubuntu-core/<image type>/ubuntu-<release>-snappy-core-<arch>-<channel>-<version>-<suffix>
+// The channel may contain dashes, the arch, version and suffix can't
+type ImageName struct {
+	ImageType, Release, Arch, Channel, Version, Suffix string
+}
+
+// ErrImageName is the type of the error returned by ParseImageName when the
+// given name doesn't follow the naming scheme
+type ErrImageName struct {
+	name string
+}
+
+func (e *ErrImageName) Error() string {
+	return fmt.Sprintf("error image name %s doesn't follow the naming scheme", e.name)
+}
+
+// newImageName returns the name of the image for the given options and version,
+// the former names of the archs are replaced by the current ones
+func newImageName(options *flags.Options, version string) *ImageName {
+	return &ImageName{
+		ImageType: options.ImageType,
+		Release:   removeDot(options.Release),
+		Arch:      currentArch(options.Arch),
+		Channel:   image.GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel),
+		Version:   version,
+		Suffix:    imageNameSufix,
+	}
+}
+
+// Format returns the string representation of the name
+func (n *ImageName) Format() string {
+	return fmt.Sprintf("%s%s/%s%s%s%s-%s-%s-%s", imageNameRoot, n.ImageType, imageNameDistro,
+		n.Release, imageNameCore, n.Arch, n.Channel, n.Version, n.Suffix)
+}
+
+// ParseImageName is the inverse of Format, it returns ErrImageName if the given
+// name doesn't follow the naming scheme
+func ParseImageName(name string) (*ImageName, error) {
+	errName := &ErrImageName{name: name}
+	if !strings.HasPrefix(name, imageNameRoot) {
+		return nil, errName
+	}
+	rest := strings.TrimPrefix(name, imageNameRoot)
+	slash := strings.Index(rest, "/")
+	if slash < 1 || !strings.HasPrefix(rest[slash+1:], imageNameDistro) {
+		return nil, errName
+	}
+	n := &ImageName{ImageType: rest[:slash]}
+	rest = rest[slash+1+len(imageNameDistro):]
+
+	core := strings.Index(rest, imageNameCore)
+	if core < 1 {
+		return nil, errName
+	}
+	n.Release = rest[:core]
+	rest = rest[core+len(imageNameCore):]
+
+	// arch-channel-version-suffix, only the channel may contain dashes
+	first, last := strings.Index(rest, "-"), strings.LastIndex(rest, "-")
+	if first < 1 || last == len(rest)-1 {
+		return nil, errName
+	}
+	n.Arch, n.Suffix = rest[:first], rest[last+1:]
+	rest = rest[first+1 : last]
+	versionDash := strings.LastIndex(rest, "-")
+	if versionDash < 1 || versionDash == len(rest)-1 {
+		return nil, errName
+	}
+	n.Channel, n.Version = rest[:versionDash], rest[versionDash+1:]
+	return n, nil
+}
+
+// sameSeries checks if both names belong to the same image type, release, arch
+// and channel, the former names of the archs match the current ones
+func (n *ImageName) sameSeries(other *ImageName) bool {
+	return n.ImageType == other.ImageType && n.Release == other.Release &&
+		currentArch(n.Arch) == currentArch(other.Arch) && n.Channel == other.Channel
+}
+
+// currentArch returns the current name of the given arch, unknown ones are
+// returned as they are
+func currentArch(name string) string {
+	if registered, err := image.ArchFor(&flags.Options{Arch: name}); err == nil {
+		return registered.Name
+	}
+	return name
+}
+
+// CompareVersions returns -1, 0 or 1 if the image version a is older, the same
+// or newer than b. system-image versions are compared numerically, all-snaps
+// timestamps chronologically and the latter are considered newer than the former.
+// Versions of other forms are the oldest and are compared as strings
+func CompareVersions(a, b string) int {
+	kindA, kindB := versionKind(a), versionKind(b)
+	switch {
+	case kindA < kindB:
+		return -1
+	case kindA > kindB:
+		return 1
+	}
+	switch kindA {
+	case siVersion:
+		numberA, _ := strconv.ParseInt(a, 10, 64)
+		numberB, _ := strconv.ParseInt(b, 10, 64)
+		if numberA < numberB {
+			return -1
+		} else if numberA > numberB {
+			return 1
+		}
+		return 0
+	case timestampVersion:
+		timeA, _ := time.Parse(timestampVersionLayout, a)
+		timeB, _ := time.Parse(timestampVersionLayout, b)
+		if timeA.Before(timeB) {
+			return -1
+		} else if timeA.After(timeB) {
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func versionKind(version string) int {
+	if _, err := time.Parse(timestampVersionLayout, version); err == nil {
+		return timestampVersion
+	}
+	if _, err := strconv.ParseInt(version, 10, 64); err == nil {
+		return siVersion
+	}
+	return unknownVersion
+}
@@ -0,0 +1,184 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cloud
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing/quick"
+
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+var _ = check.Suite(&imageNameSuite{})
+
+type imageNameSuite struct{}
+
+// validImageName generates random names that can be represented unambiguously:
+// non empty parts, dashes only in the release and the channel
+type validImageName ImageName
+
+const nameChars = "abcdefghijklmnopqrstuvwxyz0123456789._"
+
+func randomPart(rand *rand.Rand, withDashes bool) string {
+	chars := nameChars
+	if withDashes {
+		chars += "-"
+	}
+	part := make([]byte, 1+rand.Intn(12))
+	for i := range part {
+		part[i] = chars[rand.Intn(len(chars))]
+	}
+	if withDashes {
+		// the dashes can't be at the edges
+		part[0], part[len(part)-1] = 'a', 'z'
+	}
+	return string(part)
+}
+
+func (validImageName) Generate(rand *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(validImageName{
+		ImageType: randomPart(rand, true),
+		Release:   randomPart(rand, true),
+		Arch:      randomPart(rand, false),
+		Channel:   randomPart(rand, true),
+		Version:   randomPart(rand, false),
+		Suffix:    randomPart(rand, false),
+	})
+}
+
+func (s *imageNameSuite) TestParseIsTheInverseOfFormat(c *check.C) {
+	roundTrip := func(generated validImageName) bool {
+		name := ImageName(generated)
+		parsed, err := ParseImageName(name.Format())
+		return err == nil && *parsed == name
+	}
+
+	c.Assert(quick.Check(roundTrip, nil), check.IsNil)
+}
+
+func (s *imageNameSuite) TestParseImageName(c *check.C) {
+	testCases := []struct {
+		name     string
+		expected ImageName
+	}{
+		{"ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-100-disk1.img",
+			ImageName{"custom", "rolling", "amd64", "edge", "100", "disk1.img"}},
+		{"ubuntu-core/custom/ubuntu-1604-snappy-core-armhf-stable-20160614120000.000000-disk1.img",
+			ImageName{"custom", "1604", "armhf", "stable", "20160614120000.000000", "disk1.img"}},
+		{"ubuntu-core/my-type/ubuntu-rolling-snappy-core-i386-edge-my-branch-300-disk1.img",
+			ImageName{"my-type", "rolling", "i386", "edge-my-branch", "300", "disk1.img"}},
+	}
+	for _, item := range testCases {
+		parsed, err := ParseImageName(item.name)
+
+		c.Check(err, check.IsNil)
+		c.Check(*parsed, check.DeepEquals, item.expected)
+	}
+}
+
+func (s *imageNameSuite) TestParseImageNameReturnsErrImageName(c *check.C) {
+	for _, name := range []string{
+		"",
+		"precise-desktop-amd64",
+		"ubuntu-core/custom",
+		"ubuntu-core//ubuntu-rolling-snappy-core-amd64-edge-100-disk1.img",
+		"ubuntu-core/custom/rolling-snappy-core-amd64-edge-100-disk1.img",
+		"ubuntu-core/custom/ubuntu-rolling-amd64-edge-100-disk1.img",
+		"ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-100-disk1.img",
+		"ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge--disk1.img",
+		"ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-100-",
+	} {
+		_, err := ParseImageName(name)
+
+		c.Check(err, check.FitsTypeOf, &ErrImageName{}, check.Commentf(name))
+	}
+}
+
+func (s *imageNameSuite) TestCompareVersions(c *check.C) {
+	testCases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"100", "100", 0},
+		{"99", "100", -1},
+		{"100", "99", 1},
+		{"20160614120000.000000", "20160614120000.000000", 0},
+		{"20160614120000.000000", "20160615000000.000000", -1},
+		{"20160614120000.000001", "20160614120000.000000", 1},
+		{"300", "20160614120000.000000", -1},
+		{"20160614120000.000000", "300", 1},
+		{"latest", "1", -1},
+		{"a", "b", -1},
+	}
+	for _, item := range testCases {
+		c.Check(CompareVersions(item.a, item.b), check.Equals, item.expected, check.Commentf("%s vs %s", item.a, item.b))
+	}
+}
+
+func (s *imageNameSuite) TestGetImageIDFormatsImageName(c *check.C) {
+	options := &flags.Options{Release: "16.04", Arch: "armhf", ImageType: "custom",
+		OSChannel: "edge", KernelChannel: "my-branch", GadgetChannel: "my-branch"}
+
+	name := GetImageID(options, 100)
+
+	c.Assert(name, check.Equals, "ubuntu-core/custom/ubuntu-1604-snappy-core-armhf-my-branch-100-disk1.img")
+}
+
+func (s *imageNameSuite) TestGetImageIDUsesCurrentArchName(c *check.C) {
+	options := &flags.Options{Release: "15.04", Arch: "arm", ImageType: "custom",
+		OSChannel: "edge", KernelChannel: "edge", GadgetChannel: "edge"}
+
+	name := GetImageID(options, 100)
+
+	c.Assert(name, check.Equals, "ubuntu-core/custom/ubuntu-1504-snappy-core-armhf-edge-100-disk1.img")
+}
+
+func (s *imageNameSuite) TestGetImageIDUsesTimestampForAllSnaps(c *check.C) {
+	options := &flags.Options{Release: "rolling", Arch: "amd64", ImageType: "custom",
+		OSChannel: "edge", KernelChannel: "edge", GadgetChannel: "edge"}
+
+	parsed, err := ParseImageName(GetImageID(options, 0))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(parsed.Version, "."), check.Equals, true)
+	c.Assert(parsed.Channel, check.Equals, "edge")
+}
+
+func (s *imageNameSuite) TestLegacyArchNameIsInSeriesOfCurrentArch(c *check.C) {
+	options := &flags.Options{Release: "15.04", Arch: "armhf", ImageType: "custom",
+		OSChannel: "edge", KernelChannel: "edge", GadgetChannel: "edge"}
+
+	legacy := "ubuntu-core/custom/ubuntu-1504-snappy-core-arm-edge-100-disk1.img"
+
+	c.Assert(inSeries(legacy, newImageName(options, "")), check.Equals, true)
+}
+
+func (s *imageNameSuite) TestOtherArchIsNotInSeries(c *check.C) {
+	options := &flags.Options{Release: "15.04", Arch: "armhf", ImageType: "custom",
+		OSChannel: "edge", KernelChannel: "edge", GadgetChannel: "edge"}
+
+	other := "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-100-disk1.img"
+
+	c.Assert(inSeries(other, newImageName(options, "")), check.Equals, false)
+}
@@ -22,7 +22,9 @@ package flags
 
 import (
 	"flag"
+	"fmt"
 	"strconv"
+	"time"
 )
 
 // Options has fields for the existing flags
@@ -31,7 +33,12 @@ type Options struct {
 	Arch, LogLevel, Qcow2compat,
 	OS, Kernel, Gadget, ImageType,
 	OSChannel, GadgetChannel, KernelChannel,
-	Properties string
+	Properties, Backend, RetentionConfig,
+	Matrix, File, Output, Format, Image, ImageFormat, Driver, Model,
+	SIKeyring, StoreKeyring, ManifestKey, SIServer, SIChannelPrefix, SIDevice string
+	Keep, Jobs, UploadRetries, SIVersion        int
+	KeepYoungerThan, SmokeTestTimeout           time.Duration
+	DryRun, KeepImage, SmokeTest, Qcow2Compress bool
 }
 
 const (
@@ -40,30 +47,57 @@ const (
 	defaultArch          = "amd64"
 	defaultLogLevel      = "info"
 	defaultQcow2compat   = "1.1"
-	defaultKernel        = "canonical-pc-linux"
 	defaultOS            = "ubuntu-core"
-	defaultGadget        = "canonical-pc"
 	defaultImageType     = "custom"
 	defaultOSChannel     = "edge"
 	defaultGadgetChannel = "edge"
 	defaultKernelChannel = "edge"
 	defaultProperties    = ""
+	defaultBackend       = "cli"
+	defaultKeep          = 3
+	defaultJobs          = 1
+	defaultUploadRetries = 3
+	defaultOutput        = "."
+	defaultFormat        = "table"
+	defaultSmokeTimeout  = 10 * time.Minute
+	defaultImageFormat   = "qcow2"
+	defaultDriver        = "udf"
 )
 
+// ErrFlagValue is the type of the error returned by Validate when a flag has
+// a value that can't be used
+type ErrFlagValue struct {
+	name, value, msg string
+}
+
+func (e *ErrFlagValue) Error() string {
+	return fmt.Sprintf("error invalid value %s for -%s: %s", e.value, e.name, e.msg)
+}
+
 // Parse analyzes the flags and returns a Options instance with the values
 func Parse() *Options {
 	var (
-		action      = flag.String("action", defaultAction, "action to be performed")
-		release     = flag.String("release", defaultRelease, "release of the image to be created")
-		arch        = flag.String("arch", defaultArch, "arch of the image to be created")
-		logLevel    = flag.String("loglevel", defaultLogLevel, "Level of the log putput, one of debug, info, warning, error, fatal, panic")
-		qcow2compat = flag.String("qcow2compat", defaultQcow2compat, "Qcow2 compatibility level (0.10 or 1.1)")
-		os          = flag.String("os", defaultOS,
-			"OS snap of the image to be built, defaults to "+defaultOS)
-		kernel = flag.String("kernel", defaultKernel,
-			"Kernel snap of the image to be built, defaults to "+defaultKernel)
-		gadget = flag.String("gadget", defaultGadget,
-			"Gadget snap of the image to be built, defaults to "+defaultGadget)
+		action        = flag.String("action", defaultAction, "action to be performed")
+		release       = flag.String("release", defaultRelease, "release of the image to be created")
+		arch          = flag.String("arch", defaultArch, "arch of the image to be created, one of amd64, i386, armhf or arm64")
+		logLevel      = flag.String("loglevel", defaultLogLevel, "Level of the log putput, one of debug, info, warning, error, fatal, panic")
+		qcow2compat   = flag.String("qcow2compat", defaultQcow2compat, "Qcow2 compatibility level (0.10 or 1.1)")
+		imageFormat   = flag.String("image-format", defaultImageFormat, "Format of the image to be created, one of raw, qcow2, vmdk or vhd")
+		qcow2Compress = flag.Bool("qcow2-compress", false, "Compress the qcow2 images")
+		driver        = flag.String("driver", defaultDriver, "Tool used for creating the images, one of udf or ubuntu-image")
+		model         = flag.String("model", "", "Path of the model assertion the images are built from with the ubuntu-image driver")
+		siKeyring     = flag.String("si-keyring", "", "Path of the GPG keyring used for verifying the signatures of the system-image files")
+		storeKeyring  = flag.String("store-keyring", "", "Path of the GPG keyring used for verifying the signatures of the snap-revision assertions of the downloaded snaps")
+		manifestKey   = flag.String("manifest-key", "", "Path of the GPG secret keyring used for signing the image manifests")
+		siServer      = flag.String("si-server", "", "URL of the system-image server, defaults to http://system-image.ubuntu.com")
+		siPrefix      = flag.String("si-channel-prefix", "", "Path of the channels in the system-image server, defaults to ubuntu-core")
+		siDevice      = flag.String("si-device", "", "Device of the system-image channels, defaults to generic_<arch>")
+		os            = flag.String("os", defaultOS,
+			"OS snap of the image to be built, a store name, a name@revision pin or a local .snap file, defaults to "+defaultOS)
+		kernel = flag.String("kernel", "",
+			"Kernel snap of the image to be built, a store name, a name@revision pin or a local .snap file, defaults to the kernel of the arch")
+		gadget = flag.String("gadget", "",
+			"Gadget snap of the image to be built, a store name, a name@revision pin or a local .snap file, defaults to the gadget of the arch")
 		imageType = flag.String("image-type", defaultImageType,
 			"Type of image to be built, this string will be put in the image name. Defaults to "+defaultImageType)
 		osChannel = flag.String("os-channel", defaultOSChannel,
@@ -73,24 +107,89 @@ func Parse() *Options {
 		kernelChannel = flag.String("kernel-channel", defaultKernelChannel,
 			"Store channel to be used for the kernel snap.")
 		properties = flag.String("properties", defaultProperties, "Properties to use when uploading the image")
+		backend    = flag.String("backend", defaultBackend,
+			"Backend used to interact with the cloud, cli (openstack command line client) or api (Keystone v3 and Glance v2 REST APIs)")
+		keep            = flag.Int("keep", defaultKeep, "Number of newest images to keep on cleanup")
+		keepYoungerThan = flag.Duration("keep-younger-than", 0,
+			"Images younger than this duration are kept on cleanup, 0 disables the check")
+		retentionConfig = flag.String("retention-config", "",
+			"YAML file with the retention policies per release, channel and arch, overrides -keep and -keep-younger-than for the matching images")
+		matrix = flag.String("matrix", "",
+			"YAML file with a list of image specs, the action is performed for each of them using the values of the flags for the fields not set")
+		jobs = flag.Int("jobs", defaultJobs,
+			"Maximum number of image specs of the matrix config file processed concurrently")
+		uploadRetries = flag.Int("upload-retries", defaultUploadRetries,
+			"Number of times a failed upload is retried, waiting exponentially longer between attempts")
+		keepImage = flag.Bool("keep-image", false,
+			"Keep the created image file on disk, so that it can be uploaded later with the upload action")
+		file      = flag.String("file", "", "Image file to be uploaded by the upload action")
+		siVersion = flag.Int("si-version", 0,
+			"System-image version of the 15.04 image file uploaded by the upload action, defaults to the one in the manifest written next to it by the build action")
+		output = flag.String("output", defaultOutput,
+			"Directory where the build action writes the image file and its manifest")
+		smokeTest = flag.Bool("smoke-test", false,
+			"Boot the created image with QEMU before uploading it, the image is not uploaded if it doesn't boot")
+		smokeTestTimeout = flag.Duration("smoke-test-timeout", defaultSmokeTimeout,
+			"Maximum time to wait for the image to boot in the smoke test")
+		image  = flag.String("image", "", "Name or version of the image to be promoted by the promote action")
+		format = flag.String("format", defaultFormat, "Output format of the list action, table or json")
+		dryRun = flag.Bool("dry-run", false,
+			"Report the commands that would be executed and the images that would be created or removed without modifying anything")
 	)
 	flag.Parse()
 	dotRelease := addDot(*release)
 	return &Options{
-		Action:        *action,
-		Release:       dotRelease,
-		Arch:          *arch,
-		LogLevel:      *logLevel,
-		Qcow2compat:   *qcow2compat,
-		OS:            *os,
-		Kernel:        *kernel,
-		Gadget:        *gadget,
-		ImageType:     *imageType,
-		OSChannel:     *osChannel,
-		GadgetChannel: *gadgetChannel,
-		KernelChannel: *kernelChannel,
-		Properties:    *properties,
+		Action:           *action,
+		Release:          dotRelease,
+		Arch:             *arch,
+		LogLevel:         *logLevel,
+		Qcow2compat:      *qcow2compat,
+		ImageFormat:      *imageFormat,
+		Qcow2Compress:    *qcow2Compress,
+		Driver:           *driver,
+		Model:            *model,
+		SIKeyring:        *siKeyring,
+		StoreKeyring:     *storeKeyring,
+		ManifestKey:      *manifestKey,
+		SIServer:         *siServer,
+		SIChannelPrefix:  *siPrefix,
+		SIDevice:         *siDevice,
+		OS:               *os,
+		Kernel:           *kernel,
+		Gadget:           *gadget,
+		ImageType:        *imageType,
+		OSChannel:        *osChannel,
+		GadgetChannel:    *gadgetChannel,
+		KernelChannel:    *kernelChannel,
+		Properties:       *properties,
+		Backend:          *backend,
+		Keep:             *keep,
+		KeepYoungerThan:  *keepYoungerThan,
+		RetentionConfig:  *retentionConfig,
+		Matrix:           *matrix,
+		Jobs:             *jobs,
+		UploadRetries:    *uploadRetries,
+		KeepImage:        *keepImage,
+		File:             *file,
+		SIVersion:        *siVersion,
+		Output:           *output,
+		Format:           *format,
+		Image:            *image,
+		SmokeTest:        *smokeTest,
+		SmokeTestTimeout: *smokeTestTimeout,
+		DryRun:           *dryRun,
+	}
+}
+
+// Validate checks the values of the options that would make the actions misbehave
+func (o *Options) Validate() error {
+	if o.Keep < 0 {
+		return &ErrFlagValue{name: "keep", value: strconv.Itoa(o.Keep), msg: "the number of images to keep can't be negative"}
+	}
+	if o.SIVersion < 0 {
+		return &ErrFlagValue{name: "si-version", value: strconv.Itoa(o.SIVersion), msg: "system-image versions can't be negative"}
 	}
+	return nil
 }
 
 func addDot(release string) string {
@@ -22,6 +22,7 @@ import (
 	"flag"
 	"os"
 	"testing"
+	"time"
 
 	"gopkg.in/check.v1"
 )
@@ -88,13 +89,13 @@ func (s *flagsSuite) TestParseDefaultOs(c *check.C) {
 func (s *flagsSuite) TestParseDefaultKernel(c *check.C) {
 	parsedFlags := Parse()
 
-	c.Assert(parsedFlags.Kernel, check.Equals, defaultKernel)
+	c.Assert(parsedFlags.Kernel, check.Equals, "")
 }
 
 func (s *flagsSuite) TestParseDefaultGadget(c *check.C) {
 	parsedFlags := Parse()
 
-	c.Assert(parsedFlags.Gadget, check.Equals, defaultGadget)
+	c.Assert(parsedFlags.Gadget, check.Equals, "")
 }
 
 func (s *flagsSuite) TestParseDefaultImageType(c *check.C) {
@@ -237,6 +238,314 @@ func (s *flagsSuite) TestParseSetsPropertiesToFlagValue(c *check.C) {
 	c.Assert(parsedFlags.Properties, check.Equals, testProperties)
 }
 
+func (s *flagsSuite) TestParseDefaultBackend(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Backend, check.Equals, defaultBackend)
+}
+
+func (s *flagsSuite) TestParseSetsBackendToFlagValue(c *check.C) {
+	os.Args = []string{"", "-backend", "mybackend"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Backend, check.Equals, "mybackend")
+}
+
+func (s *flagsSuite) TestParseDefaultKeep(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Keep, check.Equals, defaultKeep)
+}
+
+func (s *flagsSuite) TestParseSetsKeepToFlagValue(c *check.C) {
+	os.Args = []string{"", "-keep", "7"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Keep, check.Equals, 7)
+}
+
+func (s *flagsSuite) TestValidateRejectsNegativeKeep(c *check.C) {
+	os.Args = []string{"", "-keep", "-1"}
+	parsedFlags := Parse()
+
+	err := parsedFlags.Validate()
+
+	c.Assert(err, check.FitsTypeOf, &ErrFlagValue{})
+	c.Assert(err.Error(), check.Equals, "error invalid value -1 for -keep: the number of images to keep can't be negative")
+}
+
+func (s *flagsSuite) TestParseSetsSIVersionToFlagValue(c *check.C) {
+	os.Args = []string{"", "-si-version", "42"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.SIVersion, check.Equals, 42)
+}
+
+func (s *flagsSuite) TestValidateRejectsNegativeSIVersion(c *check.C) {
+	os.Args = []string{"", "-si-version", "-2"}
+	parsedFlags := Parse()
+
+	err := parsedFlags.Validate()
+
+	c.Assert(err, check.FitsTypeOf, &ErrFlagValue{})
+}
+
+func (s *flagsSuite) TestValidateAcceptsDefaultOptions(c *check.C) {
+	c.Assert(Parse().Validate(), check.IsNil)
+}
+
+func (s *flagsSuite) TestParseDefaultKeepYoungerThan(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.KeepYoungerThan, check.Equals, time.Duration(0))
+}
+
+func (s *flagsSuite) TestParseSetsKeepYoungerThanToFlagValue(c *check.C) {
+	os.Args = []string{"", "-keep-younger-than", "72h"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.KeepYoungerThan, check.Equals, 72*time.Hour)
+}
+
+func (s *flagsSuite) TestParseDefaultRetentionConfig(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.RetentionConfig, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsRetentionConfigToFlagValue(c *check.C) {
+	os.Args = []string{"", "-retention-config", "myretention.yaml"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.RetentionConfig, check.Equals, "myretention.yaml")
+}
+
+func (s *flagsSuite) TestParseDefaultDryRun(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.DryRun, check.Equals, false)
+}
+
+func (s *flagsSuite) TestParseSetsDryRunToFlagValue(c *check.C) {
+	os.Args = []string{"", "-dry-run"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.DryRun, check.Equals, true)
+}
+
+func (s *flagsSuite) TestParseDefaultMatrix(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Matrix, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsMatrixToFlagValue(c *check.C) {
+	os.Args = []string{"", "-matrix", "mymatrix.yaml"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Matrix, check.Equals, "mymatrix.yaml")
+}
+
+func (s *flagsSuite) TestParseDefaultJobs(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Jobs, check.Equals, defaultJobs)
+}
+
+func (s *flagsSuite) TestParseSetsJobsToFlagValue(c *check.C) {
+	os.Args = []string{"", "-jobs", "4"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Jobs, check.Equals, 4)
+}
+
+func (s *flagsSuite) TestParseDefaultUploadRetries(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.UploadRetries, check.Equals, defaultUploadRetries)
+}
+
+func (s *flagsSuite) TestParseSetsUploadRetriesToFlagValue(c *check.C) {
+	os.Args = []string{"", "-upload-retries", "5"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.UploadRetries, check.Equals, 5)
+}
+
+func (s *flagsSuite) TestParseDefaultKeepImage(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.KeepImage, check.Equals, false)
+}
+
+func (s *flagsSuite) TestParseSetsKeepImageToFlagValue(c *check.C) {
+	os.Args = []string{"", "-keep-image"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.KeepImage, check.Equals, true)
+}
+
+func (s *flagsSuite) TestParseDefaultFile(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.File, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsFileToFlagValue(c *check.C) {
+	os.Args = []string{"", "-file", "/tmp/image.img"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.File, check.Equals, "/tmp/image.img")
+}
+
+func (s *flagsSuite) TestParseDefaultOutput(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Output, check.Equals, defaultOutput)
+}
+
+func (s *flagsSuite) TestParseSetsOutputToFlagValue(c *check.C) {
+	os.Args = []string{"", "-output", "/tmp/images"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Output, check.Equals, "/tmp/images")
+}
+
+func (s *flagsSuite) TestParseDefaultFormat(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Format, check.Equals, defaultFormat)
+}
+
+func (s *flagsSuite) TestParseSetsFormatToFlagValue(c *check.C) {
+	os.Args = []string{"", "-format", "json"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Format, check.Equals, "json")
+}
+
+func (s *flagsSuite) TestParseDefaultImage(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Image, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsImageToFlagValue(c *check.C) {
+	os.Args = []string{"", "-image", "100"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Image, check.Equals, "100")
+}
+
+func (s *flagsSuite) TestParseDefaultImageFormat(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.ImageFormat, check.Equals, defaultImageFormat)
+}
+
+func (s *flagsSuite) TestParseSetsImageFormatToFlagValue(c *check.C) {
+	os.Args = []string{"", "-image-format", "vmdk"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.ImageFormat, check.Equals, "vmdk")
+}
+
+func (s *flagsSuite) TestParseDefaultQcow2Compress(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Qcow2Compress, check.Equals, false)
+}
+
+func (s *flagsSuite) TestParseSetsQcow2CompressToFlagValue(c *check.C) {
+	os.Args = []string{"", "-qcow2-compress"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Qcow2Compress, check.Equals, true)
+}
+
+func (s *flagsSuite) TestParseDefaultDriver(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Driver, check.Equals, defaultDriver)
+}
+
+func (s *flagsSuite) TestParseSetsDriverToFlagValue(c *check.C) {
+	os.Args = []string{"", "-driver", "ubuntu-image"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Driver, check.Equals, "ubuntu-image")
+}
+
+func (s *flagsSuite) TestParseDefaultModel(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Model, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsModelToFlagValue(c *check.C) {
+	os.Args = []string{"", "-model", "/tmp/pc.model"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.Model, check.Equals, "/tmp/pc.model")
+}
+
+func (s *flagsSuite) TestParseDefaultSIKeyring(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.SIKeyring, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsSIKeyringToFlagValue(c *check.C) {
+	os.Args = []string{"", "-si-keyring", "/tmp/keyring.gpg"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.SIKeyring, check.Equals, "/tmp/keyring.gpg")
+}
+
+func (s *flagsSuite) TestParseDefaultStoreKeyring(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.StoreKeyring, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsStoreKeyringToFlagValue(c *check.C) {
+	os.Args = []string{"", "-store-keyring", "/tmp/store.gpg"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.StoreKeyring, check.Equals, "/tmp/store.gpg")
+}
+
+func (s *flagsSuite) TestParseDefaultManifestKey(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.ManifestKey, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsManifestKeyToFlagValue(c *check.C) {
+	os.Args = []string{"", "-manifest-key", "/tmp/secring.gpg"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.ManifestKey, check.Equals, "/tmp/secring.gpg")
+}
+
+func (s *flagsSuite) TestParseDefaultSIServer(c *check.C) {
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.SIServer, check.Equals, "")
+	c.Assert(parsedFlags.SIChannelPrefix, check.Equals, "")
+	c.Assert(parsedFlags.SIDevice, check.Equals, "")
+}
+
+func (s *flagsSuite) TestParseSetsSIServerToFlagValues(c *check.C) {
+	os.Args = []string{"", "-si-server", "https://si.example.com",
+		"-si-channel-prefix", "staging", "-si-device", "generic_pc"}
+	parsedFlags := Parse()
+
+	c.Assert(parsedFlags.SIServer, check.Equals, "https://si.example.com")
+	c.Assert(parsedFlags.SIChannelPrefix, check.Equals, "staging")
+	c.Assert(parsedFlags.SIDevice, check.Equals, "generic_pc")
+}
+
 // from flag.ResetForTesting
 func resetFlag(usage func()) {
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
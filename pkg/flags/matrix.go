@@ -0,0 +1,108 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package flags
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// matrixEntry is the representation of an image spec in the matrix config file,
+// empty values are taken from the flags
+type matrixEntry struct {
+	Release       string `yaml:"release"`
+	Arch          string `yaml:"arch"`
+	OS            string `yaml:"os"`
+	Kernel        string `yaml:"kernel"`
+	Gadget        string `yaml:"gadget"`
+	OSChannel     string `yaml:"os-channel"`
+	KernelChannel string `yaml:"kernel-channel"`
+	GadgetChannel string `yaml:"gadget-channel"`
+	ImageType     string `yaml:"image-type"`
+	Properties    string `yaml:"properties"`
+	Qcow2compat   string `yaml:"qcow2compat"`
+	ImageFormat   string `yaml:"image-format"`
+	Model         string `yaml:"model"`
+}
+
+// ErrMatrixConfig is the type of the error returned when the matrix config
+// file can't be parsed
+type ErrMatrixConfig struct {
+	path, msg string
+}
+
+func (e *ErrMatrixConfig) Error() string {
+	return fmt.Sprintf("error in matrix config %s: %s", e.path, e.msg)
+}
+
+// ReadMatrix returns an Options instance for each of the image specs defined in
+// the given YAML file, the values not set in a spec are taken from base. The file
+// has the form:
+//
+//   - release: 16.04
+//     arch: amd64
+//     os-channel: stable
+//     kernel-channel: stable
+//     gadget-channel: stable
+//   - release: 16.04
+//     arch: armhf
+//     kernel: pi2-kernel
+//     gadget: pi2
+func ReadMatrix(path string, base *Options) ([]*Options, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []matrixEntry
+	if err = yaml.Unmarshal(content, &entries); err != nil {
+		return nil, &ErrMatrixConfig{path: path, msg: err.Error()}
+	}
+	if len(entries) == 0 {
+		return nil, &ErrMatrixConfig{path: path, msg: "no image specs defined"}
+	}
+	matrix := make([]*Options, len(entries))
+	for i, entry := range entries {
+		options := *base
+		options.Matrix = ""
+		override(&options.Release, addDot(entry.Release))
+		override(&options.Arch, entry.Arch)
+		override(&options.OS, entry.OS)
+		override(&options.Kernel, entry.Kernel)
+		override(&options.Gadget, entry.Gadget)
+		override(&options.OSChannel, entry.OSChannel)
+		override(&options.KernelChannel, entry.KernelChannel)
+		override(&options.GadgetChannel, entry.GadgetChannel)
+		override(&options.ImageType, entry.ImageType)
+		override(&options.Properties, entry.Properties)
+		override(&options.Qcow2compat, entry.Qcow2compat)
+		override(&options.ImageFormat, entry.ImageFormat)
+		override(&options.Model, entry.Model)
+		matrix[i] = &options
+	}
+	return matrix, nil
+}
+
+func override(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package flags
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&matrixSuite{})
+
+type matrixSuite struct {
+	base *Options
+	path string
+}
+
+func (s *matrixSuite) SetUpTest(c *check.C) {
+	s.base = &Options{
+		Action:        "create",
+		Release:       defaultRelease,
+		Arch:          defaultArch,
+		OS:            defaultOS,
+		OSChannel:     defaultOSChannel,
+		KernelChannel: defaultKernelChannel,
+		GadgetChannel: defaultGadgetChannel,
+		ImageType:     defaultImageType,
+		Qcow2compat:   defaultQcow2compat,
+		ImageFormat:   defaultImageFormat,
+		Matrix:        "matrix.yaml",
+	}
+	s.path = ""
+}
+
+func (s *matrixSuite) TearDownTest(c *check.C) {
+	if s.path != "" {
+		os.Remove(s.path)
+	}
+}
+
+func (s *matrixSuite) writeMatrix(c *check.C, content string) {
+	file, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	_, err = file.WriteString(content)
+	c.Assert(err, check.IsNil)
+	s.path = file.Name()
+}
+
+func (s *matrixSuite) TestReadMatrixReturnsOptionsForEachSpec(c *check.C) {
+	s.writeMatrix(c, `
+- release: 15.10
+  arch: i386
+- release: "1604"
+  arch: armhf
+  os: myos
+  kernel: mykernel
+  gadget: mygadget
+  os-channel: beta
+  kernel-channel: stable
+  gadget-channel: candidate
+  image-type: myimagetype
+  properties: property1=value1
+  qcow2compat: "0.10"
+  image-format: vmdk
+  model: /tmp/armhf.model
+`)
+
+	matrix, err := ReadMatrix(s.path, s.base)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(matrix, check.HasLen, 2)
+
+	first := *s.base
+	first.Matrix = ""
+	first.Release = "15.10"
+	first.Arch = "i386"
+	c.Assert(*matrix[0], check.DeepEquals, first)
+
+	c.Assert(*matrix[1], check.DeepEquals, Options{
+		Action:        "create",
+		Release:       "16.04",
+		Arch:          "armhf",
+		OS:            "myos",
+		Kernel:        "mykernel",
+		Gadget:        "mygadget",
+		OSChannel:     "beta",
+		KernelChannel: "stable",
+		GadgetChannel: "candidate",
+		ImageType:     "myimagetype",
+		Properties:    "property1=value1",
+		Qcow2compat:   "0.10",
+		ImageFormat:   "vmdk",
+		Model:         "/tmp/armhf.model",
+	})
+}
+
+func (s *matrixSuite) TestReadMatrixDoesNotModifyBase(c *check.C) {
+	s.writeMatrix(c, "- arch: i386\n")
+	expected := *s.base
+
+	ReadMatrix(s.path, s.base)
+
+	c.Assert(*s.base, check.DeepEquals, expected)
+}
+
+func (s *matrixSuite) TestReadMatrixReturnsConfigErrors(c *check.C) {
+	for _, content := range []string{"not a list", "", "- arch: [i386, amd64]\n"} {
+		s.writeMatrix(c, content)
+
+		_, err := ReadMatrix(s.path, s.base)
+		os.Remove(s.path)
+
+		c.Check(err, check.FitsTypeOf, &ErrMatrixConfig{})
+	}
+}
+
+func (s *matrixSuite) TestReadMatrixReturnsReadError(c *check.C) {
+	_, err := ReadMatrix("/non/existing/file", s.base)
+
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,115 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+// Arch describes how the images of an architecture are built and booted
+type Arch struct {
+	// Name is the value of -arch and the arch in the image names
+	Name string
+	// SISuffix is the suffix of the system-image device, generic_<suffix>
+	SISuffix string
+	// Gadget and Kernel are the snaps used when -gadget and -kernel are not given
+	Gadget, Kernel string
+	// OEM is the oem snap of the 15.04 images, if any
+	OEM string
+	// QemuSystem and QemuMachine are the QEMU binary and machine type used for
+	// booting the images
+	QemuSystem, QemuMachine string
+	// QemuCPU is the CPU emulated when KVM is not used, the default one of the
+	// machine if empty
+	QemuCPU string
+	// QemuFirmware is the UEFI firmware booted by QEMU, the BIOS of the machine
+	// if empty. The virt machine has no firmware of its own
+	QemuFirmware string
+	// KVM tells if the images can be booted with KVM on amd64 hosts
+	KVM bool
+}
+
+var (
+	// archs are the supported architectures indexed by name
+	archs = map[string]*Arch{
+		"amd64": {Name: "amd64", SISuffix: "amd64", Gadget: "canonical-pc", Kernel: "canonical-pc-linux",
+			QemuSystem: "qemu-system-x86_64", QemuMachine: "pc", KVM: true},
+		"i386": {Name: "i386", SISuffix: "i386", Gadget: "canonical-i386", Kernel: "canonical-i386-linux",
+			QemuSystem: "qemu-system-i386", QemuMachine: "pc", KVM: true},
+		"armhf": {Name: "armhf", SISuffix: "armhf", Gadget: "canonical-pi2", Kernel: "canonical-pi2-linux",
+			OEM: "beagleblack", QemuSystem: "qemu-system-arm", QemuMachine: "virt",
+			QemuCPU: "cortex-a15", QemuFirmware: "/usr/share/AAVMF/AAVMF32_CODE.fd"},
+		"arm64": {Name: "arm64", SISuffix: "arm64", Gadget: "canonical-dragon", Kernel: "canonical-snapdragon-linux",
+			QemuSystem: "qemu-system-aarch64", QemuMachine: "virt",
+			QemuCPU: "cortex-a57", QemuFirmware: "/usr/share/AAVMF/AAVMF_CODE.fd"},
+	}
+
+	// archAliases are the former names of the architectures
+	archAliases = map[string]string{
+		"arm": "armhf",
+	}
+)
+
+// ErrUnknownArch is the type of the error returned when the requested
+// architecture is not supported
+type ErrUnknownArch struct {
+	arch string
+}
+
+func (e *ErrUnknownArch) Error() string {
+	return fmt.Sprintf("error unknown arch %s, supported archs are %s", e.arch, strings.Join(archNames(), ", "))
+}
+
+// ArchFor returns the architecture given in options
+func ArchFor(options *flags.Options) (*Arch, error) {
+	name := options.Arch
+	if alias, ok := archAliases[name]; ok {
+		name = alias
+	}
+	arch, ok := archs[name]
+	if !ok {
+		return nil, &ErrUnknownArch{arch: options.Arch}
+	}
+	return arch, nil
+}
+
+// defaultSnap returns the snap used for the given role when none is given
+func (a *Arch) defaultSnap(role string) string {
+	switch role {
+	case "kernel":
+		return a.Kernel
+	case "gadget":
+		return a.Gadget
+	}
+	return ""
+}
+
+func archNames() []string {
+	var names []string
+	for name := range archs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+var _ = check.Suite(&archSuite{})
+
+type archSuite struct{}
+
+func (s *archSuite) TestArchForReturnsRequestedArch(c *check.C) {
+	testCases := []struct {
+		arch, name, siSuffix, qemuSystem string
+	}{
+		{"amd64", "amd64", "amd64", "qemu-system-x86_64"},
+		{"i386", "i386", "i386", "qemu-system-i386"},
+		{"armhf", "armhf", "armhf", "qemu-system-arm"},
+		{"arm", "armhf", "armhf", "qemu-system-arm"},
+		{"arm64", "arm64", "arm64", "qemu-system-aarch64"},
+	}
+	for _, item := range testCases {
+		arch, err := ArchFor(&flags.Options{Arch: item.arch})
+
+		c.Check(err, check.IsNil)
+		c.Check(arch.Name, check.Equals, item.name)
+		c.Check(arch.SISuffix, check.Equals, item.siSuffix)
+		c.Check(arch.QemuSystem, check.Equals, item.qemuSystem)
+	}
+}
+
+func (s *archSuite) TestArchForReturnsErrorForUnknownArch(c *check.C) {
+	_, err := ArchFor(&flags.Options{Arch: "sparc"})
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnknownArch{})
+	c.Assert(err.Error(), check.Equals, "error unknown arch sparc, supported archs are amd64, arm64, armhf, i386")
+}
+
+func (s *archSuite) TestSnapSpecUsesSnapsOfArchByDefault(c *check.C) {
+	options := &flags.Options{Arch: "i386", OS: "ubuntu-core", KernelChannel: "edge", GadgetChannel: "beta"}
+
+	kernel, kernelChannel := snapSpec(options, "kernel")
+	gadget, gadgetChannel := snapSpec(options, "gadget")
+
+	c.Assert(kernel, check.Equals, "canonical-i386-linux")
+	c.Assert(kernelChannel, check.Equals, "edge")
+	c.Assert(gadget, check.Equals, "canonical-i386")
+	c.Assert(gadgetChannel, check.Equals, "beta")
+}
+
+func (s *archSuite) TestSnapSpecKeepsGivenSnaps(c *check.C) {
+	options := &flags.Options{Arch: "i386", Kernel: "mykernel"}
+
+	kernel, _ := snapSpec(options, "kernel")
+
+	c.Assert(kernel, check.Equals, "mykernel")
+}
@@ -0,0 +1,106 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+// DefaultFormat is the format used when none is given
+const DefaultFormat = "qcow2"
+
+// Format describes an output format of the images
+type Format struct {
+	// Name is the value of -image-format and the Glance disk format
+	Name string
+	// QemuFormat is the name of the format for qemu-img
+	QemuFormat string
+	// ContainerFormat is the Glance container format
+	ContainerFormat string
+	// Extension is the extension of the image files
+	Extension string
+}
+
+// formats are the supported output formats indexed by name
+var formats = map[string]*Format{
+	"raw":   {Name: "raw", QemuFormat: "raw", ContainerFormat: "bare", Extension: "raw"},
+	"qcow2": {Name: "qcow2", QemuFormat: "qcow2", ContainerFormat: "bare", Extension: "img"},
+	"vmdk":  {Name: "vmdk", QemuFormat: "vmdk", ContainerFormat: "bare", Extension: "vmdk"},
+	"vhd":   {Name: "vhd", QemuFormat: "vpc", ContainerFormat: "bare", Extension: "vhd"},
+}
+
+// ErrUnknownFormat is the type of the error returned when the requested image
+// format is not supported
+type ErrUnknownFormat struct {
+	format string
+}
+
+func (e *ErrUnknownFormat) Error() string {
+	return fmt.Sprintf("error unknown image format %s, supported formats are %s",
+		e.format, strings.Join(formatNames(), ", "))
+}
+
+// FormatFor returns the output format given in options, DefaultFormat if empty
+func FormatFor(options *flags.Options) (*Format, error) {
+	name := options.ImageFormat
+	if name == "" {
+		name = DefaultFormat
+	}
+	format, ok := formats[name]
+	if !ok {
+		return nil, &ErrUnknownFormat{format: name}
+	}
+	return format, nil
+}
+
+// IsQemuFormat checks if the given qemu-img format is one of the supported ones
+func IsQemuFormat(qemuFormat string) bool {
+	for _, format := range formats {
+		if format.QemuFormat == qemuFormat {
+			return true
+		}
+	}
+	return false
+}
+
+// convertOptions returns the qemu-img convert flags specific to the format
+func (f *Format) convertOptions(options *flags.Options) []string {
+	if f.Name != "qcow2" {
+		return nil
+	}
+	output := []string{"-o", "compat=" + options.Qcow2compat}
+	if options.Qcow2Compress {
+		output = append(output, "-c")
+	}
+	return output
+}
+
+func formatNames() []string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
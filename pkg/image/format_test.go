@@ -0,0 +1,78 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+var _ = check.Suite(&formatSuite{})
+
+type formatSuite struct{}
+
+func (s *formatSuite) TestFormatForReturnsRequestedFormat(c *check.C) {
+	testCases := []struct {
+		name, qemuFormat, extension string
+	}{
+		{"raw", "raw", "raw"},
+		{"qcow2", "qcow2", "img"},
+		{"vmdk", "vmdk", "vmdk"},
+		{"vhd", "vpc", "vhd"},
+	}
+	for _, item := range testCases {
+		format, err := FormatFor(&flags.Options{ImageFormat: item.name})
+
+		c.Assert(err, check.IsNil)
+		c.Check(format.Name, check.Equals, item.name)
+		c.Check(format.QemuFormat, check.Equals, item.qemuFormat)
+		c.Check(format.ContainerFormat, check.Equals, "bare")
+		c.Check(format.Extension, check.Equals, item.extension)
+	}
+}
+
+func (s *formatSuite) TestFormatForReturnsDefaultFormat(c *check.C) {
+	format, err := FormatFor(&flags.Options{})
+
+	c.Assert(err, check.IsNil)
+	c.Assert(format.Name, check.Equals, DefaultFormat)
+}
+
+func (s *formatSuite) TestFormatForReturnsUnknownFormatError(c *check.C) {
+	_, err := FormatFor(&flags.Options{ImageFormat: "iso"})
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnknownFormat{})
+	c.Assert(err.Error(), check.Equals, "error unknown image format iso, supported formats are qcow2, raw, vhd, vmdk")
+}
+
+func (s *formatSuite) TestIsQemuFormat(c *check.C) {
+	c.Check(IsQemuFormat("vpc"), check.Equals, true)
+	c.Check(IsQemuFormat("qcow2"), check.Equals, true)
+	c.Check(IsQemuFormat("vhd"), check.Equals, false)
+	c.Check(IsQemuFormat("iso"), check.Equals, false)
+}
+
+func (s *formatSuite) TestConvertOptionsOnlyApplyToQCOW2(c *check.C) {
+	options := &flags.Options{Qcow2compat: "0.10", Qcow2Compress: true}
+
+	c.Check(formats["qcow2"].convertOptions(options), check.DeepEquals, []string{"-o", "compat=0.10", "-c"})
+	c.Check(formats["vmdk"].convertOptions(options), check.HasLen, 0)
+}
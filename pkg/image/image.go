@@ -17,56 +17,119 @@
  *
  */
 
-// Package image knows how to create the requested images using UDF.
+// Package image knows how to create the requested images using UDF or ubuntu-image.
 // It also defines the required interfaces standarize the query and creation
 // of images
 package image
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/snapcore/snapd/progress"
 	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/store"
+	"golang.org/x/crypto/openpgp"
 
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
 )
 
 const (
 	rawOutputFileName  = "udf.raw"
-	outputFileName     = "udf.img"
+	outputFilePattern  = "udf.%s"
 	errRepoDetailFmt   = "Could not get details of snap with name %s, developer %s and channel %s"
 	errRepoDownloadFmt = "Could not download snap with name %s, developer %s and channel %s"
+	planTmpDir         = "<tmpdir>"
+	planSnapPattern    = "<%s snap from %s>"
+	qemuImgPath        = "/usr/bin/qemu-img"
+	// udfChannelPrefix is the path of the system-image channels used by ubuntu-device-flash
+	udfChannelPrefix = "ubuntu-core"
 )
 
+// Record holds the metadata of an image stored in a cloud backend
+type Record struct {
+	ID, Name, Status string
+	Properties       map[string]string
+	Tags             []string
+	CreatedAt        time.Time
+	Size             int64
+}
+
 // Pollster holds the methods for querying an image backend
 type Pollster interface {
 	GetLatestVersion(options *flags.Options) (ver int, err error)
 }
 
+// PollsterVerifier is a Pollster that can also check the integrity of the files
+// of an image version before they are used
+type PollsterVerifier interface {
+	Pollster
+	VerifyFiles(options *flags.Options, version int) (mirror SIMirror, err error)
+}
+
+// SIMirror serves the verified system-image files of an image version, the
+// drivers get them from URL instead of the system-image server
+type SIMirror interface {
+	URL() string
+	Close() error
+}
+
 // FullPollster is a Pollster that knows how to get a list of Versions too
 type FullPollster interface {
 	Pollster
-	GetVersions(options *flags.Options) (images []string, err error)
+	GetVersions(options *flags.Options) (images []Record, err error)
 }
 
 // PollsterWriter is a Pollster that can also create and delete images
 type PollsterWriter interface {
 	FullPollster
 	Create(filePath string, options *flags.Options, version int) (err error)
-	Delete(images ...string) (err error)
+	Delete(ids ...string) (err error)
 	Purge(options *flags.Options) (err error)
+	List(options *flags.Options) (images []Record, err error)
+	GetImagesInUse() (ids []string, err error)
+	AddTag(id, tag string) (err error)
+	RemoveTag(id, tag string) (err error)
+}
+
+// SnapDetails holds the provenance data of a snap in the store
+type SnapDetails struct {
+	Name     string `json:"name"`
+	Channel  string `json:"channel"`
+	Revision string `json:"revision"`
+	Sha3_384 string `json:"sha3_384"`
 }
 
-// Driver defines the methods required for creating images
+// SnapPollster holds the methods for querying the current details of the
+// snaps an all-snaps image is made of
+type SnapPollster interface {
+	GetSnaps(options *flags.Options) (snaps map[string]SnapDetails, err error)
+}
+
+// Driver defines the methods required for creating images. The snaps given to
+// Create are the ones returned by a SnapPollster before the build, the drivers
+// download those revisions and record them in the manifest. Create and Convert
+// write their files to the returned temporary directory, which is returned even
+// on errors and must be removed by the caller
 type Driver interface {
-	Create(options *flags.Options, ver int) (path string, err error)
+	Create(options *flags.Options, ver int, snaps map[string]SnapDetails) (path, tmpDir string, manifest *Manifest, err error)
+	Plan(options *flags.Options, ver int) (cmds [][]string)
+	DetectFormat(path string) (format string, err error)
+	Convert(options *flags.Options, path string) (output, tmpDir string, err error)
+}
+
+// Verifier defines the methods required for checking an image before uploading it
+type Verifier interface {
+	Verify(options *flags.Options, path string) (err error)
 }
 
 type storeClient interface {
@@ -83,6 +146,16 @@ func (e *ErrRepoDetail) Error() string {
 	return fmt.Sprintf(errRepoDetailFmt, e.name, e.developer, e.channel)
 }
 
+// ErrUDFChannelPrefix is the error returned by UDFQcow2 when a 15.04 image is
+// requested from system-image channels ubuntu-device-flash can't use
+type ErrUDFChannelPrefix struct {
+	prefix string
+}
+
+func (e *ErrUDFChannelPrefix) Error() string {
+	return fmt.Sprintf("error ubuntu-device-flash only uses the %s system-image channels, not the %s ones", udfChannelPrefix, e.prefix)
+}
+
 // ErrRepoDownload is the error returned when a snap could not be retrieved
 type ErrRepoDownload struct {
 	name, developer, channel string
@@ -92,57 +165,279 @@ func (e *ErrRepoDownload) Error() string {
 	return fmt.Sprintf(errRepoDownloadFmt, e.name, e.developer, e.channel)
 }
 
-// UDFQcow2 is a concrete implementation of Driver
-type UDFQcow2 struct {
+// SnapRoles are the roles of the snaps an all-snaps image is made of
+var SnapRoles = []string{"os", "kernel", "gadget"}
+
+// snapSpec returns the name and channel of the snap with the given role, the
+// kernel and gadget default to the ones of the arch
+func snapSpec(options *flags.Options, role string) (name, channel string) {
+	switch role {
+	case "kernel":
+		name, channel = options.Kernel, options.KernelChannel
+	case "gadget":
+		name, channel = options.Gadget, options.GadgetChannel
+	default:
+		name, channel = options.OS, options.OSChannel
+	}
+	if name == "" {
+		if arch, err := ArchFor(options); err == nil {
+			name = arch.defaultSnap(role)
+		}
+	}
+	return
+}
+
+// StorePollster is a concrete implementation of SnapPollster that queries the store,
+// httpClient is used for getting the details of pinned revisions
+type StorePollster struct {
+	sc         storeClient
+	httpClient web.Getter
+}
+
+// NewStorePollster is the StorePollster constructor
+func NewStorePollster(sc storeClient, httpClient web.Getter) *StorePollster {
+	return &StorePollster{sc: sc, httpClient: httpClient}
+}
+
+// GetSnaps returns the details in the store of the os, kernel and gadget
+// snaps on their respective channels, indexed by role. Pinned snaps get the
+// pinned revision and local files the LocalRevision and the sha3-384 of the file
+func (s *StorePollster) GetSnaps(options *flags.Options) (snaps map[string]SnapDetails, err error) {
+	snaps = make(map[string]SnapDetails)
+	for _, role := range SnapRoles {
+		value, channel := snapSpec(options, role)
+		ref, err := ParseSnapRef(value)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Path != "" {
+			sum, err := fileSha3_384(ref.Path)
+			if err != nil {
+				return nil, &ErrSnapFile{path: ref.Path, reason: err.Error()}
+			}
+			snaps[role] = SnapDetails{Name: ref.Name, Revision: LocalRevision, Sha3_384: hex.EncodeToString(sum)}
+			continue
+		}
+		remoteSnap, err := resolveSnap(s.sc, s.httpClient, ref, channel)
+		if err != nil {
+			return nil, err
+		}
+		snaps[role] = SnapDetails{
+			Name:     ref.Name,
+			Channel:  channel,
+			Revision: fmt.Sprint(remoteSnap.Revision),
+			Sha3_384: remoteSnap.Sha3_384,
+		}
+	}
+	return snaps, nil
+}
+
+// qemuImg implements the image format handling shared by the drivers
+type qemuImg struct {
 	cli cli.Commander
-	sc  storeClient
 }
 
-// NewUDFQcow2 is the UDFQcow2 constructor
-func NewUDFQcow2(cli cli.Commander, sc storeClient) *UDFQcow2 {
-	return &UDFQcow2{cli: cli, sc: sc}
+// DetectFormat returns the format of the given image file as reported by qemu-img
+func (q *qemuImg) DetectFormat(path string) (format string, err error) {
+	output, err := q.cli.ExecCommand(qemuImgPath, "info", "--output=json", path)
+	if err != nil {
+		return
+	}
+	var info struct {
+		Format string `json:"format"`
+	}
+	if err = json.Unmarshal([]byte(output), &info); err != nil {
+		return
+	}
+	return info.Format, nil
 }
 
-// Create makes the required call to UDF to create the raw image, and then transforms
-// it to the QCOW2 format
-func (u *UDFQcow2) Create(options *flags.Options, ver int) (path string, err error) {
-	tmpDirName, err := u.cli.ExecCommand("mktemp", "-d")
+// Convert transforms the given image file to the format given in options, the
+// result is written to a new temporary directory
+func (q *qemuImg) Convert(options *flags.Options, path string) (output, tmpDir string, err error) {
+	format, err := FormatFor(options)
 	if err != nil {
 		return
 	}
-	rawTmpFileName := filepath.Join(strings.TrimSpace(tmpDirName), rawOutputFileName)
-	log.Debug("Target image filename: ", rawTmpFileName)
+	if tmpDir, err = q.cli.ExecCommand("mktemp", "-d"); err != nil {
+		return "", "", err
+	}
+	tmpDir = strings.TrimSpace(tmpDir)
+	output = filepath.Join(tmpDir, fmt.Sprintf(outputFilePattern, format.Extension))
+	log.Debugf("Converting %s to %s format", path, format.Name)
+	cmdOutput, err := q.cli.ExecCommand(convertCmd(options, format, path, output)...)
+	log.Debug(cmdOutput)
+	return
+}
 
-	var archFlag string
-	if options.Arch == "arm" {
-		archFlag = "--oem beagleblack"
+// toFormat transforms the raw image created in tmpDirName to the given format,
+// raw images are returned as they are. The conversion and the resulting file
+// are recorded in manifest
+func (q *qemuImg) toFormat(options *flags.Options, format *Format, tmpDirName, rawTmpFileName string, manifest *Manifest) (path string, err error) {
+	path = rawTmpFileName
+	if format.QemuFormat != "raw" {
+		log.Debugf("Converting to %s format", format.Name)
+		path = filepath.Join(tmpDirName, fmt.Sprintf(outputFilePattern, format.Extension))
+		cmds := convertCmd(options, format, rawTmpFileName, path)
+		output, err := q.cli.ExecCommand(cmds...)
+		log.Debug(output)
+		if err != nil {
+			return path, err
+		}
+		manifest.addTool(q.cli, cmds)
 	}
-	cmds := []string{"sudo", "ubuntu-device-flash"}
+	return path, manifest.setOutput(path, format)
+}
 
-	if options.Release == "15.04" {
-		cmds = append(cmds, "--revision="+strconv.Itoa(ver))
+// planToFormat appends to cmds the conversion of the planned raw image to the
+// format given in options
+func planToFormat(options *flags.Options, cmds [][]string, rawTmpFileName string) [][]string {
+	format, err := FormatFor(options)
+	if err != nil || format.QemuFormat == "raw" {
+		return cmds
 	}
-	cmds = append(cmds, []string{
-		"core", options.Release,
-	}...)
+	return append(cmds, convertCmd(options, format, rawTmpFileName,
+		filepath.Join(planTmpDir, fmt.Sprintf(outputFilePattern, format.Extension))))
+}
 
-	snapFlags, err := u.getSnapFlags(options)
+// snapDownloader retrieves from the store the snaps that are not taken from
+// the channel the image is built from, httpClient is used for getting the
+// details of pinned revisions and the assertions of the downloaded snaps
+type snapDownloader struct {
+	sc         storeClient
+	httpClient web.Getter
+}
+
+// getFileFunc retrieves the file of the given snap and returns its path and store details
+type getFileFunc func(ref *SnapRef, channel string) (path string, remoteSnap *snap.Info, err error)
+
+func (d *snapDownloader) getSnapFile(ref *SnapRef, channel string, keyring openpgp.EntityList) (path string, remoteSnap *snap.Info, err error) {
+	remoteSnap, err = resolveSnap(d.sc, d.httpClient, ref, channel)
 	if err != nil {
 		return
 	}
-	cmds = append(cmds,
-		snapFlags...,
-	)
-	defer func() {
-		for _, item := range snapFlags {
-			os.RemoveAll(item)
+
+	log.Debugf("Downloading %s revision %d", ref.Name, remoteSnap.Revision)
+	path, err = d.sc.Download(remoteSnap, nil, nil)
+	if err != nil {
+		return "", nil, &ErrRepoDownload{ref.Name, "", channel}
+	}
+	log.Debugf("Downloaded %s to %s", ref.Name, path)
+	if err = d.verifySnap(remoteSnap, path, keyring); err != nil {
+		os.Remove(path)
+		return "", nil, err
+	}
+	return
+}
+
+// planSnapFile is used instead of getSnapFile for planning, it returns a
+// placeholder for the snap file
+func planSnapFile(ref *SnapRef, channel string) (string, *snap.Info, error) {
+	if ref.Revision != 0 {
+		return fmt.Sprintf(planRevisionFmt, ref.Name, ref.Revision), nil, nil
+	}
+	return fmt.Sprintf(planSnapPattern, ref.Name, channel), nil, nil
+}
+
+// snapFiles holds the channel an image is built from and the files of the snaps
+// to be side-loaded indexed by role, along with the store details of the downloaded ones
+type snapFiles struct {
+	channel    string
+	paths      map[string]string
+	snaps      map[string]*snap.Info
+	downloaded []string
+}
+
+// remove deletes the downloaded snap files, local ones are kept
+func (f *snapFiles) remove() {
+	for _, path := range f.downloaded {
+		os.Remove(path)
+	}
+}
+
+// sideloadSnaps returns the files of the snaps the image is built from, so that
+// the tools don't take them from the channel. Local files are used as given and
+// the rest are retrieved with getFile, unpinned ones at the revision given in
+// snaps for the role
+func sideloadSnaps(options *flags.Options, snaps map[string]SnapDetails, getFile getFileFunc) (*snapFiles, error) {
+	files := &snapFiles{
+		channel: GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel),
+		paths:   make(map[string]string),
+		snaps:   make(map[string]*snap.Info),
+	}
+	for _, role := range SnapRoles {
+		value, snapChannel := snapSpec(options, role)
+		ref, err := ParseSnapRef(value)
+		if err != nil {
+			files.remove()
+			return nil, err
+		}
+		if ref.Path != "" {
+			files.paths[role] = ref.Path
+			continue
+		}
+		if revision, err := strconv.Atoi(snaps[role].Revision); err == nil && ref.Revision == 0 {
+			ref.Revision = revision
 		}
-	}()
+		path, remoteSnap, err := getFile(ref, snapChannel)
+		if err != nil {
+			files.remove()
+			return nil, err
+		}
+		files.paths[role] = path
+		files.snaps[role] = remoteSnap
+		files.downloaded = append(files.downloaded, path)
+	}
+	return files, nil
+}
 
-	cmds = append(cmds, []string{
-		"--developer-mode",
-		archFlag, "-o", rawTmpFileName}...)
+// UDFQcow2 is a concrete implementation of Driver
+type UDFQcow2 struct {
+	qemuImg
+	snapDownloader
+}
+
+// NewUDFQcow2 is the UDFQcow2 constructor
+func NewUDFQcow2(cli cli.Commander, sc storeClient, httpClient web.Getter) *UDFQcow2 {
+	return &UDFQcow2{qemuImg: qemuImg{cli: cli}, snapDownloader: snapDownloader{sc: sc, httpClient: httpClient}}
+}
+
+// Create makes the required call to UDF to create the raw image, and then transforms
+// it to the format given in options. The returned manifest describes the inputs of
+// the image and the created file
+func (u *UDFQcow2) Create(options *flags.Options, ver int, snaps map[string]SnapDetails) (path, tmpDir string, manifest *Manifest, err error) {
+	format, err := FormatFor(options)
+	if err != nil {
+		return
+	}
+	if _, err = ArchFor(options); err != nil {
+		return
+	}
+	if options.Release == "15.04" {
+		if prefix := strings.Trim(options.SIChannelPrefix, "/"); prefix != "" && prefix != udfChannelPrefix {
+			return "", "", nil, &ErrUDFChannelPrefix{prefix: options.SIChannelPrefix}
+		}
+	} else if err = checkSnapRefs(options); err != nil {
+		return
+	}
+	if tmpDir, err = u.cli.ExecCommand("mktemp", "-d"); err != nil {
+		return "", "", nil, err
+	}
+	tmpDir = strings.TrimSpace(tmpDir)
+	rawTmpFileName := filepath.Join(tmpDir, rawOutputFileName)
+	log.Debug("Target image filename: ", rawTmpFileName)
 
+	getFile, err := u.fileGetter(options)
+	if err != nil {
+		return
+	}
+	snapFlags, files, err := getSnapFlags(options, snaps, getFile)
+	if err != nil {
+		return
+	}
+	defer files.remove()
+
+	cmds := udfCmd(options, ver, snapFlags, rawTmpFileName)
 	log.Debug("Executing command ", strings.Join(cmds, " "))
 	output, err := u.cli.ExecCommand(cmds...)
 	log.Debug(output)
@@ -150,63 +445,78 @@ func (u *UDFQcow2) Create(options *flags.Options, ver int) (path string, err err
 		return
 	}
 
-	log.Debug("Converting to QCOW2 format")
-	tmpFileName := filepath.Join(strings.TrimSpace(tmpDirName), outputFileName)
-	cmds = []string{"/usr/bin/qemu-img",
-		"convert", "-O", "qcow2",
-		"-o", "compat=" + options.Qcow2compat,
-		rawTmpFileName, tmpFileName}
-	output, err = u.cli.ExecCommand(cmds...)
-	log.Debug(output)
+	manifest = &Manifest{}
+	if options.Release == "15.04" {
+		manifest.SIVersion = ver
+	} else {
+		manifest.Snaps = manifestSnaps(snaps, files)
+	}
+	manifest.addTool(u.cli, cmds)
+	path, err = u.toFormat(options, format, tmpDir, rawTmpFileName, manifest)
+	return
+}
 
-	return tmpFileName, err
+// Plan returns the command lines that Create would execute for the given options
+// without executing them, the temporary directory and the snaps that would be
+// downloaded are represented by placeholders
+func (u *UDFQcow2) Plan(options *flags.Options, ver int) [][]string {
+	snapFlags, _, _ := getSnapFlags(options, nil, planSnapFile)
+	rawTmpFileName := filepath.Join(planTmpDir, rawOutputFileName)
+	return planToFormat(options, [][]string{udfCmd(options, ver, snapFlags, rawTmpFileName)}, rawTmpFileName)
 }
 
-func (u *UDFQcow2) getSnapFile(name, channel string) (path string, err error) {
-	remoteSnap, err := u.sc.Snap(name, channel, nil)
-	if err != nil {
-		return "", &ErrRepoDetail{name, "", channel}
-	}
+func udfCmd(options *flags.Options, ver int, snapFlags []string, output string) []string {
+	cmds := []string{"sudo", "ubuntu-device-flash"}
 
-	log.Debugf("Downloading %s", name)
-	path, err = u.sc.Download(remoteSnap, nil, nil)
-	if err != nil {
-		return "", &ErrRepoDownload{name, "", channel}
+	if options.Release == "15.04" {
+		if options.SIServer != "" {
+			cmds = append(cmds, "--server="+options.SIServer)
+		}
+		cmds = append(cmds, "--revision="+strconv.Itoa(ver))
 	}
-	log.Debugf("Downloaded %s to %s", name, path)
-	return
+	cmds = append(cmds, []string{
+		"core", options.Release,
+	}...)
+	if options.Release == "15.04" && options.SIDevice != "" {
+		cmds = append(cmds, "--device", options.SIDevice)
+	}
+	cmds = append(cmds,
+		snapFlags...,
+	)
+	cmds = append(cmds, "--developer-mode")
+	// the all-snaps images get the gadget snap instead
+	if arch, err := ArchFor(options); err == nil && options.Release == "15.04" && arch.OEM != "" {
+		cmds = append(cmds, "--oem", arch.OEM)
+	}
+	return append(cmds, "-o", output)
 }
 
-func (u *UDFQcow2) getSnapFlags(options *flags.Options) ([]string, error) {
-	channel := GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel)
-
-	output := []string{
-		"--channel", channel,
-	}
-	if options.Release != "15.04" {
-		var err error
-		paths := []string{}
-		snaps := []string{options.OS, options.Kernel, options.Gadget}
-		channels := []string{options.OSChannel, options.KernelChannel, options.GadgetChannel}
-		for i := 0; i < len(snaps); i++ {
-			var path string
-			if channels[i] != channel {
-				path, err = u.getSnapFile(snaps[i], channels[i])
-				if err != nil {
-					return nil, err
-				}
-			} else {
-				path = snaps[i]
-			}
-			paths = append(paths, path)
+func convertCmd(options *flags.Options, format *Format, input, output string) []string {
+	cmds := []string{qemuImgPath, "convert", "-O", format.QemuFormat}
+	cmds = append(cmds, format.convertOptions(options)...)
+	return append(cmds, input, output)
+}
+
+// getSnapFlags returns the snap related flags of the UDF call and the side-loaded
+// snaps, getFile is used for retrieving the ones that are not local files
+func getSnapFlags(options *flags.Options, snaps map[string]SnapDetails, getFile getFileFunc) ([]string, *snapFiles, error) {
+	if options.Release == "15.04" {
+		channel := GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel)
+		return []string{"--channel", channel}, &snapFiles{channel: channel}, nil
+	}
+	files, err := sideloadSnaps(options, snaps, getFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	output := []string{"--channel", files.channel}
+	for _, role := range SnapRoles {
+		path, ok := files.paths[role]
+		if !ok {
+			path, _ = snapSpec(options, role)
 		}
-		output = append(output, []string{
-			"--os", paths[0],
-			"--kernel", paths[1],
-			"--gadget", paths[2],
-		}...)
+		output = append(output, "--"+role, path)
 	}
-	return output, nil
+	return output, files, nil
 }
 
 // GetChannel returns the most frequent channel, if all are different it returns
@@ -20,12 +20,20 @@
 package image
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/sha3"
+
 	"github.com/snapcore/snapd/progress"
 	"github.com/snapcore/snapd/snap"
 	"github.com/snapcore/snapd/store"
@@ -46,6 +54,8 @@ const (
 	testDefaultKernelChannel = "mykernelchannel"
 	testDefaultGadgetChannel = "mygadgetchannel"
 	tmpDirName               = "tmpdirname"
+	testOutputSha256         = "outputsha256"
+	testOutputSize           = 1024
 )
 
 var _ = check.Suite(&imageSuite{})
@@ -58,10 +68,14 @@ var (
 func Test(t *testing.T) { check.TestingT(t) }
 
 type imageSuite struct {
-	subject        Driver
-	cli            *fakeCliCommander
-	storeClient    *fakeStoreClient
-	defaultOptions *flags.Options
+	subject          Driver
+	cli              *fakeCliCommander
+	storeClient      *fakeStoreClient
+	webGetter        *fakeWebGetter
+	defaultOptions   *flags.Options
+	backDir          string
+	backOutputDigest func(string) (string, int64, error)
+	storeKeyring     string
 }
 
 type fakeCliCommander struct {
@@ -89,10 +103,18 @@ type fakeStoreClient struct {
 	snapErr                                  bool
 	totalDownloadCalls, correctDownloadCalls int
 	downloadErr                              bool
+	revisions                                map[string]int
+	downloadURLs                             []string
+	corrupt                                  bool
+	// the snap-revision assertions of the downloaded snaps signed with key
+	// are published in webGetter, unless a test already set them
+	webGetter *fakeWebGetter
+	key       *openpgp.Entity
 }
 
 func (f *fakeStoreClient) Download(remoteSnap *snap.Info, pb progress.Meter, sa store.Authenticator) (path string, err error) {
 	f.downloadCalls[getDownloadCall(remoteSnap.Name(), remoteSnap.Channel)]++
+	f.downloadURLs = append(f.downloadURLs, remoteSnap.AnonDownloadURL)
 	f.totalDownloadCalls++
 
 	if f.downloadErr {
@@ -100,7 +122,16 @@ func (f *fakeStoreClient) Download(remoteSnap *snap.Info, pb progress.Meter, sa
 			return "", errors.New("")
 		}
 	}
-	return getSnapFilename(remoteSnap.Name(), remoteSnap.Channel), nil
+	// the snaps are written to the current directory, the suites run in a temporary one
+	path = getSnapFilename(remoteSnap.Name(), remoteSnap.Channel)
+	content := getSnapContent(remoteSnap.Name(), remoteSnap.Channel)
+	if f.corrupt {
+		content += "corrupt"
+	}
+	if _, ok := f.webGetter.outputs[getAssertionURL(content)]; !ok {
+		f.webGetter.outputs[getAssertionURL(content)] = signAssertion(f.key, content, getSnapID(remoteSnap.Name()), remoteSnap.Revision)
+	}
+	return path, ioutil.WriteFile(path, []byte(content), 0644)
 }
 
 func (f *fakeStoreClient) Snap(name, channel string, sa store.Authenticator) (remoteSnap *snap.Info, err error) {
@@ -114,13 +145,81 @@ func (f *fakeStoreClient) Snap(name, channel string, sa store.Authenticator) (re
 		}
 	}
 
-	return &snap.Info{SideInfo: snap.SideInfo{OfficialName: name, Channel: channel}}, nil
+	info := &snap.Info{SideInfo: snap.SideInfo{OfficialName: name, SnapID: getSnapID(name), Channel: channel, Revision: f.revisions[name]}}
+	info.Sha3_384 = getSnapHash(name, channel)
+	if revision, ok := f.revisions[name]; ok {
+		info.AnonDownloadURL = getDownloadURL(name, revision)
+	}
+	return info, nil
+}
+
+// snapDetails returns the details of the snaps given in options that a
+// StorePollster with this store would return
+func (f *fakeStoreClient) snapDetails(options *flags.Options) map[string]SnapDetails {
+	if options.Release == "15.04" {
+		return nil
+	}
+	snaps := make(map[string]SnapDetails)
+	for _, role := range SnapRoles {
+		value, channel := snapSpec(options, role)
+		ref, err := ParseSnapRef(value)
+		if err != nil {
+			continue
+		}
+		if ref.Path != "" {
+			sum, _ := fileSha3_384(ref.Path)
+			snaps[role] = SnapDetails{Name: ref.Name, Revision: LocalRevision, Sha3_384: hex.EncodeToString(sum)}
+			continue
+		}
+		revision := f.revisions[ref.Name]
+		if ref.Revision != 0 {
+			revision = ref.Revision
+		}
+		snaps[role] = SnapDetails{Name: ref.Name, Channel: channel, Revision: fmt.Sprint(revision),
+			Sha3_384: getSnapHash(ref.Name, channel)}
+	}
+	return snaps
+}
+
+type fakeWebGetter struct {
+	calls  map[string]int
+	output string
+	// outputs holds the contents of the given urls, output is returned for the rest
+	outputs map[string]string
+}
+
+func (f *fakeWebGetter) Get(url string) (content []byte, err error) {
+	f.calls[url]++
+	if output, ok := f.outputs[url]; ok {
+		return []byte(output), nil
+	}
+	return []byte(f.output), nil
+}
+
+// inTmpDir changes to a new temporary directory and returns the current one
+func inTmpDir(c *check.C) string {
+	backDir, err := os.Getwd()
+	c.Assert(err, check.IsNil)
+	c.Assert(os.Chdir(c.MkDir()), check.IsNil)
+	return backDir
 }
 
 func (s *imageSuite) SetUpSuite(c *check.C) {
 	s.cli = &fakeCliCommander{}
 	s.storeClient = &fakeStoreClient{}
-	s.subject = NewUDFQcow2(s.cli, s.storeClient)
+	s.webGetter = &fakeWebGetter{}
+	s.storeClient.webGetter = s.webGetter
+	var keyring openpgp.EntityList
+	s.storeKeyring, keyring = writeKeyring(c, false)
+	s.storeClient.key = keyring[0]
+	s.subject = NewUDFQcow2(s.cli, s.storeClient, s.webGetter)
+	s.backOutputDigest = outputDigest
+	outputDigest = fakeOutputDigest
+}
+
+func (s *imageSuite) TearDownSuite(c *check.C) {
+	outputDigest = s.backOutputDigest
+	os.Remove(s.storeKeyring)
 }
 
 func (s *imageSuite) SetUpTest(c *check.C) {
@@ -134,6 +233,7 @@ func (s *imageSuite) SetUpTest(c *check.C) {
 		OSChannel:     testDefaultOSChannel,
 		KernelChannel: testDefaultKernelChannel,
 		GadgetChannel: testDefaultGadgetChannel,
+		StoreKeyring:  s.storeKeyring,
 	}
 
 	s.cli.execCommandCalls = make(map[string]int)
@@ -149,6 +249,17 @@ func (s *imageSuite) SetUpTest(c *check.C) {
 	s.storeClient.downloadErr = false
 	s.storeClient.correctDownloadCalls = 0
 	s.storeClient.totalDownloadCalls = 0
+	s.storeClient.revisions = map[string]int{testDefaultOS: 1, testDefaultKernel: 2, testDefaultGadget: 3}
+	s.storeClient.downloadURLs = nil
+	s.storeClient.corrupt = false
+	s.webGetter.calls = make(map[string]int)
+	s.webGetter.output = ""
+	s.webGetter.outputs = make(map[string]string)
+	s.backDir = inTmpDir(c)
+}
+
+func (s *imageSuite) TearDownTest(c *check.C) {
+	os.Chdir(s.backDir)
 }
 
 func (s *imageSuite) TestCreateCallsUDF(c *check.C) {
@@ -159,9 +270,9 @@ func (s *imageSuite) TestCreateCallsUDF(c *check.C) {
 		version                                                                    int
 		expectedCall                                                               string
 	}{
-		{"16.04", "amd64", "os1", "kernel1", "gadget1", "oschan1", "gadgetchan1", "kernchan1", 100, "sudo ubuntu-device-flash core 16.04 --channel oschan1 --os os1 --kernel kernel1_kernchan1.snap --gadget gadget1_gadgetchan1.snap --developer-mode  -o " + filename},
-		{"rolling", "amd64", "os2", "kernel2", "gadget2", "oschan2", "gadchan2", "kchan2", 100, "sudo ubuntu-device-flash core rolling --channel oschan2 --os os2 --kernel kernel2_kchan2.snap --gadget gadget2_gadchan2.snap --developer-mode  -o " + filename},
-		{"17.10", "arm", "os3", "kernel3", "gadget3", "chanos3", "gadchan3", "kernchan3", 56, "sudo ubuntu-device-flash core 17.10 --channel chanos3 --os os3 --kernel kernel3_kernchan3.snap --gadget gadget3_gadchan3.snap --developer-mode --oem beagleblack -o " + filename},
+		{"16.04", "amd64", "os1", "kernel1", "gadget1", "oschan1", "gadgetchan1", "kernchan1", 100, "sudo ubuntu-device-flash core 16.04 --channel oschan1 --os os1_oschan1.snap --kernel kernel1_kernchan1.snap --gadget gadget1_gadgetchan1.snap --developer-mode -o " + filename},
+		{"rolling", "amd64", "os2", "kernel2", "gadget2", "oschan2", "gadchan2", "kchan2", 100, "sudo ubuntu-device-flash core rolling --channel oschan2 --os os2_oschan2.snap --kernel kernel2_kchan2.snap --gadget gadget2_gadchan2.snap --developer-mode -o " + filename},
+		{"17.10", "arm", "os3", "kernel3", "gadget3", "chanos3", "gadchan3", "kernchan3", 56, "sudo ubuntu-device-flash core 17.10 --channel chanos3 --os os3_chanos3.snap --kernel kernel3_kernchan3.snap --gadget gadget3_gadchan3.snap --developer-mode -o " + filename},
 	}
 
 	for _, item := range testCases {
@@ -177,7 +288,7 @@ func (s *imageSuite) TestCreateCallsUDF(c *check.C) {
 			GadgetChannel: item.gadgetChannel,
 			KernelChannel: item.kernelChannel,
 		}
-		_, err := s.subject.Create(options, item.version)
+		_, _, _, err := s.subject.Create(options, item.version, s.storeClient.snapDetails(options))
 
 		c.Check(err, check.IsNil)
 
@@ -190,10 +301,10 @@ func (s *imageSuite) TestCreateCallsUDFWithoutRevisionForNon1504(c *check.C) {
 	s.cli.output = tmpDirName
 	filename := tmpRawFileName()
 
-	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s_%s.snap --gadget %s_%s.snap --developer-mode  -o "+filename,
-		s.defaultOptions.Release, s.defaultOptions.OSChannel, s.defaultOptions.OS, s.defaultOptions.Kernel, s.defaultOptions.KernelChannel, s.defaultOptions.Gadget, s.defaultOptions.GadgetChannel)
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s_%s.snap --kernel %s_%s.snap --gadget %s_%s.snap --developer-mode -o "+filename,
+		s.defaultOptions.Release, s.defaultOptions.OSChannel, s.defaultOptions.OS, s.defaultOptions.OSChannel, s.defaultOptions.Kernel, s.defaultOptions.KernelChannel, s.defaultOptions.Gadget, s.defaultOptions.GadgetChannel)
 
-	_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	c.Check(err, check.IsNil)
 	c.Assert(len(s.cli.execCommandCalls) > 0, check.Equals, true)
@@ -207,12 +318,12 @@ func (s *imageSuite) TestCreateCallsUDFWithoutAllSnapsParamsFor1504(c *check.C)
 	version := 56
 	release := "15.04"
 
-	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash --revision=%d core %s --channel %s --developer-mode  -o %s",
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash --revision=%d core %s --channel %s --developer-mode -o %s",
 		version, release, testDefaultOSChannel, filename)
 
 	s.defaultOptions.Release = release
 
-	_, err := s.subject.Create(s.defaultOptions, version)
+	_, _, _, err := s.subject.Create(s.defaultOptions, version, s.storeClient.snapDetails(s.defaultOptions))
 
 	c.Check(err, check.IsNil)
 	c.Assert(len(s.cli.execCommandCalls) > 0, check.Equals, true)
@@ -220,14 +331,76 @@ func (s *imageSuite) TestCreateCallsUDFWithoutAllSnapsParamsFor1504(c *check.C)
 	c.Check(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
 }
 
+func (s *imageSuite) TestCreateCallsUDFWithOEMOfArchFor1504(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.Release = "15.04"
+	s.defaultOptions.Arch = "armhf"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[fmt.Sprintf("sudo ubuntu-device-flash --revision=%d core 15.04 --channel %s --developer-mode --oem beagleblack -o %s",
+		testDefaultVer, testDefaultOSChannel, tmpRawFileName())], check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateCallsUDFWithSIServerAndDeviceFor1504(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.Release = "15.04"
+	s.defaultOptions.SIServer = "https://si.example.com"
+	s.defaultOptions.SIDevice = "generic_pc"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[fmt.Sprintf("sudo ubuntu-device-flash --server=https://si.example.com --revision=%d core 15.04 --device generic_pc --channel %s --developer-mode -o %s",
+		testDefaultVer, testDefaultOSChannel, tmpRawFileName())], check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateReturnsErrUDFChannelPrefixFor1504(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.Release = "15.04"
+	s.defaultOptions.SIChannelPrefix = "staging"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrUDFChannelPrefix{})
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+}
+
+func (s *imageSuite) TestCreateUsesSnapsOfArchByDefault(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.Arch = "arm64"
+	s.defaultOptions.Kernel = ""
+	s.defaultOptions.Gadget = ""
+	s.defaultOptions.KernelChannel = testDefaultOSChannel
+	s.defaultOptions.GadgetChannel = testDefaultOSChannel
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s --gadget %s --developer-mode -o %s",
+		testDefaultRelease, testDefaultOSChannel, getSnapFilename(testDefaultOS, testDefaultOSChannel),
+		getSnapFilename("canonical-snapdragon-linux", testDefaultOSChannel), getSnapFilename("canonical-dragon", testDefaultOSChannel),
+		tmpRawFileName())], check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateReturnsErrorForUnknownArch(c *check.C) {
+	s.defaultOptions.Arch = "sparc"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnknownArch{})
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+}
+
 func (s *imageSuite) TestCreateDoesNotCallUDFOnMktempError(c *check.C) {
 	s.cli.err = true
 	s.cli.output = tmpDirName
 	filename := tmpRawFileName()
 
-	s.subject.Create(s.defaultOptions, testDefaultVer)
+	s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
-	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s --gadget %s --developer-mode  -o %s",
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s --gadget %s --developer-mode -o %s",
 		testDefaultRelease, testDefaultOSChannel, testDefaultOS, testDefaultKernel, testDefaultGadget, filename)
 
 	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 0)
@@ -237,32 +410,146 @@ func (s *imageSuite) TestCreateReturnsUDFError(c *check.C) {
 	s.cli.err = true
 	s.cli.correctCalls = 1
 
-	_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	c.Assert(err, check.NotNil)
 }
 
 func (s *imageSuite) TestCreateReturnsCreatedFilePath(c *check.C) {
 	s.cli.output = tmpDirName
-	path, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+	path, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 	c.Assert(err, check.IsNil)
 
 	c.Assert(path, check.Equals, tmpFileName())
 }
 
+func (s *imageSuite) TestCreateReturnsManifest(c *check.C) {
+	s.cli.output = tmpDirName
+
+	_, _, manifest, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(manifest.Snaps, check.DeepEquals, []ManifestSnap{
+		{Role: "os", Name: testDefaultOS, Channel: testDefaultOSChannel, Revision: "1",
+			Sha3_384: getSnapHash(testDefaultOS, testDefaultOSChannel)},
+		{Role: "kernel", Name: testDefaultKernel, Channel: testDefaultKernelChannel, Revision: "2",
+			Sha3_384: getSnapHash(testDefaultKernel, testDefaultKernelChannel)},
+		{Role: "gadget", Name: testDefaultGadget, Channel: testDefaultGadgetChannel, Revision: "3",
+			Sha3_384: getSnapHash(testDefaultGadget, testDefaultGadgetChannel)},
+	})
+	c.Assert(manifest.Tools, check.HasLen, 2)
+	c.Assert(manifest.Tools[0].Name, check.Equals, "ubuntu-device-flash")
+	c.Assert(manifest.Tools[0].Version, check.Equals, tmpDirName)
+	c.Assert(strings.Join(manifest.Tools[0].Args, " "), check.Matches, "core "+testDefaultRelease+" --channel .*")
+	c.Assert(manifest.Tools[1].Name, check.Equals, qemuImgPath)
+	c.Assert(manifest.Tools[1].Args, check.DeepEquals, []string{
+		"convert", "-O", "qcow2", "-o", "compat=" + testDefaultQcow2compat, tmpRawFileName(), tmpFileName()})
+	c.Assert(manifest.Output, check.DeepEquals, ManifestOutput{Format: "qcow2", Sha256: testOutputSha256, Size: testOutputSize})
+	c.Assert(s.cli.execCommandCalls["dpkg-query -W -f=${Version} ubuntu-device-flash"], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls[qemuImgPath+" --version"], check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateRecordsLocalSnapsInManifest(c *check.C) {
+	s.cli.output = tmpDirName
+	path := writeSnapFile(c, "hsqs local core")
+	defer os.Remove(path)
+	s.defaultOptions.OS = path
+
+	_, _, manifest, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	ref, _ := ParseSnapRef(path)
+	sum := sha3.Sum384([]byte("hsqs local core"))
+	c.Assert(manifest.Snaps[0], check.DeepEquals, ManifestSnap{Role: "os", Name: ref.Name,
+		Revision: LocalRevision, Sha3_384: hex.EncodeToString(sum[:]), Path: path})
+}
+
+func (s *imageSuite) TestCreateRecordsGivenSnapsInManifest(c *check.C) {
+	s.cli.output = tmpDirName
+	snaps := s.storeClient.snapDetails(s.defaultOptions)
+	snaps["os"] = SnapDetails{Name: testDefaultOS, Channel: testDefaultOSChannel, Revision: "7",
+		Sha3_384: getSnapHash(testDefaultOS, testDefaultOSChannel)}
+	setRevisionDetails(s.webGetter, testDefaultOS, 7, getSnapHash(testDefaultOS, testDefaultOSChannel))
+
+	_, _, manifest, err := s.subject.Create(s.defaultOptions, testDefaultVer, snaps)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(manifest.Snaps[0], check.DeepEquals, ManifestSnap{Role: "os", Name: testDefaultOS,
+		Channel: testDefaultOSChannel, Revision: "7", Sha3_384: getSnapHash(testDefaultOS, testDefaultOSChannel)})
+	c.Assert(s.storeClient.downloadCalls[getDownloadCall(testDefaultOS, testDefaultOSChannel)], check.Equals, 1)
+	c.Assert(s.storeClient.downloadURLs[0], check.Equals, getDownloadURL(testDefaultOS, 7))
+}
+
+func (s *imageSuite) TestCreateDownloadsGivenRevisions(c *check.C) {
+	s.cli.output = tmpDirName
+	snaps := s.storeClient.snapDetails(s.defaultOptions)
+	snaps["kernel"] = SnapDetails{Name: testDefaultKernel, Channel: testDefaultKernelChannel, Revision: "5",
+		Sha3_384: getSnapHash(testDefaultKernel, testDefaultKernelChannel)}
+	setRevisionDetails(s.webGetter, testDefaultKernel, 5, getSnapHash(testDefaultKernel, testDefaultKernelChannel))
+
+	_, _, manifest, err := s.subject.Create(s.defaultOptions, testDefaultVer, snaps)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.storeClient.downloadURLs[1], check.Equals, getDownloadURL(testDefaultKernel, 5))
+	c.Assert(manifest.Snaps[1].Revision, check.Equals, "5")
+}
+
+func (s *imageSuite) TestCreateRecordsSIVersionInManifestFor1504(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.Release = "15.04"
+
+	_, _, manifest, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(manifest.SIVersion, check.Equals, testDefaultVer)
+	c.Assert(manifest.Snaps, check.IsNil)
+	c.Assert(s.storeClient.totalSnapCalls, check.Equals, 0)
+}
+
+func (s *imageSuite) TestCreateRecordsRawOutputInManifest(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.ImageFormat = "raw"
+
+	_, _, manifest, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(manifest.Tools, check.HasLen, 1)
+	c.Assert(manifest.Output.Format, check.Equals, "raw")
+}
+
 func (s *imageSuite) TestCreateUsesTmpFileName(c *check.C) {
-	_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	c.Assert(s.cli.execCommandCalls["mktemp -d"], check.Equals, 1)
 	c.Assert(err, check.IsNil)
 }
 
+func (s *imageSuite) TestCreateReturnsTmpDir(c *check.C) {
+	s.cli.output = tmpDirName
+
+	path, tmpDir, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(tmpDir, check.Equals, tmpDirName)
+	c.Assert(filepath.Dir(path), check.Equals, tmpDir)
+}
+
+func (s *imageSuite) TestCreateReturnsTmpDirOnError(c *check.C) {
+	s.cli.output = tmpDirName
+	s.storeClient.corrupt = true
+
+	_, tmpDir, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.NotNil)
+	c.Assert(tmpDir, check.Equals, tmpDirName)
+}
+
 func (s *imageSuite) TestCreateTransformsToQCOW2(c *check.C) {
 	s.cli.output = tmpDirName
 	rawFilename := tmpRawFileName()
 	filename := tmpFileName()
 
-	s.subject.Create(s.defaultOptions, testDefaultVer)
+	s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	expectedCall := getExpectedCall(testDefaultQcow2compat, rawFilename, filename)
 	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
@@ -275,14 +562,256 @@ func (s *imageSuite) TestCreateDoesNotTransformToQCOW2OnUDFError(c *check.C) {
 	rawFilename := tmpRawFileName()
 	filename := tmpFileName()
 
-	s.subject.Create(s.defaultOptions, testDefaultVer)
+	s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	expectedCall := getExpectedCall(testDefaultQcow2compat, rawFilename, filename)
 	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 0)
 }
 
+func (s *imageSuite) TestCreateTransformsToRequestedFormat(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.ImageFormat = "vhd"
+	filename := filepath.Join(tmpDirName, "udf.vhd")
+
+	path, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Equals, filename)
+	expectedCall := fmt.Sprintf("/usr/bin/qemu-img convert -O vpc %s %s", tmpRawFileName(), filename)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateCompressesQCOW2IfRequested(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.Qcow2Compress = true
+
+	s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	expectedCall := fmt.Sprintf("/usr/bin/qemu-img convert -O qcow2 -o compat=%s -c %s %s",
+		testDefaultQcow2compat, tmpRawFileName(), tmpFileName())
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateDoesNotTransformRawImages(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.ImageFormat = "raw"
+
+	path, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Equals, tmpRawFileName())
+	for call := range s.cli.execCommandCalls {
+		c.Check(strings.HasPrefix(call, qemuImgPath), check.Equals, false)
+	}
+}
+
+func (s *imageSuite) TestCreateReturnsUnknownFormatError(c *check.C) {
+	s.defaultOptions.ImageFormat = "iso"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnknownFormat{})
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+}
+
+func (s *imageSuite) TestCreateUsesLocalSnapFiles(c *check.C) {
+	s.cli.output = tmpDirName
+	path := writeSnapFile(c, squashfsMagic)
+	defer os.Remove(path)
+	s.defaultOptions.OS = path
+	s.defaultOptions.KernelChannel = testDefaultOSChannel
+	s.defaultOptions.GadgetChannel = testDefaultOSChannel
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s --gadget %s --developer-mode -o %s",
+		testDefaultRelease, testDefaultOSChannel, path, getSnapFilename(testDefaultKernel, testDefaultOSChannel),
+		getSnapFilename(testDefaultGadget, testDefaultOSChannel), tmpRawFileName())
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 2)
+	c.Assert(s.storeClient.snapCalls[getSnapCall(testDefaultOS, testDefaultOSChannel)], check.Equals, 0)
+	_, err = os.Stat(path)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapFileForInvalidLocalSnaps(c *check.C) {
+	path := writeSnapFile(c, "not a snap")
+	defer os.Remove(path)
+
+	for _, file := range []string{path, "/non/existing/core.snap"} {
+		s.defaultOptions.Kernel = file
+
+		_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+		c.Check(err, check.FitsTypeOf, &ErrSnapFile{})
+	}
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+}
+
+func (s *imageSuite) TestCreateDownloadsPinnedRevisions(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.OS = testDefaultOS + "@42"
+	setRevisionDetails(s.webGetter, testDefaultOS, 42, getSnapHash(testDefaultOS, testDefaultOSChannel))
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s --gadget %s --developer-mode -o %s",
+		testDefaultRelease, testDefaultOSChannel, getSnapFilename(testDefaultOS, testDefaultOSChannel),
+		getSnapFilename(testDefaultKernel, testDefaultKernelChannel), getSnapFilename(testDefaultGadget, testDefaultGadgetChannel),
+		tmpRawFileName())
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+	c.Assert(s.storeClient.downloadURLs[0], check.Equals, getDownloadURL(testDefaultOS, 42))
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityOnHashMismatch(c *check.C) {
+	s.cli.output = tmpDirName
+	s.storeClient.corrupt = true
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+	_, err = os.Stat(getSnapFilename(testDefaultKernel, testDefaultKernelChannel))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	c.Assert(s.cli.execCommandCalls["mktemp -d"], check.Equals, 1)
+	c.Assert(s.cli.totalCalls, check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityOnPinnedRevisionHashMismatch(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.OS = testDefaultOS + "@42"
+	setRevisionDetails(s.webGetter, testDefaultOS, 42, getSnapHash(testDefaultOS, "other"))
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityOnAssertedRevisionMismatch(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.OS = testDefaultOS + "@42"
+	setRevisionDetails(s.webGetter, testDefaultOS, 42, "")
+	content := getSnapContent(testDefaultOS, testDefaultOSChannel)
+	s.webGetter.outputs[getAssertionURL(content)] = signAssertion(s.storeClient.key, content, getSnapID(testDefaultOS), 41)
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+	c.Assert(s.webGetter.calls, check.HasLen, 2)
+}
+
+func (s *imageSuite) TestCreateChecksAssertionsOfSnapsWithSha3(c *check.C) {
+	s.cli.output = tmpDirName
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.webGetter.calls[getAssertionURL(getSnapContent(testDefaultKernel, testDefaultKernelChannel))], check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateVerifiesSnapsFromCommonChannel(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.OSChannel = "edge"
+	s.defaultOptions.KernelChannel = "edge"
+	s.defaultOptions.GadgetChannel = "edge"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	for _, name := range testSnaps {
+		c.Check(s.webGetter.calls[getAssertionURL(getSnapContent(name, "edge"))], check.Equals, 1)
+	}
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityForCorruptSnapFromCommonChannel(c *check.C) {
+	s.cli.output = tmpDirName
+	s.storeClient.corrupt = true
+	s.defaultOptions.OSChannel = "edge"
+	s.defaultOptions.KernelChannel = "edge"
+	s.defaultOptions.GadgetChannel = "edge"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 1)
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityOnAssertedSnapIDMismatch(c *check.C) {
+	s.cli.output = tmpDirName
+	content := getSnapContent(testDefaultKernel, testDefaultKernelChannel)
+	s.webGetter.outputs[getAssertionURL(content)] = signAssertion(s.storeClient.key, content, getSnapID("other"), 2)
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityOnMissingAssertion(c *check.C) {
+	s.cli.output = tmpDirName
+	s.webGetter.outputs[getAssertionURL(getSnapContent(testDefaultKernel, testDefaultKernelChannel))] = ""
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityOnAssertionOfUnknownKey(c *check.C) {
+	s.cli.output = tmpDirName
+	path, keyring := writeKeyring(c, false)
+	defer os.Remove(path)
+	content := getSnapContent(testDefaultKernel, testDefaultKernelChannel)
+	s.webGetter.outputs[getAssertionURL(content)] = signAssertion(keyring[0], content, getSnapID(testDefaultKernel), 2)
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+}
+
+func (s *imageSuite) TestCreateReturnsErrSnapIntegrityOnTamperedAssertion(c *check.C) {
+	s.cli.output = tmpDirName
+	content := getSnapContent(testDefaultKernel, testDefaultKernelChannel)
+	assertion := signAssertion(s.storeClient.key, content, getSnapID(testDefaultKernel), 1)
+	s.webGetter.outputs[getAssertionURL(content)] = strings.Replace(assertion, "snap-revision: 1", "snap-revision: 2", 1)
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapIntegrity{})
+}
+
+func (s *imageSuite) TestCreateWithoutStoreKeyringDoesNotCheckAssertionSignatures(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.StoreKeyring = ""
+	path, keyring := writeKeyring(c, false)
+	defer os.Remove(path)
+	content := getSnapContent(testDefaultKernel, testDefaultKernelChannel)
+	s.webGetter.outputs[getAssertionURL(content)] = signAssertion(keyring[0], content, getSnapID(testDefaultKernel), 2)
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+}
+
+func (s *imageSuite) TestCreateReturnsErrorForInvalidStoreKeyring(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.StoreKeyring = "/non/existing/keyring.gpg"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 0)
+}
+
+func (s *imageSuite) TestPlanShowsPinnedRevisions(c *check.C) {
+	s.defaultOptions.Kernel = testDefaultKernel + "@42"
+
+	cmds := s.subject.Plan(s.defaultOptions, testDefaultVer)
+
+	c.Assert(strings.Join(cmds[0], " "), check.Matches, ".* --kernel <"+testDefaultKernel+" snap revision 42> .*")
+}
+
 func (s *imageSuite) TestCreateCallsStoreSnapForEachSnap(c *check.C) {
-	s.subject.Create(s.defaultOptions, testDefaultVer)
+	s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	for i := 1; i < len(testSnaps); i++ {
 		c.Check(s.storeClient.snapCalls[getSnapCall(testSnaps[i], testChannels[i])],
@@ -291,7 +820,7 @@ func (s *imageSuite) TestCreateCallsStoreSnapForEachSnap(c *check.C) {
 }
 
 func (s *imageSuite) TestCreateCallsStoreDownloadForEachSnap(c *check.C) {
-	s.subject.Create(s.defaultOptions, testDefaultVer)
+	s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	for i := 1; i < len(testSnaps); i++ {
 		c.Check(s.storeClient.downloadCalls[getDownloadCall(testSnaps[i], testChannels[i])],
@@ -302,11 +831,11 @@ func (s *imageSuite) TestCreateCallsStoreDownloadForEachSnap(c *check.C) {
 func (s *imageSuite) TestCreateReturnsStoreSnapErrorForEachSnap(c *check.C) {
 	s.storeClient.snapErr = true
 
-	for i := 1; i < len(testSnaps); i++ {
+	for i := 0; i < len(testSnaps); i++ {
 		s.storeClient.totalSnapCalls = 0
-		s.storeClient.correctSnapCalls = i - 1
+		s.storeClient.correctSnapCalls = i
 
-		_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+		_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 		c.Assert(err, check.NotNil)
 		c.Check(err, check.FitsTypeOf, &ErrRepoDetail{})
@@ -317,11 +846,11 @@ func (s *imageSuite) TestCreateReturnsStoreSnapErrorForEachSnap(c *check.C) {
 func (s *imageSuite) TestCreateReturnsStoreDownloadErrorForEachSnap(c *check.C) {
 	s.storeClient.downloadErr = true
 
-	for i := 1; i < len(testSnaps); i++ {
+	for i := 0; i < len(testSnaps); i++ {
 		s.storeClient.totalDownloadCalls = 0
-		s.storeClient.correctDownloadCalls = i - 1
+		s.storeClient.correctDownloadCalls = i
 
-		_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+		_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 		c.Assert(err, check.NotNil)
 		c.Check(err, check.FitsTypeOf, &ErrRepoDownload{})
@@ -339,10 +868,11 @@ func (s *imageSuite) TestCreateSetsChannelWhenAllSnapChannelsAreEqual(c *check.C
 	s.cli.output = tmpDirName
 	filename := tmpRawFileName()
 
-	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s --gadget %s --developer-mode  -o "+filename,
-		s.defaultOptions.Release, commonChannel, s.defaultOptions.OS, s.defaultOptions.Kernel, s.defaultOptions.Gadget)
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s --gadget %s --developer-mode -o "+filename,
+		s.defaultOptions.Release, commonChannel, getSnapFilename(s.defaultOptions.OS, commonChannel),
+		getSnapFilename(s.defaultOptions.Kernel, commonChannel), getSnapFilename(s.defaultOptions.Gadget, commonChannel))
 
-	_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	c.Check(err, check.IsNil)
 	c.Assert(len(s.cli.execCommandCalls) > 0, check.Equals, true)
@@ -359,10 +889,11 @@ func (s *imageSuite) TestCreateSetsChannelWhenTwoSnapChannelsAreEqual(c *check.C
 	s.cli.output = tmpDirName
 	filename := tmpRawFileName()
 
-	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s_%s.snap --kernel %s --gadget %s --developer-mode  -o "+filename,
-		s.defaultOptions.Release, commonChannel, s.defaultOptions.OS, anotherChannel, s.defaultOptions.Kernel, s.defaultOptions.Gadget)
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s_%s.snap --kernel %s --gadget %s --developer-mode -o "+filename,
+		s.defaultOptions.Release, commonChannel, s.defaultOptions.OS, anotherChannel,
+		getSnapFilename(s.defaultOptions.Kernel, commonChannel), getSnapFilename(s.defaultOptions.Gadget, commonChannel))
 
-	_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	c.Check(err, check.IsNil)
 	c.Assert(len(s.cli.execCommandCalls) > 0, check.Equals, true)
@@ -373,16 +904,155 @@ func (s *imageSuite) TestCreateSetsChannelWhenAllSnapChannelsAreDifferent(c *che
 	s.cli.output = tmpDirName
 	filename := tmpRawFileName()
 
-	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s --kernel %s_%s.snap --gadget %s_%s.snap --developer-mode  -o "+filename,
-		s.defaultOptions.Release, s.defaultOptions.OSChannel, s.defaultOptions.OS, s.defaultOptions.Kernel, s.defaultOptions.KernelChannel, s.defaultOptions.Gadget, s.defaultOptions.GadgetChannel)
+	expectedCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os %s_%s.snap --kernel %s_%s.snap --gadget %s_%s.snap --developer-mode -o "+filename,
+		s.defaultOptions.Release, s.defaultOptions.OSChannel, s.defaultOptions.OS, s.defaultOptions.OSChannel, s.defaultOptions.Kernel, s.defaultOptions.KernelChannel, s.defaultOptions.Gadget, s.defaultOptions.GadgetChannel)
 
-	_, err := s.subject.Create(s.defaultOptions, testDefaultVer)
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
 
 	c.Check(err, check.IsNil)
 	c.Assert(len(s.cli.execCommandCalls) > 0, check.Equals, true)
 	c.Check(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
 }
 
+func (s *imageSuite) TestPlanReturnsCommands(c *check.C) {
+	rawFilename := filepath.Join(planTmpDir, rawOutputFileName)
+	filename := filepath.Join(planTmpDir, "udf.img")
+	expectedUDFCall := fmt.Sprintf("sudo ubuntu-device-flash core %s --channel %s --os <%s snap from %s> --kernel <%s snap from %s> --gadget <%s snap from %s> --developer-mode -o %s",
+		s.defaultOptions.Release, s.defaultOptions.OSChannel, s.defaultOptions.OS, s.defaultOptions.OSChannel, s.defaultOptions.Kernel, s.defaultOptions.KernelChannel, s.defaultOptions.Gadget, s.defaultOptions.GadgetChannel, rawFilename)
+
+	cmds := s.subject.Plan(s.defaultOptions, testDefaultVer)
+
+	c.Assert(cmds, check.HasLen, 2)
+	c.Assert(strings.Join(cmds[0], " "), check.Equals, expectedUDFCall)
+	c.Assert(strings.Join(cmds[1], " "), check.Equals, getExpectedCall(testDefaultQcow2compat, rawFilename, filename))
+}
+
+func (s *imageSuite) TestPlanDoesNotConvertRawImages(c *check.C) {
+	s.defaultOptions.ImageFormat = "raw"
+
+	cmds := s.subject.Plan(s.defaultOptions, testDefaultVer)
+
+	c.Assert(cmds, check.HasLen, 1)
+}
+
+func (s *imageSuite) TestPlanDoesNotExecuteCommands(c *check.C) {
+	s.subject.Plan(s.defaultOptions, testDefaultVer)
+
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+	c.Assert(s.storeClient.totalSnapCalls, check.Equals, 0)
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 0)
+}
+
+func (s *imageSuite) TestDetectFormatCallsQemuImgInfo(c *check.C) {
+	s.cli.output = `{"virtual-size": 4294967296, "filename": "myimage.img", "format": "raw"}`
+
+	format, err := s.subject.DetectFormat("myimage.img")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(format, check.Equals, "raw")
+	c.Assert(s.cli.execCommandCalls["/usr/bin/qemu-img info --output=json myimage.img"], check.Equals, 1)
+}
+
+func (s *imageSuite) TestDetectFormatReturnsQemuImgError(c *check.C) {
+	s.cli.err = true
+
+	_, err := s.subject.DetectFormat("myimage.img")
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *imageSuite) TestDetectFormatReturnsDecodingError(c *check.C) {
+	s.cli.output = "not json"
+
+	_, err := s.subject.DetectFormat("myimage.img")
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *imageSuite) TestConvertTransformsToQCOW2InTmpDir(c *check.C) {
+	s.cli.output = tmpDirName
+
+	output, tmpDir, err := s.subject.Convert(s.defaultOptions, "myimage.img")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, tmpFileName())
+	c.Assert(tmpDir, check.Equals, tmpDirName)
+	c.Assert(s.cli.execCommandCalls["mktemp -d"], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls[getExpectedCall(testDefaultQcow2compat, "myimage.img", tmpFileName())], check.Equals, 1)
+}
+
+func (s *imageSuite) TestConvertTransformsToRequestedFormat(c *check.C) {
+	s.cli.output = tmpDirName
+	s.defaultOptions.ImageFormat = "vmdk"
+	filename := filepath.Join(tmpDirName, "udf.vmdk")
+
+	output, _, err := s.subject.Convert(s.defaultOptions, "myimage.img")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, filename)
+	c.Assert(s.cli.execCommandCalls["/usr/bin/qemu-img convert -O vmdk myimage.img "+filename], check.Equals, 1)
+}
+
+func (s *imageSuite) TestConvertDoesNotConvertOnMktempError(c *check.C) {
+	s.cli.err = true
+
+	_, _, err := s.subject.Convert(s.defaultOptions, "myimage.img")
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.cli.totalCalls, check.Equals, 1)
+}
+
+func (s *imageSuite) TestGetSnapsQueriesStoreForEachSnap(c *check.C) {
+	snaps, err := NewStorePollster(s.storeClient, s.webGetter).GetSnaps(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(snaps, check.DeepEquals, map[string]SnapDetails{
+		"os":     {Name: testDefaultOS, Channel: testDefaultOSChannel, Revision: "1", Sha3_384: getSnapHash(testDefaultOS, testDefaultOSChannel)},
+		"kernel": {Name: testDefaultKernel, Channel: testDefaultKernelChannel, Revision: "2", Sha3_384: getSnapHash(testDefaultKernel, testDefaultKernelChannel)},
+		"gadget": {Name: testDefaultGadget, Channel: testDefaultGadgetChannel, Revision: "3", Sha3_384: getSnapHash(testDefaultGadget, testDefaultGadgetChannel)},
+	})
+	for i := 0; i < len(testSnaps); i++ {
+		c.Check(s.storeClient.snapCalls[getSnapCall(testSnaps[i], testChannels[i])], check.Equals, 1)
+	}
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 0)
+}
+
+func (s *imageSuite) TestGetSnapsRecordsPinnedAndLocalSnaps(c *check.C) {
+	path := writeSnapFile(c, squashfsMagic)
+	defer os.Remove(path)
+	s.defaultOptions.OS = path
+	s.defaultOptions.Kernel = testDefaultKernel + "@7"
+	setRevisionDetails(s.webGetter, testDefaultKernel, 7, "kernelhash")
+	sum := sha3.Sum384([]byte(squashfsMagic))
+
+	snaps, err := NewStorePollster(s.storeClient, s.webGetter).GetSnaps(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(snaps["os"], check.DeepEquals, SnapDetails{Name: strings.TrimSuffix(filepath.Base(path), snapFileSuffix),
+		Revision: LocalRevision, Sha3_384: hex.EncodeToString(sum[:])})
+	c.Assert(snaps["kernel"], check.DeepEquals, SnapDetails{Name: testDefaultKernel, Channel: testDefaultKernelChannel, Revision: "7",
+		Sha3_384: "kernelhash"})
+	c.Assert(s.storeClient.totalSnapCalls, check.Equals, 2)
+}
+
+func (s *imageSuite) TestGetSnapsReturnsErrSnapFileForMissingLocalSnaps(c *check.C) {
+	s.defaultOptions.OS = "/non/existing/core_16-2_amd64.snap"
+
+	_, err := NewStorePollster(s.storeClient, s.webGetter).GetSnaps(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapFile{})
+}
+
+func (s *imageSuite) TestGetSnapsReturnsStoreSnapError(c *check.C) {
+	s.storeClient.snapErr = true
+	s.storeClient.correctSnapCalls = 1
+
+	_, err := NewStorePollster(s.storeClient, s.webGetter).GetSnaps(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrRepoDetail{})
+	c.Assert(err.Error(), check.Equals, fmt.Sprintf(errRepoDetailFmt, testDefaultKernel, "", testDefaultKernelChannel))
+}
+
 func extractKey(m map[string]int, order int) string {
 	keys := []string{}
 	for key := range m {
@@ -391,12 +1061,17 @@ func extractKey(m map[string]int, order int) string {
 	return keys[order]
 }
 
+// fakeOutputDigest is used instead of fileSha256, the created image files don't exist
+func fakeOutputDigest(path string) (string, int64, error) {
+	return testOutputSha256, testOutputSize, nil
+}
+
 func tmpRawFileName() string {
 	return filepath.Join(tmpDirName, rawOutputFileName)
 }
 
 func tmpFileName() string {
-	return filepath.Join(tmpDirName, outputFileName)
+	return filepath.Join(tmpDirName, "udf.img")
 }
 
 func getExpectedCall(compat, inputFile, outputFile string) string {
@@ -408,6 +1083,47 @@ func getSnapCall(name, channel string) string {
 	return fmt.Sprintf("%s - %s", name, channel)
 }
 
+func getDownloadURL(name string, revision int) string {
+	return fmt.Sprintf("https://store/download-snap/%sid_%d.snap", name, revision)
+}
+
+func getSnapContent(name, channel string) string {
+	return name + " from " + channel
+}
+
+// setRevisionDetails makes the fake store details endpoint return the given
+// revision of the snap with the given hash
+func setRevisionDetails(f *fakeWebGetter, name string, revision int, hash string) {
+	f.outputs[fmt.Sprintf(storeRevisionURL, name, revision)] = fmt.Sprintf(
+		`{"package_name": %q, "revision": %d, "anon_download_url": %q, "download_url": %q, "download_sha3_384": %q, "binary_filesize": 1024}`,
+		name, revision, getDownloadURL(name, revision), getDownloadURL(name, revision), hash)
+}
+
+func getSnapID(name string) string {
+	return name + "-id"
+}
+
+func getAssertionURL(content string) string {
+	sum := sha3.Sum384([]byte(content))
+	return fmt.Sprintf(snapRevisionAssertionURL, base64.RawURLEncoding.EncodeToString(sum[:]))
+}
+
+// signAssertion returns the snap-revision assertion of a snap with the given
+// content signed with key
+func signAssertion(key *openpgp.Entity, content, snapID string, revision int) string {
+	sum := sha3.Sum384([]byte(content))
+	headers := fmt.Sprintf("type: snap-revision\nsnap-sha3-384: %s\nsnap-id: %s\nsnap-revision: %d",
+		base64.RawURLEncoding.EncodeToString(sum[:]), snapID, revision)
+	var signature bytes.Buffer
+	openpgp.DetachSign(&signature, key, strings.NewReader(headers), nil)
+	return headers + "\n\n" + base64.StdEncoding.EncodeToString(signature.Bytes())
+}
+
+func getSnapHash(name, channel string) string {
+	sum := sha3.Sum384([]byte(getSnapContent(name, channel)))
+	return hex.EncodeToString(sum[:])
+}
+
 func getSnapFilename(name, channel string) string {
 	return fmt.Sprintf("%s_%s.snap", name, channel)
 }
@@ -415,3 +1131,14 @@ func getSnapFilename(name, channel string) string {
 func getDownloadCall(name, channel string) string {
 	return fmt.Sprintf("%s - %s", name, channel)
 }
+
+func writeSnapFile(c *check.C, content string) string {
+	file, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	_, err = file.WriteString(content)
+	c.Assert(err, check.IsNil)
+	path := file.Name() + snapFileSuffix
+	c.Assert(os.Rename(file.Name(), path), check.IsNil)
+	return path
+}
@@ -0,0 +1,175 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/snapcore/snapd/snap"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+const (
+	snapRevisionAssertionURL = "https://assertions.ubuntu.com/v1/assertions/snap-revision/%s"
+	snapRevisionType         = "snap-revision"
+	openpgpSignaturePrefix   = "openpgp "
+)
+
+// ErrSnapIntegrity is the type of the error returned when a downloaded snap
+// doesn't match the details published by the store
+type ErrSnapIntegrity struct {
+	name, reason string
+}
+
+func (e *ErrSnapIntegrity) Error() string {
+	return fmt.Sprintf("error verifying downloaded snap %s: %s", e.name, e.reason)
+}
+
+// ReadKeyring returns the keys in the given armored or binary keyring file
+func ReadKeyring(path string) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content)); err == nil {
+		return keyring, nil
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(content))
+}
+
+// fileGetter returns the function that downloads the snaps of an image built
+// with options, their assertions are checked with the keys of options.StoreKeyring
+func (d *snapDownloader) fileGetter(options *flags.Options) (getFileFunc, error) {
+	var keyring openpgp.EntityList
+	if options.StoreKeyring != "" {
+		var err error
+		if keyring, err = ReadKeyring(options.StoreKeyring); err != nil {
+			return nil, err
+		}
+	}
+	return func(ref *SnapRef, channel string) (string, *snap.Info, error) {
+		return d.getSnapFile(ref, channel, keyring)
+	}, nil
+}
+
+// verifySnap checks the downloaded snap file at path against its store details.
+// The sha3-384 given by the store must match, and the snap-revision assertion of
+// the digest of the file must assert the snap-id and revision of the details.
+// The signature of the assertion must be made by a key of keyring, it is not
+// checked when no keyring is given
+func (d *snapDownloader) verifySnap(remoteSnap *snap.Info, path string, keyring openpgp.EntityList) error {
+	sum, err := fileSha3_384(path)
+	if err != nil {
+		return &ErrSnapIntegrity{name: remoteSnap.Name(), reason: err.Error()}
+	}
+	if remoteSnap.Sha3_384 != "" {
+		if actual := hex.EncodeToString(sum); actual != remoteSnap.Sha3_384 {
+			return &ErrSnapIntegrity{name: remoteSnap.Name(),
+				reason: fmt.Sprintf("sha3-384 %s doesn't match %s", actual, remoteSnap.Sha3_384)}
+		}
+	}
+	digest := base64.RawURLEncoding.EncodeToString(sum)
+	content, err := d.httpClient.Get(fmt.Sprintf(snapRevisionAssertionURL, digest))
+	if err != nil {
+		return &ErrSnapIntegrity{name: remoteSnap.Name(), reason: err.Error()}
+	}
+	if keyring == nil {
+		log.Warnf("No store keyring given, the signature of the snap-revision assertion of %s is not verified", remoteSnap.Name())
+	}
+	headers, err := checkAssertion(content, keyring)
+	if err != nil {
+		return &ErrSnapIntegrity{name: remoteSnap.Name(),
+			reason: fmt.Sprintf("invalid snap-revision assertion for digest %s: %s", digest, err)}
+	}
+	if headers["type"] != snapRevisionType || headers["snap-sha3-384"] != digest {
+		return &ErrSnapIntegrity{name: remoteSnap.Name(), reason: "no snap-revision assertion for digest " + digest}
+	}
+	if headers["snap-id"] != remoteSnap.SnapID {
+		return &ErrSnapIntegrity{name: remoteSnap.Name(),
+			reason: fmt.Sprintf("snap-id %s asserted for digest %s, expected %s", headers["snap-id"], digest, remoteSnap.SnapID)}
+	}
+	revision, err := strconv.Atoi(headers["snap-revision"])
+	if err != nil || revision != remoteSnap.Revision {
+		return &ErrSnapIntegrity{name: remoteSnap.Name(),
+			reason: fmt.Sprintf("revision %s asserted for digest %s, expected %d", headers["snap-revision"], digest, remoteSnap.Revision)}
+	}
+	return nil
+}
+
+// fileSha3_384 returns the sha3-384 sum of the contents of the file at path
+func fileSha3_384(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha3.New384()
+	if _, err = io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// checkAssertion returns the headers of an assertion in its text encoding: the
+// headers, an optional body and the base64 encoded OpenPGP signature of the rest
+// separated by empty lines. If keyring is given the signature must be made by
+// one of its keys
+func checkAssertion(content []byte, keyring openpgp.EntityList) (map[string]string, error) {
+	content = bytes.TrimRight(content, "\n")
+	sep := bytes.LastIndex(content, []byte("\n\n"))
+	if sep < 0 {
+		return nil, errors.New("no signature")
+	}
+	signed, encoded := content[:sep], strings.TrimPrefix(string(content[sep+2:]), openpgpSignaturePrefix)
+	if keyring != nil {
+		signature, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(signature)); err != nil {
+			return nil, err
+		}
+	}
+	if end := bytes.Index(signed, []byte("\n\n")); end >= 0 {
+		signed = signed[:end]
+	}
+	headers := make(map[string]string)
+	for _, line := range strings.Split(string(signed), "\n") {
+		// multiline values are indented, only single line headers are needed
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 && !strings.HasPrefix(line, " ") {
+			headers[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+	return headers, nil
+}
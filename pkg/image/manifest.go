@@ -0,0 +1,184 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
+)
+
+const unknownToolVersion = "unknown"
+
+var (
+	// outputDigest returns the hex encoded sha256 and the size of the created image
+	outputDigest = fileSha256
+
+	// versionCmds are the commands reporting the version of the tools that don't
+	// support --version
+	versionCmds = map[string][]string{
+		"ubuntu-device-flash": {"dpkg-query", "-W", "-f=${Version}", "ubuntu-device-flash"},
+	}
+)
+
+// Manifest records what went into an image created by a Driver. The build
+// action completes it with the name, options and properties of the image
+type Manifest struct {
+	Image       string         `json:"image,omitempty"`
+	Release     string         `json:"release,omitempty"`
+	Arch        string         `json:"arch,omitempty"`
+	ImageType   string         `json:"image_type,omitempty"`
+	Qcow2compat string         `json:"qcow2compat,omitempty"`
+	ToolVersion string         `json:"tool_version,omitempty"`
+	SIVersion   int            `json:"si_version,omitempty"`
+	Snaps       []ManifestSnap `json:"snaps,omitempty"`
+	Tools       []ManifestTool `json:"tools"`
+	Output      ManifestOutput `json:"output"`
+	Properties  string         `json:"properties,omitempty"`
+}
+
+// ManifestSnap describes one of the input snaps, Path is only set for local files
+type ManifestSnap struct {
+	Role     string `json:"role"`
+	Name     string `json:"name"`
+	Channel  string `json:"channel,omitempty"`
+	Revision string `json:"revision"`
+	Sha3_384 string `json:"sha3_384"`
+	Path     string `json:"path,omitempty"`
+}
+
+// ManifestTool describes an external tool execution
+type ManifestTool struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Args    []string `json:"args"`
+}
+
+// ManifestOutput describes the created image file
+type ManifestOutput struct {
+	Format string `json:"format"`
+	Sha256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// ErrManifestKey is the type of the error returned by SignManifest when the
+// given keyring has no usable secret key
+type ErrManifestKey struct {
+	path, msg string
+}
+
+func (e *ErrManifestKey) Error() string {
+	return fmt.Sprintf("error reading manifest signing key %s: %s", e.path, e.msg)
+}
+
+// addTool records the execution of the given command line, a leading sudo is left out
+func (m *Manifest) addTool(c cli.Commander, cmds []string) {
+	if len(cmds) > 0 && cmds[0] == "sudo" {
+		cmds = cmds[1:]
+	}
+	m.Tools = append(m.Tools, ManifestTool{Name: cmds[0], Version: toolVersion(c, cmds[0]), Args: cmds[1:]})
+}
+
+// setOutput records the digest and size of the created image file
+func (m *Manifest) setOutput(path string, format *Format) (err error) {
+	m.Output.Format = format.Name
+	m.Output.Sha256, m.Output.Size, err = outputDigest(path)
+	return
+}
+
+// toolVersion returns the first line of the version reported by the given tool
+func toolVersion(c cli.Commander, name string) string {
+	cmds, ok := versionCmds[name]
+	if !ok {
+		cmds = []string{name, "--version"}
+	}
+	output, err := c.ExecCommand(cmds...)
+	if err != nil {
+		log.Warnf("Error getting the version of %s: %s", name, err)
+		return unknownToolVersion
+	}
+	return strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])
+}
+
+// manifestSnaps returns the details of the input snaps of an all-snaps image,
+// the ones given as local files are recorded with their path
+func manifestSnaps(snaps map[string]SnapDetails, files *snapFiles) []ManifestSnap {
+	var items []ManifestSnap
+	for _, role := range SnapRoles {
+		details := snaps[role]
+		item := ManifestSnap{Role: role, Name: details.Name, Channel: details.Channel,
+			Revision: details.Revision, Sha3_384: details.Sha3_384}
+		if details.Revision == LocalRevision {
+			item.Path = files.paths[role]
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// SignManifest returns the armored detached signature of content made with the
+// first unencrypted secret key of the armored or binary keyring at keyPath
+func SignManifest(content []byte, keyPath string) ([]byte, error) {
+	keyring, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyring))
+	if err != nil {
+		if entities, err = openpgp.ReadKeyRing(bytes.NewReader(keyring)); err != nil {
+			return nil, &ErrManifestKey{path: keyPath, msg: err.Error()}
+		}
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey == nil || entity.PrivateKey.Encrypted {
+			continue
+		}
+		var signature bytes.Buffer
+		if err = openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader(content), nil); err != nil {
+			return nil, err
+		}
+		return signature.Bytes(), nil
+	}
+	return nil, &ErrManifestKey{path: keyPath, msg: "no unencrypted secret key found"}
+}
+
+// fileSha256 returns the hex encoded sha256 and the size of the file at path
+func fileSha256(path string) (sum string, size int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if size, err = io.Copy(hash, file); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,129 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/openpgp"
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&manifestSuite{})
+
+type manifestSuite struct {
+	cli *fakeCliCommander
+}
+
+func (s *manifestSuite) SetUpTest(c *check.C) {
+	s.cli = &fakeCliCommander{execCommandCalls: make(map[string]int)}
+}
+
+func (s *manifestSuite) TestToolVersionReturnsFirstLine(c *check.C) {
+	s.cli.output = "qemu-img version 2.5.0\nCopyright (c) 2003-2008 Fabrice Bellard\n"
+
+	version := toolVersion(s.cli, qemuImgPath)
+
+	c.Assert(version, check.Equals, "qemu-img version 2.5.0")
+	c.Assert(s.cli.execCommandCalls[qemuImgPath+" --version"], check.Equals, 1)
+}
+
+func (s *manifestSuite) TestToolVersionQueriesPackageOfUDF(c *check.C) {
+	s.cli.output = "0.31-0ubuntu1"
+
+	version := toolVersion(s.cli, "ubuntu-device-flash")
+
+	c.Assert(version, check.Equals, "0.31-0ubuntu1")
+	c.Assert(s.cli.execCommandCalls["dpkg-query -W -f=${Version} ubuntu-device-flash"], check.Equals, 1)
+}
+
+func (s *manifestSuite) TestToolVersionReturnsUnknownOnError(c *check.C) {
+	s.cli.err = true
+
+	c.Assert(toolVersion(s.cli, "ubuntu-image"), check.Equals, unknownToolVersion)
+}
+
+func (s *manifestSuite) TestAddToolLeavesOutSudo(c *check.C) {
+	s.cli.output = "0.31"
+	manifest := &Manifest{}
+
+	manifest.addTool(s.cli, []string{"sudo", "ubuntu-device-flash", "core", "rolling"})
+
+	c.Assert(manifest.Tools, check.DeepEquals, []ManifestTool{
+		{Name: "ubuntu-device-flash", Version: "0.31", Args: []string{"core", "rolling"}}})
+}
+
+func (s *manifestSuite) TestFileSha256(c *check.C) {
+	path := writeSnapFile(c, "image content")
+	defer os.Remove(path)
+
+	sum, size, err := fileSha256(path)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(sum, check.Equals, "b78f9dfd81d9bc073cad0a0e3acb1d6b164ede188bd71beb775b8004d7237117")
+	c.Assert(size, check.Equals, int64(len("image content")))
+}
+
+func (s *manifestSuite) TestSignManifest(c *check.C) {
+	path, keyring := writeKeyring(c, true)
+	defer os.Remove(path)
+
+	signature, err := SignManifest([]byte("manifest"), path)
+
+	c.Assert(err, check.IsNil)
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader([]byte("manifest")), bytes.NewReader(signature))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *manifestSuite) TestSignManifestReturnsErrorWithoutSecretKey(c *check.C) {
+	path, _ := writeKeyring(c, false)
+	defer os.Remove(path)
+
+	_, err := SignManifest([]byte("manifest"), path)
+
+	c.Assert(err, check.FitsTypeOf, &ErrManifestKey{})
+}
+
+func (s *manifestSuite) TestSignManifestReturnsErrorForInvalidKeyring(c *check.C) {
+	path := writeSnapFile(c, "not a keyring")
+	defer os.Remove(path)
+
+	_, err := SignManifest([]byte("manifest"), path)
+
+	c.Assert(err, check.FitsTypeOf, &ErrManifestKey{})
+}
+
+// writeKeyring creates a new key and writes it to a keyring file, only its
+// public part if secret is false
+func writeKeyring(c *check.C, secret bool) (string, openpgp.EntityList) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	c.Assert(err, check.IsNil)
+	file, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	if secret {
+		c.Assert(entity.SerializePrivate(file, nil), check.IsNil)
+	} else {
+		c.Assert(entity.Serialize(file), check.IsNil)
+	}
+	return file.Name(), openpgp.EntityList{entity}
+}
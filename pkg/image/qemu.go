@@ -0,0 +1,168 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+const (
+	kvmDevice = "/dev/kvm"
+	// bootMarkers match the serial console output of a booted image: the login
+	// prompt or the end of the cloud-init run
+	bootMarkers = `login:|Cloud-init v\. [^ ]+ finished`
+	// bootWatchScript runs the command given after its arguments, the console
+	// log file, the timeout in seconds and the boot markers, until the markers
+	// are found in its output, it exits or the timeout expires. It prints the
+	// outcome, one of the boot statuses
+	bootWatchScript = `log=$1 deadline=$(($(date +%s) + $2)) markers=$3
+shift 3
+"$@" >"$log" 2>&1 &
+pid=$!
+while kill -0 $pid 2>/dev/null; do
+	if grep -sqE "$markers" "$log"; then
+		kill $pid
+		echo booted
+		exit 0
+	fi
+	if [ $(date +%s) -ge $deadline ]; then
+		kill $pid
+		echo timeout
+		exit 0
+	fi
+	sleep 1
+done
+if grep -sqE "$markers" "$log"; then
+	echo booted
+else
+	echo exited
+fi`
+	bootedStatus  = "booted"
+	timeoutStatus = "timeout"
+)
+
+var (
+	kvmAvailable = func() bool {
+		file, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+		if err != nil {
+			return false
+		}
+		file.Close()
+		return true
+	}
+	firmwareAvailable = func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+)
+
+// ErrSmokeTest is the type of the error returned by QEMUVerifier when the
+// image doesn't boot
+type ErrSmokeTest struct {
+	path, reason string
+}
+
+func (e *ErrSmokeTest) Error() string {
+	return fmt.Sprintf("error smoke testing image %s: %s", e.path, e.reason)
+}
+
+// QEMUVerifier is a concrete implementation of Verifier that boots the image
+// with QEMU
+type QEMUVerifier struct {
+	cli cli.Commander
+}
+
+// NewQEMUVerifier is the QEMUVerifier constructor
+func NewQEMUVerifier(cli cli.Commander) *QEMUVerifier {
+	return &QEMUVerifier{cli: cli}
+}
+
+// Verify boots the given image and waits up to options.SmokeTestTimeout for
+// the login prompt or the cloud-init finished message in the serial console. KVM
+// is used if available, TCG otherwise. The image is not modified
+func (q *QEMUVerifier) Verify(options *flags.Options, path string) (err error) {
+	cmds, err := qemuCmd(options, path, kvmAvailable())
+	if err != nil {
+		return
+	}
+	arch, _ := ArchFor(options)
+	if arch.QemuFirmware != "" && !firmwareAvailable(arch.QemuFirmware) {
+		return &ErrSmokeTest{path: path, reason: fmt.Sprintf("firmware %s of arch %s not found", arch.QemuFirmware, arch.Name)}
+	}
+	console, err := ioutil.TempFile("", "console")
+	if err != nil {
+		return
+	}
+	console.Close()
+	defer os.Remove(console.Name())
+
+	log.Debugf("Executing command %v", cmds)
+	timeout := int((options.SmokeTestTimeout + time.Second - 1) / time.Second)
+	output, err := q.cli.ExecCommand(append([]string{"sh", "-c", bootWatchScript, "sh",
+		console.Name(), strconv.Itoa(timeout), bootMarkers}, cmds...)...)
+	if err != nil {
+		return
+	}
+	switch strings.TrimSpace(output) {
+	case bootedStatus:
+		log.Infof("Image %s booted successfully", path)
+		return nil
+	case timeoutStatus:
+		return &ErrSmokeTest{path: path, reason: fmt.Sprintf("image not booted after %s", options.SmokeTestTimeout)}
+	}
+	return &ErrSmokeTest{path: path, reason: "QEMU exited before the image booted"}
+}
+
+// qemuCmd returns the command line for booting the image, the changes to the
+// disk are discarded. KVM is only used for the archs that support it, the rest
+// emulate the CPU of the arch and boot its firmware
+func qemuCmd(options *flags.Options, path string, kvm bool) ([]string, error) {
+	arch, err := ArchFor(options)
+	if err != nil {
+		return nil, err
+	}
+	format, err := FormatFor(options)
+	if err != nil {
+		return nil, err
+	}
+	cmds := []string{arch.QemuSystem, "-machine", arch.QemuMachine}
+	if kvm && arch.KVM {
+		cmds = append(cmds, "-enable-kvm", "-cpu", "host")
+	} else if arch.QemuCPU != "" {
+		cmds = append(cmds, "-cpu", arch.QemuCPU)
+	}
+	if arch.QemuFirmware != "" {
+		cmds = append(cmds, "-bios", arch.QemuFirmware)
+	}
+	return append(cmds,
+		"-m", "1024", "-nographic", "-snapshot",
+		"-drive", "file="+path+",format="+format.QemuFormat+",if=virtio",
+		"-net", "nic", "-net", "user"), nil
+}
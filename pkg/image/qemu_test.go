@@ -0,0 +1,233 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+var _ = check.Suite(&qemuSuite{})
+
+type qemuSuite struct {
+	subject          Verifier
+	cli              *fakeQemuCli
+	backKvmAvailable func() bool
+	backFirmware     func(string) bool
+	kvm              bool
+	firmware         bool
+	commands         []string
+	options          *flags.Options
+}
+
+// fakeQemuCli records the QEMU command lines run by the boot watch script and
+// returns the given status
+type fakeQemuCli struct {
+	s      *qemuSuite
+	status string
+	err    bool
+}
+
+func (f *fakeQemuCli) ExecCommand(cmds ...string) (output string, err error) {
+	// sh -c script sh log timeout markers qemu...
+	f.s.commands = append(f.s.commands, strings.Join(cmds[7:], " "))
+	if f.err {
+		err = fmt.Errorf("exec error")
+	}
+	return f.status + "\n", err
+}
+
+func (s *qemuSuite) SetUpSuite(c *check.C) {
+	s.backKvmAvailable = kvmAvailable
+	s.backFirmware = firmwareAvailable
+	kvmAvailable = func() bool { return s.kvm }
+	firmwareAvailable = func(string) bool { return s.firmware }
+	s.cli = &fakeQemuCli{s: s}
+	s.subject = NewQEMUVerifier(s.cli)
+}
+
+func (s *qemuSuite) TearDownSuite(c *check.C) {
+	kvmAvailable = s.backKvmAvailable
+	firmwareAvailable = s.backFirmware
+}
+
+func (s *qemuSuite) SetUpTest(c *check.C) {
+	s.cli.status = bootedStatus
+	s.cli.err = false
+	s.kvm = false
+	s.firmware = true
+	s.commands = nil
+	s.options = &flags.Options{Arch: "amd64", SmokeTestTimeout: 5 * time.Second}
+}
+
+// watchBoot runs the boot watch script for the given command and timeout
+func watchBoot(c *check.C, timeout int, cmds ...string) string {
+	console := c.MkDir() + "/console"
+	output, err := (&cli.Executor{}).ExecCommand(append([]string{"sh", "-c", bootWatchScript, "sh",
+		console, fmt.Sprint(timeout), bootMarkers}, cmds...)...)
+	c.Assert(err, check.IsNil)
+	return strings.TrimSpace(output)
+}
+
+func (s *qemuSuite) TestBootWatchScriptDetectsLoginPrompt(c *check.C) {
+	// the login prompt isn't followed by a new line, QEMU keeps running
+	status := watchBoot(c, 10, "sh", "-c", `printf "Ubuntu 16.04 LTS ubuntu ttyS0\n\nubuntu login: "; exec sleep 60`)
+
+	c.Assert(status, check.Equals, bootedStatus)
+}
+
+func (s *qemuSuite) TestBootWatchScriptDetectsCloudInitFinished(c *check.C) {
+	status := watchBoot(c, 10, "sh", "-c",
+		`echo "Cloud-init v. 0.7.7 finished at Tue, 14 Jun 2016 12:00:00 +0000. Up 20.00 seconds"; exec sleep 60`)
+
+	c.Assert(status, check.Equals, bootedStatus)
+}
+
+func (s *qemuSuite) TestBootWatchScriptReportsTimeout(c *check.C) {
+	status := watchBoot(c, 1, "sh", "-c", `echo "Loading kernel"; exec sleep 60`)
+
+	c.Assert(status, check.Equals, timeoutStatus)
+}
+
+func (s *qemuSuite) TestBootWatchScriptReportsExit(c *check.C) {
+	status := watchBoot(c, 10, "sh", "-c", `echo "Could not open disk image"; exit 1`)
+
+	c.Assert(status, check.Equals, "exited")
+}
+
+func (s *qemuSuite) TestVerifyBootsImageWithQEMU(c *check.C) {
+	err := s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.commands, check.DeepEquals, []string{
+		"qemu-system-x86_64 -machine pc -m 1024 -nographic -snapshot -drive file=myimage.img,format=qcow2,if=virtio -net nic -net user"})
+}
+
+func (s *qemuSuite) TestVerifyUsesImageFormat(c *check.C) {
+	s.options.ImageFormat = "vhd"
+
+	err := s.subject.Verify(s.options, "myimage.vhd")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.commands, check.HasLen, 1)
+	c.Assert(strings.Contains(s.commands[0], "-drive file=myimage.vhd,format=vpc,if=virtio"), check.Equals, true)
+}
+
+func (s *qemuSuite) TestVerifyUsesKVMIfAvailable(c *check.C) {
+	s.kvm = true
+
+	err := s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.commands, check.HasLen, 1)
+	c.Assert(strings.HasPrefix(s.commands[0], "qemu-system-x86_64 -machine pc -enable-kvm -cpu host "), check.Equals, true)
+}
+
+func (s *qemuSuite) TestVerifyDoesNotUseKVMForARM(c *check.C) {
+	s.kvm = true
+	s.options.Arch = "arm64"
+
+	s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(s.commands, check.HasLen, 1)
+	c.Assert(strings.HasPrefix(s.commands[0], "qemu-system-aarch64 -machine virt -cpu cortex-a57 "), check.Equals, true)
+}
+
+func (s *qemuSuite) TestVerifyBootsFirmwareOfARM(c *check.C) {
+	testCases := []struct {
+		arch, prefix string
+	}{
+		{"armhf", "qemu-system-arm -machine virt -cpu cortex-a15 -bios /usr/share/AAVMF/AAVMF32_CODE.fd -m 1024 "},
+		{"arm64", "qemu-system-aarch64 -machine virt -cpu cortex-a57 -bios /usr/share/AAVMF/AAVMF_CODE.fd -m 1024 "},
+	}
+	for _, item := range testCases {
+		s.commands = nil
+		s.options.Arch = item.arch
+
+		err := s.subject.Verify(s.options, "myimage.img")
+
+		c.Check(err, check.IsNil)
+		c.Assert(s.commands, check.HasLen, 1)
+		c.Check(strings.HasPrefix(s.commands[0], item.prefix), check.Equals, true, check.Commentf(s.commands[0]))
+	}
+}
+
+func (s *qemuSuite) TestVerifyReturnsErrorIfFirmwareIsMissing(c *check.C) {
+	s.firmware = false
+	s.options.Arch = "arm64"
+
+	err := s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(err, check.FitsTypeOf, &ErrSmokeTest{})
+	c.Assert(err.Error(), check.Equals,
+		"error smoke testing image myimage.img: firmware /usr/share/AAVMF/AAVMF_CODE.fd of arch arm64 not found")
+	c.Assert(s.commands, check.HasLen, 0)
+}
+
+func (s *qemuSuite) TestVerifyUsesQEMUSystemOfArch(c *check.C) {
+	s.options.Arch = "i386"
+
+	s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(s.commands, check.HasLen, 1)
+	c.Assert(strings.HasPrefix(s.commands[0], "qemu-system-i386 "), check.Equals, true)
+}
+
+func (s *qemuSuite) TestVerifyReturnsErrorOnTimeout(c *check.C) {
+	s.cli.status = timeoutStatus
+	s.options.SmokeTestTimeout = 500 * time.Millisecond
+
+	err := s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(err, check.FitsTypeOf, &ErrSmokeTest{})
+	c.Assert(err.Error(), check.Equals, "error smoke testing image myimage.img: image not booted after 500ms")
+}
+
+func (s *qemuSuite) TestVerifyReturnsErrorIfQEMUExits(c *check.C) {
+	s.cli.status = "exited"
+
+	err := s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(err, check.FitsTypeOf, &ErrSmokeTest{})
+	c.Assert(err.Error(), check.Equals, "error smoke testing image myimage.img: QEMU exited before the image booted")
+}
+
+func (s *qemuSuite) TestVerifyReturnsCliError(c *check.C) {
+	s.cli.err = true
+
+	err := s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(err, check.ErrorMatches, "exec error")
+}
+
+func (s *qemuSuite) TestVerifyReturnsErrorForUnknownArch(c *check.C) {
+	s.options.Arch = "sparc"
+
+	err := s.subject.Verify(s.options, "myimage.img")
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnknownArch{})
+	c.Assert(s.commands, check.HasLen, 0)
+}
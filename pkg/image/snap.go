@@ -0,0 +1,176 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/snap"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const (
+	// LocalRevision is the revision recorded for the snaps given as local files
+	LocalRevision = "local"
+
+	snapFileSuffix  = ".snap"
+	revisionSep     = "@"
+	squashfsMagic   = "hsqs"
+	planRevisionFmt = "<%s snap revision %d>"
+)
+
+// storeRevisionURL is the store endpoint with the details of a revision of a snap
+var storeRevisionURL = "https://search.apps.ubuntu.com/api/v1/snaps/details/%s?revision=%d"
+
+// storeRevision holds the details of a snap revision given by the store
+type storeRevision struct {
+	Revision        int    `json:"revision"`
+	AnonDownloadURL string `json:"anon_download_url"`
+	DownloadURL     string `json:"download_url"`
+	Sha3_384        string `json:"download_sha3_384"`
+	Size            int64  `json:"binary_filesize"`
+}
+
+// SnapRef is an os, kernel or gadget snap as given in the options: a store
+// name, a name@revision pin or the path of a local .snap file
+type SnapRef struct {
+	Name     string
+	Revision int
+	Path     string
+}
+
+// ErrSnapRef is the type of the error returned when a snap reference can't be parsed
+type ErrSnapRef struct {
+	value string
+}
+
+func (e *ErrSnapRef) Error() string {
+	return fmt.Sprintf("error invalid snap %s, expected a name, name@revision or a .snap file", e.value)
+}
+
+// ErrSnapFile is the type of the error returned when a local snap file is not valid
+type ErrSnapFile struct {
+	path, reason string
+}
+
+func (e *ErrSnapFile) Error() string {
+	return fmt.Sprintf("error invalid snap file %s: %s", e.path, e.reason)
+}
+
+// ErrSnapRevision is the type of the error returned when a pinned revision
+// can't be retrieved from the store
+type ErrSnapRevision struct {
+	name     string
+	revision int
+}
+
+func (e *ErrSnapRevision) Error() string {
+	return fmt.Sprintf("error revision %d of snap %s can't be downloaded from the store", e.revision, e.name)
+}
+
+// ParseSnapRef returns the reference described by value
+func ParseSnapRef(value string) (*SnapRef, error) {
+	if strings.HasSuffix(value, snapFileSuffix) {
+		// local files are usually named <name>_<version>_<arch>.snap
+		name := strings.SplitN(strings.TrimSuffix(filepath.Base(value), snapFileSuffix), "_", 2)[0]
+		return &SnapRef{Name: name, Path: value}, nil
+	}
+	parts := strings.SplitN(value, revisionSep, 2)
+	if parts[0] == "" {
+		return nil, &ErrSnapRef{value: value}
+	}
+	ref := &SnapRef{Name: parts[0]}
+	if len(parts) == 2 {
+		revision, err := strconv.Atoi(parts[1])
+		if err != nil || revision < 1 {
+			return nil, &ErrSnapRef{value: value}
+		}
+		ref.Revision = revision
+	}
+	return ref, nil
+}
+
+// checkSnapRefs validates the snaps given in options, local files must be
+// readable squashfs images
+func checkSnapRefs(options *flags.Options) error {
+	for _, role := range SnapRoles {
+		value, _ := snapSpec(options, role)
+		ref, err := ParseSnapRef(value)
+		if err != nil {
+			return err
+		}
+		if ref.Path != "" {
+			if err = checkSnapFile(ref.Path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkSnapFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return &ErrSnapFile{path: path, reason: err.Error()}
+	}
+	defer file.Close()
+	magic := make([]byte, len(squashfsMagic))
+	if _, err = io.ReadFull(file, magic); err != nil || !bytes.Equal(magic, []byte(squashfsMagic)) {
+		return &ErrSnapFile{path: path, reason: "not a squashfs file"}
+	}
+	return nil
+}
+
+// resolveSnap returns the store details of the referenced snap, pinned revisions
+// other than the current one in the channel are asked to the store details
+// endpoint with httpClient
+func resolveSnap(sc storeClient, httpClient web.Getter, ref *SnapRef, channel string) (*snap.Info, error) {
+	remoteSnap, err := sc.Snap(ref.Name, channel, nil)
+	if err != nil {
+		return nil, &ErrRepoDetail{ref.Name, "", channel}
+	}
+	if ref.Revision == 0 || remoteSnap.Revision == ref.Revision {
+		return remoteSnap, nil
+	}
+	content, err := httpClient.Get(fmt.Sprintf(storeRevisionURL, ref.Name, ref.Revision))
+	if err != nil {
+		return nil, &ErrSnapRevision{name: ref.Name, revision: ref.Revision}
+	}
+	var details storeRevision
+	if err = json.Unmarshal(content, &details); err != nil || details.Revision != ref.Revision || details.AnonDownloadURL == "" {
+		return nil, &ErrSnapRevision{name: ref.Name, revision: ref.Revision}
+	}
+	pinned := *remoteSnap
+	pinned.Revision = details.Revision
+	pinned.AnonDownloadURL = details.AnonDownloadURL
+	pinned.DownloadURL = details.DownloadURL
+	pinned.Sha3_384 = details.Sha3_384
+	pinned.Size = details.Size
+	return &pinned, nil
+}
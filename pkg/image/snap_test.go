@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+var _ = check.Suite(&snapSuite{})
+
+type snapSuite struct {
+	storeClient *fakeStoreClient
+	webGetter   *fakeWebGetter
+}
+
+func (s *snapSuite) SetUpTest(c *check.C) {
+	s.storeClient = &fakeStoreClient{
+		snapCalls:     make(map[string]int),
+		downloadCalls: make(map[string]int),
+		revisions:     map[string]int{"core": 10},
+	}
+	s.webGetter = &fakeWebGetter{calls: make(map[string]int), outputs: make(map[string]string)}
+}
+
+func (s *snapSuite) TestParseSnapRef(c *check.C) {
+	testCases := []struct {
+		value    string
+		expected SnapRef
+	}{
+		{"core", SnapRef{Name: "core"}},
+		{"core@123", SnapRef{Name: "core", Revision: 123}},
+		{"/tmp/core_16-2_amd64.snap", SnapRef{Name: "core", Path: "/tmp/core_16-2_amd64.snap"}},
+		{"mycore.snap", SnapRef{Name: "mycore", Path: "mycore.snap"}},
+	}
+	for _, item := range testCases {
+		ref, err := ParseSnapRef(item.value)
+
+		c.Check(err, check.IsNil)
+		c.Check(*ref, check.DeepEquals, item.expected)
+	}
+}
+
+func (s *snapSuite) TestParseSnapRefReturnsErrSnapRef(c *check.C) {
+	for _, value := range []string{"", "@12", "core@", "core@edge", "core@0", "core@-1"} {
+		_, err := ParseSnapRef(value)
+
+		c.Check(err, check.FitsTypeOf, &ErrSnapRef{})
+	}
+}
+
+func (s *snapSuite) TestCheckSnapRefsValidatesLocalFiles(c *check.C) {
+	path := writeSnapFile(c, squashfsMagic+"content")
+	defer os.Remove(path)
+	options := &flags.Options{OS: path, Kernel: "mykernel@3", Gadget: "mygadget"}
+
+	c.Assert(checkSnapRefs(options), check.IsNil)
+
+	options.Gadget = "/non/existing/gadget.snap"
+	c.Assert(checkSnapRefs(options), check.FitsTypeOf, &ErrSnapFile{})
+}
+
+func (s *snapSuite) TestResolveSnapReturnsChannelRevision(c *check.C) {
+	info, err := resolveSnap(s.storeClient, s.webGetter, &SnapRef{Name: "core"}, "edge")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Revision, check.Equals, 10)
+	c.Assert(info.Sha3_384, check.Equals, getSnapHash("core", "edge"))
+	c.Assert(s.storeClient.snapCalls[getSnapCall("core", "edge")], check.Equals, 1)
+}
+
+func (s *snapSuite) TestResolveSnapKeepsHashOfPinnedChannelRevision(c *check.C) {
+	info, err := resolveSnap(s.storeClient, s.webGetter, &SnapRef{Name: "core", Revision: 10}, "edge")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Sha3_384, check.Equals, getSnapHash("core", "edge"))
+	c.Assert(info.AnonDownloadURL, check.Equals, getDownloadURL("core", 10))
+}
+
+func (s *snapSuite) TestResolveSnapAsksStoreForPinnedRevision(c *check.C) {
+	setRevisionDetails(s.webGetter, "core", 7, "pinnedhash")
+
+	info, err := resolveSnap(s.storeClient, s.webGetter, &SnapRef{Name: "core", Revision: 7}, "edge")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.webGetter.calls["https://search.apps.ubuntu.com/api/v1/snaps/details/core?revision=7"], check.Equals, 1)
+	c.Assert(info.Name(), check.Equals, "core")
+	c.Assert(info.Revision, check.Equals, 7)
+	c.Assert(info.Sha3_384, check.Equals, "pinnedhash")
+	c.Assert(info.Size, check.Equals, int64(1024))
+	c.Assert(info.AnonDownloadURL, check.Equals, getDownloadURL("core", 7))
+}
+
+func (s *snapSuite) TestResolveSnapReturnsErrSnapRevisionForUnknownRevisions(c *check.C) {
+	// the store answers with an error document for revisions it doesn't have
+	s.webGetter.output = `{"result": "error", "errors": ["No such package"]}`
+
+	_, err := resolveSnap(s.storeClient, s.webGetter, &SnapRef{Name: "core", Revision: 7}, "edge")
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapRevision{})
+}
+
+func (s *snapSuite) TestResolveSnapReturnsErrSnapRevisionForOtherRevisions(c *check.C) {
+	setRevisionDetails(s.webGetter, "core", 7, "pinnedhash")
+	s.webGetter.outputs[fmt.Sprintf(storeRevisionURL, "core", 8)] = s.webGetter.outputs[fmt.Sprintf(storeRevisionURL, "core", 7)]
+
+	_, err := resolveSnap(s.storeClient, s.webGetter, &SnapRef{Name: "core", Revision: 8}, "edge")
+
+	c.Assert(err, check.FitsTypeOf, &ErrSnapRevision{})
+}
+
+func (s *snapSuite) TestResolveSnapReturnsErrRepoDetail(c *check.C) {
+	s.storeClient.snapErr = true
+
+	_, err := resolveSnap(s.storeClient, s.webGetter, &SnapRef{Name: "core", Revision: 7}, "edge")
+
+	c.Assert(err, check.FitsTypeOf, &ErrRepoDetail{})
+}
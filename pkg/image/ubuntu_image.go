@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+// ErrNoModel is the type of the error returned by UbuntuImage when no model
+// assertion is given
+type ErrNoModel struct{}
+
+func (e *ErrNoModel) Error() string {
+	return "error no model assertion given for the ubuntu-image driver, use -model"
+}
+
+// ErrDriverRelease is the type of the error returned by UbuntuImage when the
+// requested release can't be built with ubuntu-image
+type ErrDriverRelease struct {
+	release string
+}
+
+func (e *ErrDriverRelease) Error() string {
+	return fmt.Sprintf("error release %s can't be built with ubuntu-image, use the udf driver", e.release)
+}
+
+// UbuntuImage is a concrete implementation of Driver that builds all-snaps
+// images from a model assertion using ubuntu-image
+type UbuntuImage struct {
+	qemuImg
+	snapDownloader
+}
+
+// NewUbuntuImage is the UbuntuImage constructor
+func NewUbuntuImage(cli cli.Commander, sc storeClient, httpClient web.Getter) *UbuntuImage {
+	return &UbuntuImage{qemuImg: qemuImg{cli: cli}, snapDownloader: snapDownloader{sc: sc, httpClient: httpClient}}
+}
+
+// Create makes the required call to ubuntu-image to create the raw image, and then
+// transforms it to the format given in options. The os, kernel and gadget snaps
+// are always side-loaded, from local files or from the downloaded revisions. The
+// returned manifest describes the inputs of the image and the created file
+func (u *UbuntuImage) Create(options *flags.Options, ver int, snaps map[string]SnapDetails) (path, tmpDir string, manifest *Manifest, err error) {
+	if err = checkUbuntuImageOptions(options); err != nil {
+		return
+	}
+	if _, err = ArchFor(options); err != nil {
+		return
+	}
+	if err = checkSnapRefs(options); err != nil {
+		return
+	}
+	format, err := FormatFor(options)
+	if err != nil {
+		return
+	}
+	if tmpDir, err = u.cli.ExecCommand("mktemp", "-d"); err != nil {
+		return "", "", nil, err
+	}
+	tmpDir = strings.TrimSpace(tmpDir)
+	rawTmpFileName := filepath.Join(tmpDir, rawOutputFileName)
+	log.Debug("Target image filename: ", rawTmpFileName)
+
+	getFile, err := u.fileGetter(options)
+	if err != nil {
+		return
+	}
+	files, err := sideloadSnaps(options, snaps, getFile)
+	if err != nil {
+		return
+	}
+	defer files.remove()
+
+	cmds := ubuntuImageCmd(options, files, rawTmpFileName)
+	log.Debug("Executing command ", strings.Join(cmds, " "))
+	output, err := u.cli.ExecCommand(cmds...)
+	log.Debug(output)
+	if err != nil {
+		return
+	}
+
+	manifest = &Manifest{Snaps: manifestSnaps(snaps, files)}
+	manifest.addTool(u.cli, cmds)
+	path, err = u.toFormat(options, format, tmpDir, rawTmpFileName, manifest)
+	return
+}
+
+// Plan returns the command lines that Create would execute for the given options
+// without executing them, the temporary directory and the snaps that would be
+// downloaded are represented by placeholders
+func (u *UbuntuImage) Plan(options *flags.Options, ver int) [][]string {
+	files, err := sideloadSnaps(options, nil, planSnapFile)
+	if err != nil {
+		files = &snapFiles{}
+	}
+	rawTmpFileName := filepath.Join(planTmpDir, rawOutputFileName)
+	return planToFormat(options, [][]string{ubuntuImageCmd(options, files, rawTmpFileName)}, rawTmpFileName)
+}
+
+func checkUbuntuImageOptions(options *flags.Options) error {
+	if options.Release == "15.04" {
+		return &ErrDriverRelease{release: options.Release}
+	}
+	if options.Model == "" {
+		return &ErrNoModel{}
+	}
+	return nil
+}
+
+func ubuntuImageCmd(options *flags.Options, files *snapFiles, output string) []string {
+	cmds := []string{"ubuntu-image", "-c", files.channel}
+	for _, role := range SnapRoles {
+		if path, ok := files.paths[role]; ok {
+			cmds = append(cmds, "--extra-snaps", path)
+		}
+	}
+	return append(cmds, "-o", output, options.Model)
+}
@@ -0,0 +1,212 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+const testModel = "/tmp/pc.model"
+
+var _ = check.Suite(&ubuntuImageSuite{})
+
+type ubuntuImageSuite struct {
+	subject          Driver
+	cli              *fakeCliCommander
+	storeClient      *fakeStoreClient
+	defaultOptions   *flags.Options
+	backDir          string
+	backOutputDigest func(string) (string, int64, error)
+	storeKeyring     string
+}
+
+func (s *ubuntuImageSuite) SetUpSuite(c *check.C) {
+	s.cli = &fakeCliCommander{}
+	s.storeClient = &fakeStoreClient{webGetter: &fakeWebGetter{}}
+	var keyring openpgp.EntityList
+	s.storeKeyring, keyring = writeKeyring(c, false)
+	s.storeClient.key = keyring[0]
+	s.subject = NewUbuntuImage(s.cli, s.storeClient, s.storeClient.webGetter)
+	s.backOutputDigest = outputDigest
+	outputDigest = fakeOutputDigest
+}
+
+func (s *ubuntuImageSuite) TearDownSuite(c *check.C) {
+	outputDigest = s.backOutputDigest
+	os.Remove(s.storeKeyring)
+}
+
+func (s *ubuntuImageSuite) SetUpTest(c *check.C) {
+	s.defaultOptions = &flags.Options{
+		Release:       testDefaultRelease,
+		Arch:          testDefaultArch,
+		Qcow2compat:   testDefaultQcow2compat,
+		OS:            testDefaultOS,
+		Kernel:        testDefaultKernel,
+		Gadget:        testDefaultGadget,
+		OSChannel:     testDefaultOSChannel,
+		KernelChannel: testDefaultKernelChannel,
+		GadgetChannel: testDefaultGadgetChannel,
+		Model:         testModel,
+		StoreKeyring:  s.storeKeyring,
+	}
+
+	s.cli.execCommandCalls = make(map[string]int)
+	s.cli.err = false
+	s.cli.correctCalls = 0
+	s.cli.totalCalls = 0
+	s.cli.output = tmpDirName
+	s.storeClient.snapCalls = make(map[string]int)
+	s.storeClient.downloadCalls = make(map[string]int)
+	s.storeClient.snapErr = false
+	s.storeClient.correctSnapCalls = 0
+	s.storeClient.totalSnapCalls = 0
+	s.storeClient.downloadErr = false
+	s.storeClient.correctDownloadCalls = 0
+	s.storeClient.totalDownloadCalls = 0
+	s.storeClient.revisions = map[string]int{testDefaultOS: 1, testDefaultKernel: 2, testDefaultGadget: 3}
+	s.storeClient.webGetter.calls = make(map[string]int)
+	s.storeClient.webGetter.outputs = make(map[string]string)
+	s.backDir = inTmpDir(c)
+}
+
+func (s *ubuntuImageSuite) TearDownTest(c *check.C) {
+	os.Chdir(s.backDir)
+}
+
+func (s *ubuntuImageSuite) TestCreateCallsUbuntuImage(c *check.C) {
+	expectedCall := fmt.Sprintf("ubuntu-image -c %s --extra-snaps %s --extra-snaps %s --extra-snaps %s -o %s %s",
+		testDefaultOSChannel,
+		getSnapFilename(testDefaultOS, testDefaultOSChannel),
+		getSnapFilename(testDefaultKernel, testDefaultKernelChannel),
+		getSnapFilename(testDefaultGadget, testDefaultGadgetChannel),
+		tmpRawFileName(), testModel)
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *ubuntuImageSuite) TestCreateSideloadsSnapsFromCommonChannel(c *check.C) {
+	s.defaultOptions.KernelChannel = testDefaultOSChannel
+	s.defaultOptions.GadgetChannel = testDefaultOSChannel
+	expectedCall := fmt.Sprintf("ubuntu-image -c %s --extra-snaps %s --extra-snaps %s --extra-snaps %s -o %s %s", testDefaultOSChannel,
+		getSnapFilename(testDefaultOS, testDefaultOSChannel), getSnapFilename(testDefaultKernel, testDefaultOSChannel),
+		getSnapFilename(testDefaultGadget, testDefaultOSChannel), tmpRawFileName(), testModel)
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 3)
+}
+
+func (s *ubuntuImageSuite) TestCreateDownloadsSideloadedSnaps(c *check.C) {
+	s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 3)
+	c.Assert(s.storeClient.downloadCalls[getDownloadCall(testDefaultOS, testDefaultOSChannel)], check.Equals, 1)
+	c.Assert(s.storeClient.downloadCalls[getDownloadCall(testDefaultKernel, testDefaultKernelChannel)], check.Equals, 1)
+	c.Assert(s.storeClient.downloadCalls[getDownloadCall(testDefaultGadget, testDefaultGadgetChannel)], check.Equals, 1)
+}
+
+func (s *ubuntuImageSuite) TestCreateReturnsManifest(c *check.C) {
+	_, _, manifest, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(manifest.Snaps, check.HasLen, 3)
+	c.Assert(manifest.Snaps[1], check.DeepEquals, ManifestSnap{Role: "kernel", Name: testDefaultKernel,
+		Channel: testDefaultKernelChannel, Revision: "2", Sha3_384: getSnapHash(testDefaultKernel, testDefaultKernelChannel)})
+	c.Assert(manifest.Tools, check.HasLen, 2)
+	c.Assert(manifest.Tools[0].Name, check.Equals, "ubuntu-image")
+	c.Assert(manifest.Tools[1].Name, check.Equals, qemuImgPath)
+	c.Assert(s.cli.execCommandCalls["ubuntu-image --version"], check.Equals, 1)
+	c.Assert(manifest.Output.Sha256, check.Equals, testOutputSha256)
+}
+
+func (s *ubuntuImageSuite) TestCreateReturnsStoreDownloadError(c *check.C) {
+	s.storeClient.downloadErr = true
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrRepoDownload{})
+	c.Assert(s.cli.totalCalls, check.Equals, 1)
+}
+
+func (s *ubuntuImageSuite) TestCreateTransformsToRequestedFormat(c *check.C) {
+	path, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Equals, tmpFileName())
+	c.Assert(s.cli.execCommandCalls[getExpectedCall(testDefaultQcow2compat, tmpRawFileName(), tmpFileName())], check.Equals, 1)
+}
+
+func (s *ubuntuImageSuite) TestCreateDoesNotTransformOnUbuntuImageError(c *check.C) {
+	s.cli.err = true
+	s.cli.correctCalls = 1
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.cli.totalCalls, check.Equals, 2)
+}
+
+func (s *ubuntuImageSuite) TestCreateReturnsErrNoModel(c *check.C) {
+	s.defaultOptions.Model = ""
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoModel{})
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+}
+
+func (s *ubuntuImageSuite) TestCreateReturnsErrDriverReleaseFor1504(c *check.C) {
+	s.defaultOptions.Release = "15.04"
+
+	_, _, _, err := s.subject.Create(s.defaultOptions, testDefaultVer, s.storeClient.snapDetails(s.defaultOptions))
+
+	c.Assert(err, check.FitsTypeOf, &ErrDriverRelease{})
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+}
+
+func (s *ubuntuImageSuite) TestPlanReturnsCommands(c *check.C) {
+	rawFilename := filepath.Join(planTmpDir, rawOutputFileName)
+	expectedCall := fmt.Sprintf("ubuntu-image -c %s --extra-snaps <%s snap from %s> --extra-snaps <%s snap from %s> --extra-snaps <%s snap from %s> -o %s %s",
+		testDefaultOSChannel, testDefaultOS, testDefaultOSChannel, testDefaultKernel, testDefaultKernelChannel, testDefaultGadget, testDefaultGadgetChannel,
+		rawFilename, testModel)
+
+	cmds := s.subject.Plan(s.defaultOptions, testDefaultVer)
+
+	c.Assert(cmds, check.HasLen, 2)
+	c.Assert(strings.Join(cmds[0], " "), check.Equals, expectedCall)
+	c.Assert(strings.Join(cmds[1], " "), check.Equals,
+		getExpectedCall(testDefaultQcow2compat, rawFilename, filepath.Join(planTmpDir, "udf.img")))
+	c.Assert(s.cli.totalCalls, check.Equals, 0)
+	c.Assert(s.storeClient.totalDownloadCalls, check.Equals, 0)
+}
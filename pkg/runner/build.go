@@ -0,0 +1,159 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+const (
+	manifestSuffix  = ".manifest.json"
+	signatureSuffix = ".asc"
+)
+
+var rename = os.Rename
+
+// build creates the image and writes it to options.Output along with its
+// manifest, nothing is checked or uploaded to the cloud
+func (r *Runner) build(options *flags.Options) (err error) {
+	format, err := image.FormatFor(options)
+	if err != nil {
+		return
+	}
+	if _, err = image.ArchFor(options); err != nil {
+		return
+	}
+	var siVersion int
+	var snaps map[string]image.SnapDetails
+	if options.Release == "15.04" {
+		if siVersion, err = r.imgDataOrigin.GetLatestVersion(options); err != nil {
+			return
+		}
+	} else {
+		if snaps, err = r.snapDataOrigin.GetSnaps(options); err != nil {
+			return
+		}
+	}
+	imageOptions := *options
+	imageOptions.Properties = joinProperties(options.Properties, provenanceProperties(snaps, siVersion))
+	options = &imageOptions
+
+	name := filepath.Base(cloud.GetImageID(options, siVersion))
+	name = strings.TrimSuffix(name, filepath.Ext(name)) + "." + format.Extension
+	imagePath := filepath.Join(options.Output, name)
+	manifestPath := imagePath + manifestSuffix
+
+	if options.DryRun {
+		for _, cmd := range r.imgDriver.Plan(options, siVersion) {
+			log.Infof("Would execute %s", strings.Join(cmd, " "))
+		}
+		log.Infof("Would write image file %s and manifest %s", imagePath, manifestPath)
+		if options.ManifestKey != "" {
+			log.Infof("Would sign the manifest with the key in %s", options.ManifestKey)
+		}
+		return
+	}
+	if err = os.MkdirAll(options.Output, 0755); err != nil {
+		return
+	}
+	path, tmpDir, built, err := r.createImage(options, siVersion, snaps)
+	defer removeTmpDir(tmpDir)
+	if err != nil {
+		return
+	}
+	if err = moveFile(path, imagePath); err != nil {
+		return
+	}
+	if err = writeManifest(manifestPath, completeManifest(built, name, options, siVersion), options.ManifestKey); err != nil {
+		return
+	}
+	log.Infof("Image file written to %s, manifest to %s", imagePath, manifestPath)
+	return
+}
+
+// completeManifest returns a copy of the manifest of the driver completed with
+// the name, options and properties of the image
+func completeManifest(built *image.Manifest, name string, options *flags.Options, siVersion int) *image.Manifest {
+	manifest := *built
+	manifest.Image = name
+	manifest.Release = options.Release
+	manifest.Arch = options.Arch
+	manifest.ImageType = options.ImageType
+	manifest.Qcow2compat = options.Qcow2compat
+	manifest.ToolVersion = Version
+	manifest.SIVersion = siVersion
+	manifest.Properties = options.Properties
+	return &manifest
+}
+
+// writeManifest stores the given manifest as JSON in path, if keyPath is given
+// its armored signature is stored next to it
+func writeManifest(path string, manifest *image.Manifest, keyPath string) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	if err = ioutil.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	if keyPath == "" {
+		return nil
+	}
+	signature, err := image.SignManifest(content, keyPath)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+signatureSuffix, signature, 0644)
+}
+
+// moveFile renames src to dst, copying it when they are in different filesystems
+func moveFile(src, dst string) (err error) {
+	if err = rename(src, dst); err == nil {
+		return
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,278 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/openpgp"
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+var _ = check.Suite(&runnerBuildSuite{})
+
+type runnerBuildSuite struct {
+	subject     *Runner
+	options     *flags.Options
+	siClient    *fakeSiClient
+	cloudClient *fakeCloudClient
+	udfDriver   *fakeImgDriver
+	storeClient *fakeStoreClient
+	outputDir   string
+}
+
+func (s *runnerBuildSuite) SetUpSuite(c *check.C) {
+	s.siClient = &fakeSiClient{}
+	s.cloudClient = &fakeCloudClient{}
+	s.udfDriver = &fakeImgDriver{}
+	s.storeClient = &fakeStoreClient{}
+	s.subject = NewRunner(s.siClient, s.cloudClient, s.udfDriver, s.storeClient, &fakeVerifier{})
+}
+
+func (s *runnerBuildSuite) SetUpTest(c *check.C) {
+	s.siClient.getVersionCalls = make(map[string]int)
+	s.siClient.version = 2
+	s.siClient.doVerifyErr = false
+	s.cloudClient.getLatestVersionCalls = make(map[string]int)
+	s.cloudClient.getVersionsCalls = make(map[string]int)
+	s.cloudClient.createCalls = make(map[string]int)
+	s.storeClient.getSnapsCalls = make(map[string]int)
+	s.storeClient.doErr = false
+	s.storeClient.snaps = map[string]image.SnapDetails{
+		"os":     {Name: "myos", Channel: "edge", Revision: "10", Sha3_384: "oshash"},
+		"kernel": {Name: "mykernel", Channel: "edge", Revision: "20", Sha3_384: "kernelhash"},
+		"gadget": {Name: "mygadget", Channel: "beta", Revision: "30", Sha3_384: "gadgethash"},
+	}
+	s.udfDriver.createCalls = make(map[string]int)
+	s.udfDriver.planCalls = make(map[string]int)
+	s.udfDriver.doErr = false
+
+	var err error
+	s.outputDir, err = ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	s.udfDriver.tmpDir = writeTmpDir(c)
+	s.udfDriver.path = filepath.Join(s.udfDriver.tmpDir, "udf.img")
+
+	s.options = &flags.Options{
+		Action:        "build",
+		Release:       "rolling",
+		OSChannel:     "edge",
+		KernelChannel: "edge",
+		GadgetChannel: "edge",
+		Arch:          "amd64",
+		ImageType:     "custom",
+		Qcow2compat:   "1.1",
+		Output:        filepath.Join(s.outputDir, "images")}
+}
+
+func (s *runnerBuildSuite) TearDownTest(c *check.C) {
+	os.RemoveAll(s.outputDir)
+	os.RemoveAll(s.udfDriver.tmpDir)
+	s.udfDriver.tmpDir = ""
+}
+
+func (s *runnerBuildSuite) TestBuildWritesImageFileToOutputDir(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.createCalls[getCreateKey(s.options, 0)], check.Equals, 1)
+	images, _ := filepath.Glob(filepath.Join(s.options.Output, "ubuntu-rolling-snappy-core-amd64-edge-*-disk1.img"))
+	c.Assert(images, check.HasLen, 1)
+	content, err := ioutil.ReadFile(images[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "image content")
+	_, err = os.Stat(s.udfDriver.path)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerBuildSuite) TestBuildRemovesTmpDirOfDriver(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(s.udfDriver.tmpDir)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerBuildSuite) TestBuildRemovesTmpDirOfDriverOnError(c *check.C) {
+	s.udfDriver.doErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	_, err = os.Stat(s.udfDriver.tmpDir)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerBuildSuite) TestBuildWritesManifest(c *check.C) {
+	s.options.Properties = "property1=value1"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	manifest := s.readManifest(c)
+	c.Assert(manifest.Release, check.Equals, "rolling")
+	c.Assert(manifest.Arch, check.Equals, "amd64")
+	c.Assert(manifest.ImageType, check.Equals, "custom")
+	c.Assert(manifest.Qcow2compat, check.Equals, "1.1")
+	c.Assert(manifest.ToolVersion, check.Equals, Version)
+	c.Assert(manifest.SIVersion, check.Equals, 0)
+	c.Assert(manifest.Snaps, check.DeepEquals, testManifest.Snaps)
+	c.Assert(manifest.Tools, check.DeepEquals, testManifest.Tools)
+	c.Assert(manifest.Output, check.DeepEquals, testManifest.Output)
+	c.Assert(manifest.Properties, check.Equals, "property1=value1,tool_version="+Version+","+testSnapProperties)
+	c.Assert(testManifest.Image, check.Equals, "")
+	paths, _ := filepath.Glob(filepath.Join(s.options.Output, "*"+manifestSuffix+signatureSuffix))
+	c.Assert(paths, check.HasLen, 0)
+}
+
+func (s *runnerBuildSuite) TestBuildCreatesImageFromPolledSnaps(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.snaps, check.DeepEquals, s.storeClient.snaps)
+}
+
+func (s *runnerBuildSuite) TestBuildSignsManifestWithGivenKey(c *check.C) {
+	keyPath, keyring := writeSecretKeyring(c, true)
+	defer os.Remove(keyPath)
+	s.options.ManifestKey = keyPath
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	paths, _ := filepath.Glob(filepath.Join(s.options.Output, "*"+manifestSuffix))
+	c.Assert(paths, check.HasLen, 1)
+	content, err := os.Open(paths[0])
+	c.Assert(err, check.IsNil)
+	defer content.Close()
+	signature, err := os.Open(paths[0] + signatureSuffix)
+	c.Assert(err, check.IsNil)
+	defer signature.Close()
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, content, signature)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *runnerBuildSuite) TestBuildUsesImageFormatExtension(c *check.C) {
+	s.options.ImageFormat = "vmdk"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	images, _ := filepath.Glob(filepath.Join(s.options.Output, "ubuntu-rolling-snappy-core-amd64-edge-*-disk1.vmdk"))
+	c.Assert(images, check.HasLen, 1)
+	c.Assert(s.readManifest(c).Image, check.Equals, filepath.Base(images[0]))
+}
+
+func (s *runnerBuildSuite) TestBuildUsesSIVersionFor1504(c *check.C) {
+	s.options.Release = "15.04"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.siClient.getVersionCalls[getFakeKey(s.options)], check.Equals, 1)
+	c.Assert(len(s.storeClient.getSnapsCalls), check.Equals, 0)
+	c.Assert(s.udfDriver.createCalls[getCreateKey(s.options, 2)], check.Equals, 1)
+	_, err = os.Stat(filepath.Join(s.options.Output, "ubuntu-1504-snappy-core-amd64-edge-2-disk1.img"))
+	c.Assert(err, check.IsNil)
+	manifest := s.readManifest(c)
+	c.Assert(manifest.SIVersion, check.Equals, 2)
+	c.Assert(s.udfDriver.snaps, check.IsNil)
+}
+
+func (s *runnerBuildSuite) TestBuildReturnsSIFilesVerificationErrorFor1504(c *check.C) {
+	s.options.Release = "15.04"
+	s.siClient.doVerifyErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, siVerifyFilesError)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerBuildSuite) TestBuildDoesNotQueryTheCloud(c *check.C) {
+	s.subject.Exec(s.options)
+
+	c.Assert(len(s.cloudClient.getLatestVersionCalls), check.Equals, 0)
+	c.Assert(len(s.cloudClient.getVersionsCalls), check.Equals, 0)
+	c.Assert(len(s.cloudClient.createCalls), check.Equals, 0)
+}
+
+func (s *runnerBuildSuite) TestBuildReturnsGetSnapsError(c *check.C) {
+	s.storeClient.doErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, storeRevisionsError)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerBuildSuite) TestBuildReturnsCreateError(c *check.C) {
+	s.udfDriver.doErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, udfCreateError)
+	files, _ := ioutil.ReadDir(s.options.Output)
+	c.Assert(files, check.HasLen, 0)
+}
+
+func (s *runnerBuildSuite) TestBuildDoesNotCreateOnDryRun(c *check.C) {
+	s.options.DryRun = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+	c.Assert(s.udfDriver.planCalls[getCreateKey(s.options, 0)], check.Equals, 1)
+	_, err = os.Stat(s.options.Output)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerBuildSuite) TestBuildCopiesImageFileWhenItCannotBeRenamed(c *check.C) {
+	backRename := rename
+	defer func() { rename = backRename }()
+	rename = func(src, dst string) error { return fmt.Errorf("invalid cross-device link") }
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	images, _ := filepath.Glob(filepath.Join(s.options.Output, "*-disk1.img"))
+	c.Assert(images, check.HasLen, 1)
+	content, _ := ioutil.ReadFile(images[0])
+	c.Assert(string(content), check.Equals, "image content")
+	_, err = os.Stat(s.udfDriver.path)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerBuildSuite) readManifest(c *check.C) *image.Manifest {
+	paths, _ := filepath.Glob(filepath.Join(s.options.Output, "*"+manifestSuffix))
+	c.Assert(paths, check.HasLen, 1)
+	content, err := ioutil.ReadFile(paths[0])
+	c.Assert(err, check.IsNil)
+	manifest := &image.Manifest{}
+	c.Assert(json.Unmarshal(content, manifest), check.IsNil)
+	return manifest
+}
@@ -0,0 +1,146 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+const (
+	tableFormat = "table"
+	jsonFormat  = "json"
+)
+
+var stdout io.Writer = os.Stdout
+
+// ErrListFormat is the type of the error returned by Exec when the output
+// format of the list action is not recognized
+type ErrListFormat struct {
+	format string
+}
+
+func (e *ErrListFormat) Error() string {
+	return fmt.Sprintf("error unknown list format %s, table or json expected", e.format)
+}
+
+// ImageGroup holds the images of a release, arch and channel
+type ImageGroup struct {
+	ImageType string        `json:"image_type"`
+	Release   string        `json:"release"`
+	Arch      string        `json:"arch"`
+	Channel   string        `json:"channel"`
+	Images    []ListedImage `json:"images"`
+}
+
+// ListedImage holds the details of an image shown by the list action
+type ListedImage struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
+
+// list prints the images managed by the tool grouped by release, arch and
+// channel, newest first
+func (r *Runner) list(options *flags.Options) (err error) {
+	if options.Format != tableFormat && options.Format != jsonFormat {
+		return &ErrListFormat{format: options.Format}
+	}
+	images, err := r.imgDataTarget.List(options)
+	if err != nil {
+		return
+	}
+	groups := groupImages(images)
+	if options.Format == jsonFormat {
+		encoder := json.NewEncoder(stdout)
+		return encoder.Encode(groups)
+	}
+	return printTable(groups)
+}
+
+// groupImages parses the names of the given images and groups them, the
+// images whose name doesn't follow the naming scheme are skipped
+func groupImages(images []image.Record) []ImageGroup {
+	images = append([]image.Record(nil), images...)
+	sort.Sort(sort.Reverse(cloud.ByVersion(images)))
+	index := make(map[string]int)
+	groups := []ImageGroup{}
+	for _, item := range images {
+		name, err := cloud.ParseImageName(item.Name)
+		if err != nil {
+			log.Debugf("Skipping image %s: %s", item.Name, err)
+			continue
+		}
+		key := fmt.Sprintf("%s %s %s %s", name.ImageType, name.Release, name.Arch, name.Channel)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, ImageGroup{
+				ImageType: name.ImageType, Release: name.Release, Arch: name.Arch, Channel: name.Channel})
+		}
+		groups[i].Images = append(groups[i].Images, ListedImage{
+			ID: item.ID, Name: item.Name, Version: name.Version, Status: item.Status, CreatedAt: item.CreatedAt, Size: item.Size})
+	}
+	sort.Sort(byGroup(groups))
+	return groups
+}
+
+func printTable(groups []ImageGroup) error {
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE TYPE\tRELEASE\tARCH\tCHANNEL\tVERSION\tID\tSTATUS\tCREATED")
+	for _, group := range groups {
+		for _, item := range group.Images {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", group.ImageType, group.Release, group.Arch,
+				group.Channel, item.Version, item.ID, item.Status, item.CreatedAt.Format(time.RFC3339))
+		}
+	}
+	return w.Flush()
+}
+
+type byGroup []ImageGroup
+
+func (b byGroup) Len() int      { return len(b) }
+func (b byGroup) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byGroup) Less(i, j int) bool {
+	if b[i].ImageType != b[j].ImageType {
+		return b[i].ImageType < b[j].ImageType
+	}
+	if b[i].Release != b[j].Release {
+		return b[i].Release < b[j].Release
+	}
+	if b[i].Arch != b[j].Arch {
+		return b[i].Arch < b[j].Arch
+	}
+	return b[i].Channel < b[j].Channel
+}
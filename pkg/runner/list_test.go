@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+var _ = check.Suite(&runnerListSuite{})
+
+type runnerListSuite struct {
+	subject     *Runner
+	options     *flags.Options
+	cloudClient *fakeCloudClient
+	output      *bytes.Buffer
+	backStdout  io.Writer
+}
+
+func (s *runnerListSuite) SetUpSuite(c *check.C) {
+	s.cloudClient = &fakeCloudClient{}
+	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{}, &fakeStoreClient{}, &fakeVerifier{})
+	s.output = &bytes.Buffer{}
+	s.backStdout = stdout
+	stdout = s.output
+}
+
+func (s *runnerListSuite) TearDownSuite(c *check.C) {
+	stdout = s.backStdout
+}
+
+func (s *runnerListSuite) SetUpTest(c *check.C) {
+	s.output.Reset()
+	s.cloudClient.listCalls = 0
+	s.cloudClient.doListErr = false
+	created := time.Date(2016, 6, 14, 12, 0, 0, 0, time.UTC)
+	s.cloudClient.list = []image.Record{
+		{ID: "id1", Name: "ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-20160614120000.000000-disk1.img", Status: "active", CreatedAt: created},
+		{ID: "id2", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-300-disk1.img", Status: "active", CreatedAt: created},
+		{ID: "id3", Name: "ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-20160615120000.000000-disk1.img", Status: "active", CreatedAt: created},
+		{ID: "id4", Name: "ubuntu-core/custom/ubuntu-rolling-snappy-core-armhf-my-branch-20160614120000.000000-disk1.img", Status: "active", CreatedAt: created},
+		{ID: "id5", Name: "ubuntu-core/custom/not-managed", Status: "active", CreatedAt: created},
+	}
+	s.options = &flags.Options{Action: "list", ImageType: "custom", Format: "table"}
+}
+
+func (s *runnerListSuite) TestListGroupsAndSortsImages(c *check.C) {
+	groups := groupImages(s.cloudClient.list)
+
+	c.Assert(groups, check.HasLen, 3)
+	c.Assert(groups[0].Release, check.Equals, "1504")
+	c.Assert(groups[1].Release, check.Equals, "rolling")
+	c.Assert(groups[1].Arch, check.Equals, "amd64")
+	c.Assert(groups[1].Channel, check.Equals, "edge")
+	c.Assert(groups[1].Images, check.HasLen, 2)
+	c.Assert(groups[1].Images[0].ID, check.Equals, "id3")
+	c.Assert(groups[1].Images[0].Version, check.Equals, "20160615120000.000000")
+	c.Assert(groups[1].Images[1].ID, check.Equals, "id1")
+	c.Assert(groups[2].Arch, check.Equals, "armhf")
+	c.Assert(groups[2].Channel, check.Equals, "my-branch")
+}
+
+func (s *runnerListSuite) TestListSortsVersionsNumerically(c *check.C) {
+	groups := groupImages([]image.Record{
+		{ID: "id1", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-99-disk1.img"},
+		{ID: "id2", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-100-disk1.img"},
+	})
+
+	c.Assert(groups, check.HasLen, 1)
+	c.Assert(groups[0].Images[0].ID, check.Equals, "id2")
+	c.Assert(groups[0].Images[1].ID, check.Equals, "id1")
+}
+
+func (s *runnerListSuite) TestListSortsSameVersionsByCreationTime(c *check.C) {
+	created := time.Date(2016, 6, 14, 12, 0, 0, 0, time.UTC)
+	groups := groupImages([]image.Record{
+		{ID: "id1", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-100-disk1.img", CreatedAt: created},
+		{ID: "id2", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-100-disk1.img", CreatedAt: created.Add(time.Hour)},
+	})
+
+	c.Assert(groups, check.HasLen, 1)
+	c.Assert(groups[0].Images[0].ID, check.Equals, "id2")
+	c.Assert(groups[0].Images[1].ID, check.Equals, "id1")
+}
+
+func (s *runnerListSuite) TestListPrintsTable(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.listCalls, check.Equals, 1)
+	lines := strings.Split(strings.TrimSpace(s.output.String()), "\n")
+	c.Assert(lines, check.HasLen, 5)
+	c.Assert(strings.Fields(lines[0])[0], check.Equals, "IMAGE")
+	c.Assert(strings.Fields(lines[1]), check.DeepEquals,
+		[]string{"custom", "1504", "amd64", "edge", "300", "id2", "active", "2016-06-14T12:00:00Z"})
+	c.Assert(strings.Fields(lines[2])[5], check.Equals, "id3")
+	c.Assert(strings.Fields(lines[4])[5], check.Equals, "id4")
+}
+
+func (s *runnerListSuite) TestListPrintsJSON(c *check.C) {
+	s.options.Format = "json"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	var groups []ImageGroup
+	c.Assert(json.Unmarshal(s.output.Bytes(), &groups), check.IsNil)
+	c.Assert(groups, check.DeepEquals, groupImages(s.cloudClient.list))
+}
+
+func (s *runnerListSuite) TestListReturnsListError(c *check.C) {
+	s.cloudClient.doListErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, cloudListError)
+	c.Assert(s.output.Len(), check.Equals, 0)
+}
+
+func (s *runnerListSuite) TestListReturnsErrListFormat(c *check.C) {
+	s.options.Format = "yaml"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrListFormat{})
+	c.Assert(s.cloudClient.listCalls, check.Equals, 0)
+}
@@ -0,0 +1,108 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+// PromotedTag is the tag that marks the image of a release, channel and arch
+// everybody should boot
+const PromotedTag = "promoted"
+
+// ErrNoImage is the type of the error returned by Exec when the promote action
+// is requested without an image
+type ErrNoImage struct{}
+
+func (e *ErrNoImage) Error() string {
+	return "error no image given for the promote action, use -image"
+}
+
+// ErrImageNotFound is the type of the error returned by Exec when the image to
+// be promoted doesn't exist
+type ErrImageNotFound struct {
+	image string
+}
+
+func (e *ErrImageNotFound) Error() string {
+	return fmt.Sprintf("error image %s not found", e.image)
+}
+
+// promote tags the image given by name or version as the promoted one of its
+// release, channel and arch. The tag is added to the new image before removing it
+// from the previous ones, so that there is always a promoted image
+func (r *Runner) promote(options *flags.Options) (err error) {
+	if options.Image == "" {
+		return &ErrNoImage{}
+	}
+	images, err := r.imgDataTarget.GetVersions(options)
+	if err != nil {
+		return
+	}
+	target, found := findImage(images, options.Image)
+	if !found {
+		return &ErrImageNotFound{image: options.Image}
+	}
+	var previous []image.Record
+	for _, item := range images {
+		if item.ID != target.ID && hasTag(item, PromotedTag) {
+			previous = append(previous, item)
+		}
+	}
+
+	if options.DryRun {
+		log.Infof("Would promote image %s (%s)", target.ID, target.Name)
+		for _, item := range previous {
+			log.Infof("Would demote image %s (%s)", item.ID, item.Name)
+		}
+		return
+	}
+	if !hasTag(target, PromotedTag) {
+		if err = r.imgDataTarget.AddTag(target.ID, PromotedTag); err != nil {
+			return
+		}
+	}
+	log.Infof("Promoted image %s (%s)", target.ID, target.Name)
+	for _, item := range previous {
+		if err = r.imgDataTarget.RemoveTag(item.ID, PromotedTag); err != nil {
+			return
+		}
+		log.Infof("Demoted image %s (%s)", item.ID, item.Name)
+	}
+	return
+}
+
+// findImage returns the image with the given name or version
+func findImage(images []image.Record, nameOrVersion string) (image.Record, bool) {
+	for _, item := range images {
+		if item.Name == nameOrVersion {
+			return item, true
+		}
+		if name, err := cloud.ParseImageName(item.Name); err == nil && name.Version == nameOrVersion {
+			return item, true
+		}
+	}
+	return image.Record{}, false
+}
@@ -0,0 +1,130 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+var _ = check.Suite(&runnerPromoteSuite{})
+
+type runnerPromoteSuite struct {
+	subject     *Runner
+	options     *flags.Options
+	cloudClient *fakeCloudClient
+}
+
+func (s *runnerPromoteSuite) SetUpSuite(c *check.C) {
+	s.cloudClient = &fakeCloudClient{}
+	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{}, &fakeStoreClient{}, &fakeVerifier{})
+}
+
+func (s *runnerPromoteSuite) SetUpTest(c *check.C) {
+	s.cloudClient.getVersionsCalls = make(map[string]int)
+	s.cloudClient.doVerErr = false
+	s.cloudClient.doTagErr = false
+	s.cloudClient.tagCalls = nil
+	s.cloudClient.versions = []image.Record{
+		{ID: "id3", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-300-disk1.img"},
+		{ID: "id2", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-200-disk1.img", Tags: []string{PromotedTag}},
+		{ID: "id1", Name: "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-100-disk1.img"},
+	}
+	s.options = &flags.Options{
+		Action:        "promote",
+		Release:       "15.04",
+		OSChannel:     "edge",
+		KernelChannel: "edge",
+		GadgetChannel: "edge",
+		Arch:          "amd64",
+		ImageType:     "custom",
+		Image:         "300"}
+}
+
+func (s *runnerPromoteSuite) TestPromoteByVersionMovesTag(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.getVersionsCalls[getFakeKey(s.options)], check.Equals, 1)
+	c.Assert(s.cloudClient.tagCalls, check.DeepEquals, []string{"add promoted id3", "remove promoted id2"})
+}
+
+func (s *runnerPromoteSuite) TestPromoteByName(c *check.C) {
+	s.options.Image = "ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-100-disk1.img"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.tagCalls, check.DeepEquals, []string{"add promoted id1", "remove promoted id2"})
+}
+
+func (s *runnerPromoteSuite) TestPromoteDoesNotRetagPromotedImage(c *check.C) {
+	s.options.Image = "200"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.tagCalls, check.IsNil)
+}
+
+func (s *runnerPromoteSuite) TestPromoteDoesNotDemoteIfTaggingFails(c *check.C) {
+	s.cloudClient.doTagErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, cloudTagError)
+	c.Assert(s.cloudClient.tagCalls, check.DeepEquals, []string{"add promoted id3"})
+}
+
+func (s *runnerPromoteSuite) TestPromoteReturnsErrNoImage(c *check.C) {
+	s.options.Image = ""
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoImage{})
+	c.Assert(len(s.cloudClient.getVersionsCalls), check.Equals, 0)
+}
+
+func (s *runnerPromoteSuite) TestPromoteReturnsErrImageNotFound(c *check.C) {
+	s.options.Image = "400"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrImageNotFound{})
+	c.Assert(s.cloudClient.tagCalls, check.IsNil)
+}
+
+func (s *runnerPromoteSuite) TestPromoteReturnsGetVersionsError(c *check.C) {
+	s.cloudClient.doVerErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, cloudVersionsError)
+}
+
+func (s *runnerPromoteSuite) TestPromoteDoesNotTagOnDryRun(c *check.C) {
+	s.options.DryRun = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.tagCalls, check.IsNil)
+}
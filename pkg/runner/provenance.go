@@ -0,0 +1,114 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2015, 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+// Version is the version of the tool, it is recorded in the images created. The
+// package build sets it to the one of the package with -ldflags -X
+var Version = "devel"
+
+const (
+	toolVersionProperty     = "tool_version"
+	siVersionProperty       = "si_version"
+	snapPropertyPattern     = "%s_%s"
+	revisionPropertyPattern = "%s_revision"
+	namePropertyPattern     = "%s_name"
+	manifestProperty        = "manifest"
+	manifestSigProperty     = "manifest_signature"
+)
+
+// provenanceProperties returns the image properties that record the inputs of
+// the image: the tool version and either the system-image version, for 15.04,
+// or the name, channel, revision and sha3-384 of each snap
+func provenanceProperties(snaps map[string]image.SnapDetails, siVersion int) string {
+	properties := []string{toolVersionProperty + "=" + Version}
+	if snaps == nil {
+		return joinProperties(append(properties, fmt.Sprintf("%s=%d", siVersionProperty, siVersion))...)
+	}
+	for _, role := range image.SnapRoles {
+		snap := snaps[role]
+		for _, field := range []struct{ key, value string }{
+			{"name", snap.Name},
+			{"channel", snap.Channel},
+			{"revision", snap.Revision},
+			{"sha3_384", snap.Sha3_384},
+		} {
+			properties = append(properties, fmt.Sprintf(snapPropertyPattern+"=%s", role, field.key, field.value))
+		}
+	}
+	return joinProperties(properties...)
+}
+
+// manifestProperties returns the image properties holding the build manifest
+// and, if keyPath is given, its armored signature, both base64 encoded
+func manifestProperties(manifest *image.Manifest, keyPath string) (string, error) {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+	properties := []string{manifestProperty + "=" + base64.StdEncoding.EncodeToString(content)}
+	if keyPath != "" {
+		signature, err := image.SignManifest(content, keyPath)
+		if err != nil {
+			return "", err
+		}
+		properties = append(properties, manifestSigProperty+"="+base64.StdEncoding.EncodeToString(signature))
+	}
+	return joinProperties(properties...), nil
+}
+
+// sameRevisions checks if the names and revisions of the given snaps are the ones
+// recorded in the image properties, local snap files are always considered new
+func sameRevisions(snaps map[string]image.SnapDetails, properties map[string]string) bool {
+	for _, role := range image.SnapRoles {
+		if snaps[role].Revision == image.LocalRevision ||
+			properties[fmt.Sprintf(namePropertyPattern, role)] != snaps[role].Name ||
+			properties[fmt.Sprintf(revisionPropertyPattern, role)] != snaps[role].Revision {
+			return false
+		}
+	}
+	return true
+}
+
+// revisionsString returns a human readable list of the revisions of the given snaps
+func revisionsString(snaps map[string]image.SnapDetails) string {
+	revisions := make([]string, len(image.SnapRoles))
+	for i, role := range image.SnapRoles {
+		revisions[i] = fmt.Sprintf("%s=%s", snaps[role].Name, snaps[role].Revision)
+	}
+	return strings.Join(revisions, ",")
+}
+
+func joinProperties(properties ...string) string {
+	var nonEmpty []string
+	for _, item := range properties {
+		if item != "" {
+			nonEmpty = append(nonEmpty, item)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
@@ -0,0 +1,171 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2015, 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+var _ = check.Suite(&provenanceSuite{})
+
+type provenanceSuite struct {
+	snaps map[string]image.SnapDetails
+}
+
+func (s *provenanceSuite) SetUpTest(c *check.C) {
+	s.snaps = map[string]image.SnapDetails{
+		"os":     {Name: "myos", Channel: "edge", Revision: "1", Sha3_384: "oshash"},
+		"kernel": {Name: "mykernel", Channel: "stable", Revision: "2", Sha3_384: "kernelhash"},
+		"gadget": {Name: "mygadget", Channel: "edge", Revision: "3"},
+	}
+}
+
+func (s *provenanceSuite) TestProvenancePropertiesForAllSnaps(c *check.C) {
+	properties := provenanceProperties(s.snaps, 0)
+
+	c.Assert(properties, check.Equals, "tool_version="+Version+
+		",os_name=myos,os_channel=edge,os_revision=1,os_sha3_384=oshash"+
+		",kernel_name=mykernel,kernel_channel=stable,kernel_revision=2,kernel_sha3_384=kernelhash"+
+		",gadget_name=mygadget,gadget_channel=edge,gadget_revision=3,gadget_sha3_384=")
+}
+
+func (s *provenanceSuite) TestProvenancePropertiesForSystemImage(c *check.C) {
+	properties := provenanceProperties(nil, 56)
+
+	c.Assert(properties, check.Equals, "tool_version="+Version+",si_version=56")
+}
+
+func (s *provenanceSuite) TestSameRevisions(c *check.C) {
+	testCases := []struct {
+		properties map[string]string
+		expected   bool
+	}{
+		{s.revisionProperties("myos", "mykernel", "mygadget", "1", "2", "3"), true},
+		{s.revisionProperties("myos", "mykernel", "mygadget", "1", "4", "3"), false},
+		{s.revisionProperties("myos", "otherkernel", "mygadget", "1", "2", "3"), false},
+		{s.revisionProperties("myos", "mykernel", "othergadget", "1", "2", "3"), false},
+		{map[string]string{"os_revision": "1", "kernel_revision": "2", "gadget_revision": "3"}, false},
+		{map[string]string{"os_name": "myos", "os_revision": "1", "kernel_name": "mykernel", "kernel_revision": "2"}, false},
+		{nil, false},
+	}
+	for _, item := range testCases {
+		c.Check(sameRevisions(s.snaps, item.properties), check.Equals, item.expected)
+	}
+}
+
+func (s *provenanceSuite) TestSameRevisionsIgnoresOtherProperties(c *check.C) {
+	properties := s.revisionProperties("myos", "mykernel", "mygadget", "1", "2", "3")
+	properties["os_channel"] = "beta"
+
+	c.Assert(sameRevisions(s.snaps, properties), check.Equals, true)
+}
+
+// revisionProperties returns the name and revision properties of an image
+// with the given os, kernel and gadget snaps
+func (s *provenanceSuite) revisionProperties(osName, kernelName, gadgetName, osRevision, kernelRevision, gadgetRevision string) map[string]string {
+	return map[string]string{
+		"os_name": osName, "os_revision": osRevision,
+		"kernel_name": kernelName, "kernel_revision": kernelRevision,
+		"gadget_name": gadgetName, "gadget_revision": gadgetRevision,
+	}
+}
+
+func (s *provenanceSuite) TestSameRevisionsIsFalseForLocalSnaps(c *check.C) {
+	s.snaps["os"] = image.SnapDetails{Name: "core", Revision: image.LocalRevision}
+	properties := s.revisionProperties("core", "mykernel", "mygadget", image.LocalRevision, "2", "3")
+
+	c.Assert(sameRevisions(s.snaps, properties), check.Equals, false)
+}
+
+func (s *provenanceSuite) TestJoinPropertiesSkipsEmptyValues(c *check.C) {
+	c.Assert(joinProperties("", "a=1", "", "b=2"), check.Equals, "a=1,b=2")
+	c.Assert(joinProperties(""), check.Equals, "")
+}
+
+func (s *provenanceSuite) TestManifestPropertiesEncodesManifest(c *check.C) {
+	properties, err := manifestProperties(testManifest, "")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(properties, check.Equals, testManifestProperty(c))
+	content, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(properties, manifestProperty+"="))
+	c.Assert(err, check.IsNil)
+	var manifest image.Manifest
+	c.Assert(json.Unmarshal(content, &manifest), check.IsNil)
+	c.Assert(&manifest, check.DeepEquals, testManifest)
+}
+
+func (s *provenanceSuite) TestManifestPropertiesSignsManifest(c *check.C) {
+	keyPath, keyring := writeSecretKeyring(c, true)
+	defer os.Remove(keyPath)
+
+	properties, err := manifestProperties(testManifest, keyPath)
+
+	c.Assert(err, check.IsNil)
+	parts := strings.Split(properties, ",")
+	c.Assert(parts, check.HasLen, 2)
+	c.Assert(parts[0], check.Equals, testManifestProperty(c))
+	c.Assert(strings.HasPrefix(parts[1], manifestSigProperty+"="), check.Equals, true)
+	content, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(parts[0], manifestProperty+"="))
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(parts[1], manifestSigProperty+"="))
+	c.Assert(err, check.IsNil)
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(signature))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *provenanceSuite) TestManifestPropertiesReturnsKeyError(c *check.C) {
+	keyPath, _ := writeSecretKeyring(c, false)
+	defer os.Remove(keyPath)
+
+	_, err := manifestProperties(testManifest, keyPath)
+
+	c.Assert(err, check.FitsTypeOf, &image.ErrManifestKey{})
+}
+
+// testManifestProperty returns the manifest property of the images created with testManifest
+func testManifestProperty(c *check.C) string {
+	content, err := json.Marshal(testManifest)
+	c.Assert(err, check.IsNil)
+	return manifestProperty + "=" + base64.StdEncoding.EncodeToString(content)
+}
+
+// writeSecretKeyring creates a new key and writes it to a keyring file, only its
+// public part if secret is false. It returns the path of the file and the key
+func writeSecretKeyring(c *check.C, secret bool) (string, openpgp.EntityList) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	c.Assert(err, check.IsNil)
+	file, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	if secret {
+		c.Assert(entity.SerializePrivate(file, nil), check.IsNil)
+	} else {
+		c.Assert(entity.Serialize(file), check.IsNil)
+	}
+	return file.Name(), openpgp.EntityList{entity}
+}
@@ -0,0 +1,190 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+const (
+	// PinnedTag is the tag that protects an image from being removed by cleanup
+	PinnedTag = "pinned"
+
+	reasonNewest   = "newest"
+	reasonYoung    = "younger than %s"
+	reasonPinned   = "pinned"
+	reasonPromoted = "promoted"
+	reasonInUse    = "in use"
+)
+
+var timeNow = time.Now
+
+// RetentionPolicy defines which images are kept by the cleanup action. Release, Channel
+// and Arch select the images the policy applies to, an empty value matches any of them.
+// The newest Keep images and the ones younger than KeepYoungerThan are kept, pinned and
+// promoted images and the ones in use by servers are always kept
+type RetentionPolicy struct {
+	Release, Channel, Arch string
+	Keep                   int
+	KeepYoungerThan        time.Duration
+}
+
+// retentionPolicyYAML is the representation of a policy in the config file
+type retentionPolicyYAML struct {
+	Release         string `yaml:"release"`
+	Channel         string `yaml:"channel"`
+	Arch            string `yaml:"arch"`
+	Keep            *int   `yaml:"keep"`
+	KeepYoungerThan string `yaml:"keep-younger-than"`
+}
+
+// ErrRetentionConfig is the type of the error returned when the retention
+// config file has invalid values
+type ErrRetentionConfig struct {
+	path, msg string
+}
+
+func (e *ErrRetentionConfig) Error() string {
+	return fmt.Sprintf("error in retention config %s: %s", e.path, e.msg)
+}
+
+// RetentionDecision holds an image and the reason for keeping it, if any
+type RetentionDecision struct {
+	Image  image.Record
+	Reason string
+}
+
+// RetentionReport holds the result of applying a RetentionPolicy to a list of images
+type RetentionReport struct {
+	Kept, Removed []RetentionDecision
+}
+
+// ReadRetentionPolicies returns the policies defined in the given YAML file, the
+// policies without a keep value take the one of base. The file has the form:
+//
+//   - release: rolling
+//     channel: edge
+//     arch: amd64
+//     keep: 5
+//     keep-younger-than: 72h
+func ReadRetentionPolicies(path string, base *flags.Options) ([]RetentionPolicy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var items []retentionPolicyYAML
+	if err = yaml.Unmarshal(content, &items); err != nil {
+		return nil, &ErrRetentionConfig{path: path, msg: err.Error()}
+	}
+	policies := make([]RetentionPolicy, len(items))
+	for i, item := range items {
+		keep := base.Keep
+		if item.Keep != nil {
+			keep = *item.Keep
+		}
+		if keep < 0 {
+			return nil, &ErrRetentionConfig{path: path, msg: fmt.Sprintf("negative keep value %d", keep)}
+		}
+		policies[i] = RetentionPolicy{
+			Release: item.Release, Channel: item.Channel, Arch: item.Arch, Keep: keep}
+		if item.KeepYoungerThan != "" {
+			if policies[i].KeepYoungerThan, err = time.ParseDuration(item.KeepYoungerThan); err != nil {
+				return nil, &ErrRetentionConfig{path: path, msg: err.Error()}
+			}
+		}
+	}
+	return policies, nil
+}
+
+// selectPolicy returns the first policy matching the given options, or the one
+// defined by the flags if none matches
+func selectPolicy(policies []RetentionPolicy, options *flags.Options) RetentionPolicy {
+	for _, policy := range policies {
+		if policy.matches(options) {
+			return policy
+		}
+	}
+	return RetentionPolicy{Keep: options.Keep, KeepYoungerThan: options.KeepYoungerThan}
+}
+
+func (p *RetentionPolicy) matches(options *flags.Options) bool {
+	channel := image.GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel)
+	return (p.Release == "" || removeDot(p.Release) == removeDot(options.Release)) &&
+		(p.Channel == "" || p.Channel == channel) &&
+		(p.Arch == "" || p.Arch == options.Arch)
+}
+
+// Apply decides which of the given images, sorted in descending version order,
+// should be kept and which removed. inUse holds the UUIDs of the images used by servers
+func (p *RetentionPolicy) Apply(images []image.Record, inUse map[string]bool) *RetentionReport {
+	report := &RetentionReport{}
+	now := timeNow()
+	for i, item := range images {
+		var reason string
+		switch {
+		case i < p.Keep:
+			reason = reasonNewest
+		case p.KeepYoungerThan > 0 && now.Sub(item.CreatedAt) < p.KeepYoungerThan:
+			reason = fmt.Sprintf(reasonYoung, p.KeepYoungerThan)
+		case hasTag(item, PinnedTag):
+			reason = reasonPinned
+		case hasTag(item, PromotedTag):
+			reason = reasonPromoted
+		case inUse[item.ID]:
+			reason = reasonInUse
+		}
+		decision := RetentionDecision{Image: item, Reason: reason}
+		if reason == "" {
+			report.Removed = append(report.Removed, decision)
+		} else {
+			report.Kept = append(report.Kept, decision)
+		}
+	}
+	return report
+}
+
+// RemovedIDs returns the UUIDs of the images to be removed
+func (r *RetentionReport) RemovedIDs() []string {
+	ids := make([]string, len(r.Removed))
+	for i, decision := range r.Removed {
+		ids[i] = decision.Image.ID
+	}
+	return ids
+}
+
+func hasTag(item image.Record, tag string) bool {
+	for _, t := range item.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func removeDot(in string) string {
+	return strings.Replace(in, ".", "", 1)
+}
@@ -0,0 +1,197 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+var _ = check.Suite(&retentionSuite{})
+
+type retentionSuite struct {
+	backTimeNow func() time.Time
+	now         time.Time
+	images      []image.Record
+}
+
+func (s *retentionSuite) SetUpSuite(c *check.C) {
+	s.backTimeNow = timeNow
+	s.now = time.Date(2016, 6, 14, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return s.now }
+}
+
+func (s *retentionSuite) TearDownSuite(c *check.C) {
+	timeNow = s.backTimeNow
+}
+
+func (s *retentionSuite) SetUpTest(c *check.C) {
+	s.images = []image.Record{}
+	// one image per day, the newest created one hour ago
+	for i := 0; i < 6; i++ {
+		s.images = append(s.images, image.Record{
+			ID:        "id" + string('0'+rune(i)),
+			CreatedAt: s.now.Add(-time.Hour - time.Duration(i)*24*time.Hour)})
+	}
+}
+
+func (s *retentionSuite) TestApplyKeepsNewest(c *check.C) {
+	policy := &RetentionPolicy{Keep: 2}
+
+	report := policy.Apply(s.images, nil)
+
+	c.Assert(report.Kept, check.HasLen, 2)
+	c.Assert(report.Kept[0].Reason, check.Equals, reasonNewest)
+	c.Assert(report.RemovedIDs(), check.DeepEquals, []string{"id2", "id3", "id4", "id5"})
+}
+
+func (s *retentionSuite) TestApplyKeepsYoungImages(c *check.C) {
+	policy := &RetentionPolicy{Keep: 1, KeepYoungerThan: 72 * time.Hour}
+
+	report := policy.Apply(s.images, nil)
+
+	c.Assert(report.Kept, check.HasLen, 3)
+	c.Assert(report.Kept[1].Reason, check.Equals, "younger than 72h0m0s")
+	c.Assert(report.RemovedIDs(), check.DeepEquals, []string{"id3", "id4", "id5"})
+}
+
+func (s *retentionSuite) TestApplyKeepsPinnedImages(c *check.C) {
+	s.images[4].Tags = []string{PinnedTag}
+	policy := &RetentionPolicy{Keep: 1}
+
+	report := policy.Apply(s.images, nil)
+
+	c.Assert(report.Kept[1].Image.ID, check.Equals, "id4")
+	c.Assert(report.Kept[1].Reason, check.Equals, reasonPinned)
+	c.Assert(report.RemovedIDs(), check.DeepEquals, []string{"id1", "id2", "id3", "id5"})
+}
+
+func (s *retentionSuite) TestApplyKeepsPromotedImages(c *check.C) {
+	s.images[3].Tags = []string{PromotedTag}
+	policy := &RetentionPolicy{Keep: 1}
+
+	report := policy.Apply(s.images, nil)
+
+	c.Assert(report.Kept[1].Image.ID, check.Equals, "id3")
+	c.Assert(report.Kept[1].Reason, check.Equals, reasonPromoted)
+	c.Assert(report.RemovedIDs(), check.DeepEquals, []string{"id1", "id2", "id4", "id5"})
+}
+
+func (s *retentionSuite) TestApplyKeepsImagesInUse(c *check.C) {
+	policy := &RetentionPolicy{Keep: 0}
+
+	report := policy.Apply(s.images, map[string]bool{"id5": true})
+
+	c.Assert(report.Kept, check.HasLen, 1)
+	c.Assert(report.Kept[0].Reason, check.Equals, reasonInUse)
+	c.Assert(report.RemovedIDs(), check.DeepEquals, []string{"id0", "id1", "id2", "id3", "id4"})
+}
+
+func (s *retentionSuite) TestSelectPolicy(c *check.C) {
+	policies := []RetentionPolicy{
+		{Release: "16.04", Arch: "amd64", Keep: 1},
+		{Release: "rolling", Channel: "stable", Keep: 2},
+		{Arch: "armhf", Keep: 4},
+	}
+	testCases := []struct {
+		release, channel, arch string
+		expectedKeep           int
+	}{
+		{"1604", "edge", "amd64", 1},
+		{"16.04", "edge", "amd64", 1},
+		{"16.04", "edge", "armhf", 4},
+		{"rolling", "stable", "i386", 2},
+		{"rolling", "edge", "i386", 10},
+	}
+	for _, item := range testCases {
+		options := &flags.Options{Release: item.release, OSChannel: item.channel,
+			KernelChannel: item.channel, GadgetChannel: item.channel, Arch: item.arch, Keep: 10}
+
+		c.Check(selectPolicy(policies, options).Keep, check.Equals, item.expectedKeep)
+	}
+}
+
+func (s *retentionSuite) TestReadRetentionPolicies(c *check.C) {
+	path := writeTempFile(c, `
+- release: rolling
+  channel: edge
+  arch: amd64
+  keep: 5
+  keep-younger-than: 72h
+- arch: armhf
+  keep: 1
+`)
+	defer os.Remove(path)
+
+	policies, err := ReadRetentionPolicies(path, &flags.Options{Keep: 3})
+
+	c.Assert(err, check.IsNil)
+	c.Assert(policies, check.DeepEquals, []RetentionPolicy{
+		{Release: "rolling", Channel: "edge", Arch: "amd64", Keep: 5, KeepYoungerThan: 72 * time.Hour},
+		{Arch: "armhf", Keep: 1},
+	})
+}
+
+func (s *retentionSuite) TestReadRetentionPoliciesTakesKeepFromOptions(c *check.C) {
+	path := writeTempFile(c, `
+- arch: amd64
+  keep-younger-than: 72h
+- arch: armhf
+  keep: 0
+`)
+	defer os.Remove(path)
+
+	policies, err := ReadRetentionPolicies(path, &flags.Options{Keep: 3})
+
+	c.Assert(err, check.IsNil)
+	c.Assert(policies, check.DeepEquals, []RetentionPolicy{
+		{Arch: "amd64", Keep: 3, KeepYoungerThan: 72 * time.Hour},
+		{Arch: "armhf", Keep: 0},
+	})
+}
+
+func (s *retentionSuite) TestReadRetentionPoliciesReturnsConfigErrors(c *check.C) {
+	for _, content := range []string{
+		"- keep: -1\n",
+		"- keep-younger-than: notaduration\n",
+		"not a list",
+	} {
+		path := writeTempFile(c, content)
+
+		_, err := ReadRetentionPolicies(path, &flags.Options{Keep: 3})
+		os.Remove(path)
+
+		c.Check(err, check.FitsTypeOf, &ErrRetentionConfig{})
+	}
+}
+
+func writeTempFile(c *check.C, content string) string {
+	file, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	_, err = file.WriteString(content)
+	c.Assert(err, check.IsNil)
+	return file.Name()
+}
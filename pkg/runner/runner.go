@@ -21,8 +21,9 @@ package runner
 
 import (
 	"fmt"
-	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -31,18 +32,18 @@ import (
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
 )
 
-const imagesToKeep = 3
-
 // Runner is the main type of the package
 type Runner struct {
-	imgDataOrigin image.Pollster
-	imgDataTarget image.PollsterWriter
-	imgDriver     image.Driver
+	imgDataOrigin  image.PollsterVerifier
+	imgDataTarget  image.PollsterWriter
+	imgDriver      image.Driver
+	snapDataOrigin image.SnapPollster
+	imgVerifier    image.Verifier
 }
 
 // NewRunner is the Runner constructor
-func NewRunner(imgDataOrigin image.Pollster, imgDataTarget image.PollsterWriter, imgDriver image.Driver) *Runner {
-	return &Runner{imgDataOrigin: imgDataOrigin, imgDataTarget: imgDataTarget, imgDriver: imgDriver}
+func NewRunner(imgDataOrigin image.PollsterVerifier, imgDataTarget image.PollsterWriter, imgDriver image.Driver, snapDataOrigin image.SnapPollster, imgVerifier image.Verifier) *Runner {
+	return &Runner{imgDataOrigin: imgDataOrigin, imgDataTarget: imgDataTarget, imgDriver: imgDriver, snapDataOrigin: snapDataOrigin, imgVerifier: imgVerifier}
 }
 
 // ErrVersion is the type of the error returned by Exec when the version
@@ -55,6 +56,18 @@ func (e *ErrVersion) Error() string {
 	return fmt.Sprintf("error SI version %d is not greater than cloud version %d", e.siVersion, e.cloudVersion)
 }
 
+// ErrRevisions is the type of the error returned by Exec when the revisions
+// of the snaps in the store are the same of the latest image in cloud
+type ErrRevisions struct {
+	image string
+	snaps map[string]image.SnapDetails
+}
+
+func (e *ErrRevisions) Error() string {
+	return fmt.Sprintf("error snap revisions %s are the same of the latest image %s",
+		revisionsString(e.snaps), e.image)
+}
+
 // ErrActionUnknown is the type of the error returned by Exec when the
 // action given is not recognized
 type ErrActionUnknown struct {
@@ -65,23 +78,140 @@ func (e *ErrActionUnknown) Error() string {
 	return fmt.Sprintf("error unknown action %s", e.action)
 }
 
+// ErrImageFormat is the type of the error returned by Exec when the file given
+// for the upload action is not in one of the supported image formats
+type ErrImageFormat struct {
+	path, format string
+}
+
+func (e *ErrImageFormat) Error() string {
+	return fmt.Sprintf("error unsupported format %s of image file %s", e.format, e.path)
+}
+
+// ErrMatrix is the type of the error returned by Exec when the action failed
+// for some of the image specs of the matrix config file
+type ErrMatrix struct {
+	failed []string
+	total  int
+}
+
+func (e *ErrMatrix) Error() string {
+	return fmt.Sprintf("error action failed for %d of %d image specs: %s",
+		len(e.failed), e.total, strings.Join(e.failed, "; "))
+}
+
 // Exec is the main entry point, it interprets the given options and
 // handles the logic of the utility
 func (r *Runner) Exec(options *flags.Options) (err error) {
+	if err = options.Validate(); err != nil {
+		return
+	}
+	if options.Matrix != "" {
+		return r.execMatrix(options)
+	}
+	return r.exec(options)
+}
+
+// execMatrix performs the action for each of the image specs in the matrix
+// config file, up to options.Jobs of them concurrently. A failing spec doesn't
+// prevent the rest from being processed, the specs already up to date are
+// skipped without failing the run
+func (r *Runner) execMatrix(options *flags.Options) (err error) {
+	matrix, err := flags.ReadMatrix(options.Matrix, options)
+	if err != nil {
+		return
+	}
+	jobs := options.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	// the actions may modify the options, the specs are described beforehand
+	specs := make([]string, len(matrix))
+	errs := make([]error, len(matrix))
+	sem := make(chan struct{}, jobs)
+	var wg sync.WaitGroup
+	for i, entry := range matrix {
+		specs[i] = describe(entry)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, entry *flags.Options) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = r.exec(entry)
+			if upToDate(errs[i]) {
+				log.Infof("Action %s skipped for %s: %s", entry.Action, specs[i], errs[i])
+				errs[i] = nil
+			} else if errs[i] != nil {
+				log.Errorf("Action %s failed for %s: %s", entry.Action, specs[i], errs[i])
+			} else {
+				log.Infof("Action %s succeeded for %s", entry.Action, specs[i])
+			}
+		}(i, entry)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, entryErr := range errs {
+		if entryErr != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", specs[i], entryErr))
+		}
+	}
+	if len(failed) > 0 {
+		return &ErrMatrix{failed: failed, total: len(matrix)}
+	}
+	return
+}
+
+// upToDate checks if err reports that there's nothing new to build
+func upToDate(err error) bool {
+	switch err.(type) {
+	case *ErrVersion, *ErrRevisions:
+		return true
+	}
+	return false
+}
+
+func (r *Runner) exec(options *flags.Options) (err error) {
 	if options.Action == "create" {
 		return r.create(options)
 	} else if options.Action == "cleanup" {
 		return r.cleanup(options)
 	} else if options.Action == "purge" {
 		return r.purge(options)
+	} else if options.Action == "upload" {
+		return r.uploadFile(options)
+	} else if options.Action == "build" {
+		return r.build(options)
+	} else if options.Action == "list" {
+		return r.list(options)
+	} else if options.Action == "promote" {
+		return r.promote(options)
 	}
 	return &ErrActionUnknown{action: options.Action}
 }
 
+// describe returns a human readable identifier of the image spec
+func describe(options *flags.Options) string {
+	return fmt.Sprintf("release %s, channel %s, arch %s, image type %s", options.Release,
+		image.GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel), options.Arch, options.ImageType)
+}
+
 func (r *Runner) create(options *flags.Options) (err error) {
 	log.Infof("Checking current versions for release %s, os channel %s, kernel channel %s, gadget channel %s and arch %s",
 		options.Release, options.OSChannel, options.KernelChannel, options.GadgetChannel, options.Arch)
+	if _, err = image.FormatFor(options); err != nil {
+		return
+	}
+	if _, err = image.ArchFor(options); err != nil {
+		return
+	}
+	if err = cloud.CheckProperties(options.Properties); err != nil {
+		return
+	}
 	var siVersion, cloudVersion int
+	var snaps map[string]image.SnapDetails
 
 	if options.Release == "15.04" {
 		siVersion, cloudVersion, err = r.getVersions(options)
@@ -91,17 +221,44 @@ func (r *Runner) create(options *flags.Options) (err error) {
 		if siVersion <= cloudVersion {
 			return &ErrVersion{siVersion, cloudVersion}
 		}
+	} else {
+		if snaps, err = r.checkRevisions(options); err != nil {
+			return
+		}
 	}
-	var path string
-	path, err = r.imgDriver.Create(options, siVersion)
-	defer os.Remove(path)
+	// the provenance of the image is recorded in its properties, the snap revisions
+	// are used for the comparison of the next run
+	imageOptions := *options
+	imageOptions.Properties = joinProperties(options.Properties, provenanceProperties(snaps, siVersion))
+	options = &imageOptions
+
+	if options.DryRun {
+		r.planCreate(options, siVersion)
+		return
+	}
+	var path, tmpDir, properties string
+	var manifest *image.Manifest
+	path, tmpDir, manifest, err = r.createImage(options, siVersion, snaps)
+	defer removeImageFile(path, tmpDir, options)
 	log.Infof("Creating image file in %s", path)
 	if err != nil {
 		return
 	}
+	if err = r.verify(path, options); err != nil {
+		return
+	}
+	if options.KeepImage {
+		// the kept file can be uploaded later with the properties recorded here
+		if err = writeManifest(path+manifestSuffix, completeManifest(manifest, filepath.Base(path), options, siVersion), options.ManifestKey); err != nil {
+			return
+		}
+	}
+	if properties, err = manifestProperties(manifest, options.ManifestKey); err != nil {
+		return
+	}
+	options.Properties = joinProperties(options.Properties, properties)
 
-	log.Infof("Uploading %s", path)
-	err = r.imgDataTarget.Create(path, options, siVersion)
+	err = r.upload(path, options, siVersion)
 	if err != nil {
 		return
 	}
@@ -110,6 +267,69 @@ func (r *Runner) create(options *flags.Options) (err error) {
 
 }
 
+// checkRevisions returns the current details of the snaps of an all-snaps image,
+// or ErrRevisions if their revisions are the same of the latest image in cloud
+func (r *Runner) checkRevisions(options *flags.Options) (snaps map[string]image.SnapDetails, err error) {
+	snaps, err = r.snapDataOrigin.GetSnaps(options)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("snap revisions: ", revisionsString(snaps))
+	images, err := r.imgDataTarget.GetVersions(options)
+	if err != nil {
+		if _, ok := err.(*cloud.ErrVersionNotFound); ok {
+			return snaps, nil
+		}
+		return nil, err
+	}
+	if len(images) > 0 && sameRevisions(snaps, images[0].Properties) {
+		return nil, &ErrRevisions{image: images[0].Name, snaps: snaps}
+	}
+	return snaps, nil
+}
+
+// planCreate logs the commands that would be executed for creating the image
+// and the name it would be uploaded with
+func (r *Runner) planCreate(options *flags.Options, siVersion int) {
+	for _, cmd := range r.imgDriver.Plan(options, siVersion) {
+		log.Infof("Would execute %s", strings.Join(cmd, " "))
+	}
+	if options.SmokeTest {
+		log.Info("Would boot the image with QEMU before uploading it")
+	}
+	if options.ManifestKey != "" {
+		log.Infof("Would sign the image manifest with the key in %s", options.ManifestKey)
+	}
+	log.Infof("Would upload image %s with properties %s", cloud.GetImageID(options, siVersion), options.Properties)
+}
+
+// verify boots the image at path if the smoke test was requested
+func (r *Runner) verify(path string, options *flags.Options) error {
+	if !options.SmokeTest {
+		return nil
+	}
+	log.Infof("Smoke testing image %s", path)
+	return r.imgVerifier.Verify(options, path)
+}
+
+// createImage creates the image file with the driver from the given snaps. The
+// system-image files of 15.04 images are verified before and the driver gets
+// them from the mirror of the verified ones
+func (r *Runner) createImage(options *flags.Options, siVersion int, snaps map[string]image.SnapDetails) (path, tmpDir string, manifest *image.Manifest, err error) {
+	if options.Release != "15.04" {
+		return r.imgDriver.Create(options, siVersion, snaps)
+	}
+	log.Infof("Verifying system-image files of version %d", siVersion)
+	mirror, err := r.imgDataOrigin.VerifyFiles(options, siVersion)
+	if err != nil {
+		return
+	}
+	defer mirror.Close()
+	mirrorOptions := *options
+	mirrorOptions.SIServer = mirror.URL()
+	return r.imgDriver.Create(&mirrorOptions, siVersion, nil)
+}
+
 func (r *Runner) getVersions(options *flags.Options) (siVersion, cloudVersion int, err error) {
 	var siError, cloudError error
 	versionChan := make(chan struct{}, 2)
@@ -142,21 +362,59 @@ func (r *Runner) getVersions(options *flags.Options) (siVersion, cloudVersion in
 }
 
 func (r *Runner) cleanup(options *flags.Options) (err error) {
-	options.Release = strings.Replace(options.Release, ".", "", 1)
+	var policies []RetentionPolicy
+	if options.RetentionConfig != "" {
+		if policies, err = ReadRetentionPolicies(options.RetentionConfig, options); err != nil {
+			return
+		}
+	}
+	policy := selectPolicy(policies, options)
+
 	imageList, err := r.imgDataTarget.GetVersions(options)
 	if err != nil {
 		log.Info("Error getting image list")
 		return
 	}
-	if len(imageList) > imagesToKeep {
-		// assumes that imageList is sorted in descending order,
-		// the last items in the list will be the older ones
-		log.Infof("Removing images %s", imageList[imagesToKeep:])
-		err = r.imgDataTarget.Delete(imageList[imagesToKeep:]...)
+	inUseList, err := r.imgDataTarget.GetImagesInUse()
+	if err != nil {
+		log.Info("Error getting images in use")
+		return
 	}
-	return
+	inUse := make(map[string]bool)
+	for _, id := range inUseList {
+		inUse[id] = true
+	}
+
+	report := policy.Apply(imageList, inUse)
+	for _, decision := range report.Kept {
+		log.Infof("Keeping image %s (%s): %s", decision.Image.ID, decision.Image.Name, decision.Reason)
+	}
+	if len(report.Removed) == 0 {
+		return
+	}
+	for _, decision := range report.Removed {
+		if options.DryRun {
+			log.Infof("Would remove image %s (%s)", decision.Image.ID, decision.Image.Name)
+		} else {
+			log.Infof("Removing image %s (%s)", decision.Image.ID, decision.Image.Name)
+		}
+	}
+	if options.DryRun {
+		return
+	}
+	return r.imgDataTarget.Delete(report.RemovedIDs()...)
 }
 
 func (r *Runner) purge(options *flags.Options) (err error) {
-	return r.imgDataTarget.Purge(options)
+	if !options.DryRun {
+		return r.imgDataTarget.Purge(options)
+	}
+	images, err := r.imgDataTarget.List(options)
+	if err != nil {
+		return
+	}
+	for _, item := range images {
+		log.Infof("Would remove image %s (%s)", item.ID, item.Name)
+	}
+	return
 }
@@ -19,15 +19,22 @@
 package runner
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
 
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
 
 	"gopkg.in/check.v1"
 )
@@ -39,12 +46,32 @@ const (
 	cloudCreateError        = "error creating cloud image"
 	cloudDeleteError        = "error deleting cloud images"
 	cloudPurgeError         = "error purging cloud images"
+	cloudInUseError         = "error getting images in use"
+	cloudListError          = "error listing cloud images"
+	cloudTagError           = "error tagging cloud image"
 	udfCreateError          = "error creating image"
+	detectFormatError       = "error detecting image format"
+	convertError            = "error converting image"
+	verifyError             = "error smoke testing image"
+	storeRevisionsError     = "error getting snap revisions"
+	siVerifyFilesError      = "error verifying si files"
+	testMirrorURL           = "http://127.0.0.1:8080"
+	testSnapProperties      = "os_name=myos,os_channel=edge,os_revision=10,os_sha3_384=oshash," +
+		"kernel_name=mykernel,kernel_channel=edge,kernel_revision=20,kernel_sha3_384=kernelhash," +
+		"gadget_name=mygadget,gadget_channel=beta,gadget_revision=30,gadget_sha3_384=gadgethash"
+	testImagesToKeep = 3
 )
 
+var testManifest = &image.Manifest{
+	Snaps:  []image.ManifestSnap{{Role: "os", Name: "ubuntu-core", Channel: "edge", Revision: "10", Sha3_384: "oshash"}},
+	Tools:  []image.ManifestTool{{Name: "ubuntu-device-flash", Version: "0.31", Args: []string{"core", "rolling"}}},
+	Output: image.ManifestOutput{Format: "qcow2", Sha256: "imagesha256", Size: 1024},
+}
+
 var _ = check.Suite(&runnerCreateSuite{})
 var _ = check.Suite(&runnerCleanupSuite{})
 var _ = check.Suite(&runnerPurgeSuite{})
+var _ = check.Suite(&runnerMatrixSuite{})
 
 func Test(t *testing.T) { check.TestingT(t) }
 
@@ -54,6 +81,8 @@ type runnerCreateSuite struct {
 	siClient    *fakeSiClient
 	cloudClient *fakeCloudClient
 	udfDriver   *fakeImgDriver
+	storeClient *fakeStoreClient
+	verifier    *fakeVerifier
 }
 
 type runnerCleanupSuite struct {
@@ -68,13 +97,28 @@ type runnerPurgeSuite struct {
 	cloudClient *fakeCloudClient
 }
 
+type runnerMatrixSuite struct {
+	subject     *Runner
+	options     *flags.Options
+	siClient    *fakeSiClient
+	cloudClient *fakeCloudClient
+	udfDriver   *fakeImgDriver
+	matrixPath  string
+}
+
 type fakeSiClient struct {
-	getVersionCalls map[string]int
-	doErr           bool
-	version         int
+	sync.Mutex
+	getVersionCalls  map[string]int
+	doErr            bool
+	version          int
+	verifyFilesCalls int
+	doVerifyErr      bool
+	mirror           *fakeMirror
 }
 
 func (s *fakeSiClient) GetLatestVersion(options *flags.Options) (ver int, err error) {
+	s.Lock()
+	defer s.Unlock()
 	key := getFakeKey(options)
 	s.getVersionCalls[key]++
 	if s.doErr {
@@ -83,22 +127,78 @@ func (s *fakeSiClient) GetLatestVersion(options *flags.Options) (ver int, err er
 	return s.version, err
 }
 
+func (s *fakeSiClient) VerifyFiles(options *flags.Options, version int) (mirror image.SIMirror, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.verifyFilesCalls++
+	if s.doVerifyErr {
+		return nil, fmt.Errorf(siVerifyFilesError)
+	}
+	s.mirror = &fakeMirror{}
+	return s.mirror, nil
+}
+
+type fakeMirror struct {
+	closed bool
+}
+
+func (m *fakeMirror) URL() string {
+	return testMirrorURL
+}
+
+func (m *fakeMirror) Close() error {
+	m.closed = true
+	return nil
+}
+
+type fakeStoreClient struct {
+	sync.Mutex
+	getSnapsCalls map[string]int
+	doErr         bool
+	snaps         map[string]image.SnapDetails
+}
+
+func (s *fakeStoreClient) GetSnaps(options *flags.Options) (snaps map[string]image.SnapDetails, err error) {
+	s.Lock()
+	defer s.Unlock()
+	key := getFakeKey(options)
+	s.getSnapsCalls[key]++
+	if s.doErr {
+		err = fmt.Errorf(storeRevisionsError)
+	}
+	return s.snaps, err
+}
+
 type fakeCloudClient struct {
+	sync.Mutex
 	getLatestVersionCalls map[string]int
 	getVersionsCalls      map[string]int
 	createCalls           map[string]int
 	deleteCalls           map[string]int
 	purgeCalls            int
+	inUseCalls            int
+	listCalls             int
 	doVerErr              bool
 	doVerNotFoundErr      bool
 	doCreateErr           bool
 	doDeleteErr           bool
 	doPurgeErr            bool
+	doInUseErr            bool
+	doListErr             bool
 	version               int
-	versions              []string
+	versions              []image.Record
+	inUse                 []string
+	list                  []image.Record
+	properties            string
+	totalCreateCalls      int
+	failingCreateCalls    int
+	tagCalls              []string
+	doTagErr              bool
 }
 
 func (s *fakeCloudClient) GetLatestVersion(options *flags.Options) (ver int, err error) {
+	s.Lock()
+	defer s.Unlock()
 	key := getFakeKey(options)
 	s.getLatestVersionCalls[key]++
 	if s.doVerErr {
@@ -110,26 +210,57 @@ func (s *fakeCloudClient) GetLatestVersion(options *flags.Options) (ver int, err
 	return s.version, err
 }
 
-func (s *fakeCloudClient) GetVersions(options *flags.Options) (images []string, err error) {
+func (s *fakeCloudClient) GetVersions(options *flags.Options) (images []image.Record, err error) {
+	s.Lock()
+	defer s.Unlock()
 	key := getFakeKey(options)
 	s.getVersionsCalls[key]++
 	if s.doVerErr {
 		err = fmt.Errorf(cloudVersionsError)
 	}
+	if s.doVerNotFoundErr {
+		err = cloud.NewErrVersionNotFound(options)
+	}
 	return s.versions, err
 }
 
 func (s *fakeCloudClient) Create(filePath string, options *flags.Options, version int) (err error) {
+	s.Lock()
+	defer s.Unlock()
 	key := getFullCreateKey(filePath, options, version)
 	s.createCalls[key]++
-	if s.doCreateErr {
+	s.totalCreateCalls++
+	s.properties = options.Properties
+	if s.doCreateErr || s.totalCreateCalls <= s.failingCreateCalls {
 		err = fmt.Errorf(cloudCreateError)
 	}
 	return
 }
 
-func (s *fakeCloudClient) Delete(versions ...string) (err error) {
-	key := getDeleteKey(versions)
+func (s *fakeCloudClient) AddTag(id, tag string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.tagCalls = append(s.tagCalls, "add "+tag+" "+id)
+	if s.doTagErr {
+		err = fmt.Errorf(cloudTagError)
+	}
+	return
+}
+
+func (s *fakeCloudClient) RemoveTag(id, tag string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.tagCalls = append(s.tagCalls, "remove "+tag+" "+id)
+	if s.doTagErr {
+		err = fmt.Errorf(cloudTagError)
+	}
+	return
+}
+
+func (s *fakeCloudClient) Delete(ids ...string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	key := getDeleteKey(ids)
 	s.deleteCalls[key]++
 	if s.doDeleteErr {
 		err = fmt.Errorf(cloudDeleteError)
@@ -138,6 +269,8 @@ func (s *fakeCloudClient) Delete(versions ...string) (err error) {
 }
 
 func (s *fakeCloudClient) Purge(options *flags.Options) (err error) {
+	s.Lock()
+	defer s.Unlock()
 	s.purgeCalls++
 	if s.doPurgeErr {
 		err = fmt.Errorf(cloudPurgeError)
@@ -145,26 +278,119 @@ func (s *fakeCloudClient) Purge(options *flags.Options) (err error) {
 	return
 }
 
+func (s *fakeCloudClient) GetImagesInUse() (ids []string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.inUseCalls++
+	if s.doInUseErr {
+		err = fmt.Errorf(cloudInUseError)
+	}
+	return s.inUse, err
+}
+
+func (s *fakeCloudClient) List(options *flags.Options) (images []image.Record, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.listCalls++
+	if s.doListErr {
+		err = fmt.Errorf(cloudListError)
+	}
+	return s.list, err
+}
+
 type fakeImgDriver struct {
-	createCalls map[string]int
-	path        string
-	doErr       bool
+	sync.Mutex
+	createCalls  map[string]int
+	planCalls    map[string]int
+	convertCalls map[string]int
+	path         string
+	tmpDir       string
+	format       string
+	convertPath  string
+	convertDir   string
+	doErr        bool
+	doFormatErr  bool
+	failArch     string
+	siServer     string
+	snaps        map[string]image.SnapDetails
+	delay        time.Duration
+	running      int
+	maxRunning   int
 }
 
-func (s *fakeImgDriver) Create(options *flags.Options, version int) (path string, err error) {
+func (s *fakeImgDriver) Create(options *flags.Options, version int, snaps map[string]image.SnapDetails) (path, tmpDir string, manifest *image.Manifest, err error) {
+	s.Lock()
+	defer s.Unlock()
 	key := getCreateKey(options, version)
 	s.createCalls[key]++
-	if s.doErr {
+	s.siServer = options.SIServer
+	s.snaps = snaps
+	if s.delay > 0 {
+		s.running++
+		if s.running > s.maxRunning {
+			s.maxRunning = s.running
+		}
+		s.Unlock()
+		time.Sleep(s.delay)
+		s.Lock()
+		s.running--
+	}
+	if s.doErr || options.Arch == s.failArch {
 		err = fmt.Errorf(udfCreateError)
 	}
-	return s.path, err
+	return s.path, s.tmpDir, testManifest, err
+}
+
+func (s *fakeImgDriver) Plan(options *flags.Options, version int) (cmds [][]string) {
+	s.Lock()
+	defer s.Unlock()
+	key := getCreateKey(options, version)
+	s.planCalls[key]++
+	return [][]string{{"udf", "call"}, {"convert", "call"}}
+}
+
+func (s *fakeImgDriver) DetectFormat(path string) (format string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.doFormatErr {
+		err = fmt.Errorf(detectFormatError)
+	}
+	return s.format, err
+}
+
+func (s *fakeImgDriver) Convert(options *flags.Options, path string) (output, tmpDir string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.convertCalls[path]++
+	if s.doErr {
+		err = fmt.Errorf(convertError)
+	}
+	return s.convertPath, s.convertDir, err
+}
+
+type fakeVerifier struct {
+	sync.Mutex
+	verifyCalls map[string]int
+	doErr       bool
+}
+
+func (s *fakeVerifier) Verify(options *flags.Options, path string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.verifyCalls[path]++
+	if s.doErr {
+		err = fmt.Errorf(verifyError)
+	}
+	return
 }
 
 func (s *runnerCreateSuite) SetUpSuite(c *check.C) {
 	s.siClient = &fakeSiClient{}
 	s.cloudClient = &fakeCloudClient{}
 	s.udfDriver = &fakeImgDriver{}
-	s.subject = NewRunner(s.siClient, s.cloudClient, s.udfDriver)
+	s.storeClient = &fakeStoreClient{}
+	s.verifier = &fakeVerifier{}
+	s.subject = NewRunner(s.siClient, s.cloudClient, s.udfDriver, s.storeClient, s.verifier)
 	s.options = &flags.Options{
 		Action:        "create",
 		Release:       "15.04",
@@ -178,29 +404,55 @@ func (s *runnerCreateSuite) SetUpTest(c *check.C) {
 	s.siClient.getVersionCalls = make(map[string]int)
 	s.siClient.doErr = false
 	s.siClient.version = 2
+	s.siClient.verifyFilesCalls = 0
+	s.siClient.doVerifyErr = false
+	s.siClient.mirror = nil
 	s.cloudClient.getLatestVersionCalls = make(map[string]int)
 	s.cloudClient.createCalls = make(map[string]int)
 	s.cloudClient.doVerErr = false
 	s.cloudClient.doVerNotFoundErr = false
+	s.cloudClient.getVersionsCalls = make(map[string]int)
+	s.cloudClient.versions = []image.Record{}
+	s.cloudClient.properties = ""
+	s.storeClient.getSnapsCalls = make(map[string]int)
+	s.storeClient.doErr = false
+	s.storeClient.snaps = map[string]image.SnapDetails{
+		"os":     {Name: "myos", Channel: "edge", Revision: "10", Sha3_384: "oshash"},
+		"kernel": {Name: "mykernel", Channel: "edge", Revision: "20", Sha3_384: "kernelhash"},
+		"gadget": {Name: "mygadget", Channel: "beta", Revision: "30", Sha3_384: "gadgethash"},
+	}
 	s.cloudClient.doCreateErr = false
+	s.cloudClient.totalCreateCalls = 0
+	s.cloudClient.failingCreateCalls = 0
 	s.cloudClient.version = 1
 	s.udfDriver.createCalls = make(map[string]int)
+	s.udfDriver.planCalls = make(map[string]int)
 	s.udfDriver.doErr = false
 	s.udfDriver.path = "path"
+	s.udfDriver.tmpDir = ""
 	s.options.Action = "create"
 	s.options.Release = "15.04"
+	s.options.Properties = ""
+	s.options.ImageFormat = ""
+	s.options.ManifestKey = ""
+	s.options.Arch = "amd64"
+	s.options.DryRun = false
+	s.options.SmokeTest = false
+	s.verifier.verifyCalls = make(map[string]int)
+	s.verifier.doErr = false
 }
 
 func (s *runnerCleanupSuite) SetUpSuite(c *check.C) {
 	s.cloudClient = &fakeCloudClient{}
-	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{})
+	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{}, &fakeStoreClient{}, &fakeVerifier{})
 	s.options = &flags.Options{
 		Action:        "cleanup",
 		Release:       "15.04",
 		OSChannel:     "edge",
 		KernelChannel: "edge",
 		GadgetChannel: "edge",
-		Arch:          "amd64"}
+		Arch:          "amd64",
+		Keep:          testImagesToKeep}
 }
 
 func (s *runnerCleanupSuite) SetUpTest(c *check.C) {
@@ -208,13 +460,20 @@ func (s *runnerCleanupSuite) SetUpTest(c *check.C) {
 	s.cloudClient.deleteCalls = make(map[string]int)
 	s.cloudClient.doVerErr = false
 	s.cloudClient.doDeleteErr = false
-	s.cloudClient.versions = []string{}
+	s.cloudClient.versions = []image.Record{}
+	s.cloudClient.inUseCalls = 0
+	s.cloudClient.doInUseErr = false
+	s.cloudClient.inUse = []string{}
 	s.options.Action = "cleanup"
+	s.options.Keep = testImagesToKeep
+	s.options.KeepYoungerThan = 0
+	s.options.RetentionConfig = ""
+	s.options.DryRun = false
 }
 
 func (s *runnerPurgeSuite) SetUpSuite(c *check.C) {
 	s.cloudClient = &fakeCloudClient{}
-	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{})
+	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{}, &fakeStoreClient{}, &fakeVerifier{})
 	s.options = &flags.Options{
 		Action:        "purge",
 		Release:       "15.04",
@@ -227,7 +486,48 @@ func (s *runnerPurgeSuite) SetUpSuite(c *check.C) {
 func (s *runnerPurgeSuite) SetUpTest(c *check.C) {
 	s.cloudClient.purgeCalls = 0
 	s.cloudClient.doPurgeErr = false
+	s.cloudClient.listCalls = 0
+	s.cloudClient.doListErr = false
+	s.cloudClient.list = []image.Record{}
 	s.options.Action = "purge"
+	s.options.DryRun = false
+}
+
+func (s *runnerMatrixSuite) SetUpSuite(c *check.C) {
+	s.siClient = &fakeSiClient{}
+	s.cloudClient = &fakeCloudClient{}
+	s.udfDriver = &fakeImgDriver{}
+	s.subject = NewRunner(s.siClient, s.cloudClient, s.udfDriver,
+		&fakeStoreClient{getSnapsCalls: make(map[string]int)}, &fakeVerifier{})
+	s.matrixPath = writeTempFile(c, "- arch: amd64\n- arch: i386\n- release: 16.04\n  arch: armhf\n")
+}
+
+func (s *runnerMatrixSuite) TearDownSuite(c *check.C) {
+	os.Remove(s.matrixPath)
+}
+
+func (s *runnerMatrixSuite) SetUpTest(c *check.C) {
+	s.siClient.getVersionCalls = make(map[string]int)
+	s.siClient.version = 0
+	s.cloudClient.getLatestVersionCalls = make(map[string]int)
+	s.cloudClient.version = 0
+	s.cloudClient.createCalls = make(map[string]int)
+	s.cloudClient.getVersionsCalls = make(map[string]int)
+	s.cloudClient.doCreateErr = false
+	s.udfDriver.createCalls = make(map[string]int)
+	s.udfDriver.failArch = ""
+	s.udfDriver.delay = 0
+	s.udfDriver.maxRunning = 0
+	s.udfDriver.path = "path"
+	s.options = &flags.Options{
+		Action:        "create",
+		Release:       "rolling",
+		OSChannel:     "edge",
+		KernelChannel: "edge",
+		GadgetChannel: "edge",
+		Arch:          "amd64",
+		ImageType:     "custom",
+		Matrix:        s.matrixPath}
 }
 
 func (s *runnerCreateSuite) TestExecCreateGetsSIVersionFor1504(c *check.C) {
@@ -403,20 +703,36 @@ func (s *runnerCreateSuite) TestExecReturnsCloudCreateError(c *check.C) {
 	c.Assert(err.Error(), check.Equals, cloudCreateError)
 }
 
-func (s *runnerCreateSuite) TestExecRemovesImageFile(c *check.C) {
-	tmpFile, err := ioutil.TempFile("", "")
-	defer os.Remove(tmpFile.Name())
-	c.Assert(err, check.IsNil)
-
-	s.udfDriver.path = tmpFile.Name()
+func (s *runnerCreateSuite) TestExecRemovesTmpDirOfImageFile(c *check.C) {
+	s.udfDriver.tmpDir = writeTmpDir(c)
+	s.udfDriver.path = filepath.Join(s.udfDriver.tmpDir, "udf.img")
 
 	s.subject.Exec(s.options)
 
-	_, err = os.Stat(tmpFile.Name())
+	_, err := os.Stat(s.udfDriver.tmpDir)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerCreateSuite) TestExecRemovesTmpDirOnCreateError(c *check.C) {
+	s.udfDriver.tmpDir = writeTmpDir(c)
+	s.udfDriver.doErr = true
+
+	err := s.subject.Exec(s.options)
 
+	c.Assert(err, check.NotNil)
+	_, err = os.Stat(s.udfDriver.tmpDir)
 	c.Assert(os.IsNotExist(err), check.Equals, true)
 }
 
+// writeTmpDir returns a new temporary directory with an image file in it, as
+// the drivers do
+func writeTmpDir(c *check.C) string {
+	tmpDir, err := ioutil.TempDir("", "")
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(tmpDir, "udf.img"), []byte("image content"), 0644), check.IsNil)
+	return tmpDir
+}
+
 func (s *runnerCreateSuite) TestExecReturnsErrorOnInvalidAction(c *check.C) {
 	s.options.Action = "invalid-action"
 	err := s.subject.Exec(s.options)
@@ -426,6 +742,278 @@ func (s *runnerCreateSuite) TestExecReturnsErrorOnInvalidAction(c *check.C) {
 	c.Assert(err.Error(), check.Equals, expectedError.Error())
 }
 
+func (s *runnerCreateSuite) TestExecReturnsErrorOnUnknownImageFormat(c *check.C) {
+	s.options.ImageFormat = "iso"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &image.ErrUnknownFormat{})
+	c.Assert(len(s.storeClient.getSnapsCalls), check.Equals, 0)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsErrorOnUnknownArch(c *check.C) {
+	s.options.Arch = "sparc"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &image.ErrUnknownArch{})
+	c.Assert(s.siClient.getVersionCalls, check.HasLen, 0)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsErrorOnReservedProperty(c *check.C) {
+	s.options.Properties = "visibility=public"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &cloud.ErrReservedProperty{})
+	c.Assert(s.siClient.getVersionCalls, check.HasLen, 0)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecGetsSnapRevisionsForNon1504(c *check.C) {
+	s.options.Release = "rolling"
+
+	s.subject.Exec(s.options)
+
+	c.Assert(s.storeClient.getSnapsCalls[getFakeKey(s.options)], check.Equals, 1)
+	c.Assert(s.cloudClient.getVersionsCalls[getFakeKey(s.options)], check.Equals, 1)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotGetSnapRevisionsFor1504(c *check.C) {
+	s.subject.Exec(s.options)
+
+	c.Assert(len(s.storeClient.getSnapsCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsSnapRevisionsError(c *check.C) {
+	s.options.Release = "rolling"
+	s.storeClient.doErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, storeRevisionsError)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsErrRevisionsIfRevisionsAreUnchanged(c *check.C) {
+	s.options.Release = "rolling"
+	s.cloudClient.versions = []image.Record{{Name: "latest", Properties: map[string]string{
+		"os_name": "myos", "os_revision": "10", "kernel_name": "mykernel", "kernel_revision": "20",
+		"gadget_name": "mygadget", "gadget_revision": "30", "other": "value"}}}
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrRevisions{})
+	c.Assert(err.Error(), check.Equals,
+		"error snap revisions myos=10,mykernel=20,mygadget=30 are the same of the latest image latest")
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+	c.Assert(len(s.cloudClient.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecCreatesImageIfSnapNamesChanged(c *check.C) {
+	s.options.Release = "rolling"
+	s.cloudClient.versions = []image.Record{{Name: "latest", Properties: map[string]string{
+		"os_name": "myos", "os_revision": "10", "kernel_name": "otherkernel", "kernel_revision": "20",
+		"gadget_name": "mygadget", "gadget_revision": "30"}}}
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.createCalls[getCreateKey(s.options, 0)], check.Equals, 1)
+}
+
+func (s *runnerCreateSuite) TestExecCreatesImageIfRevisionsChanged(c *check.C) {
+	s.options.Release = "rolling"
+	s.cloudClient.versions = []image.Record{{Name: "latest", Properties: map[string]string{
+		"os_revision": "10", "kernel_revision": "19", "gadget_revision": "30"}}}
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.createCalls[getCreateKey(s.options, 0)], check.Equals, 1)
+	c.Assert(s.cloudClient.properties, check.Equals, "tool_version="+Version+","+testSnapProperties+","+testManifestProperty(c))
+}
+
+func (s *runnerCreateSuite) TestExecCreatesImageFromCheckedSnaps(c *check.C) {
+	s.options.Release = "rolling"
+	s.cloudClient.doVerNotFoundErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.snaps, check.DeepEquals, s.storeClient.snaps)
+	c.Assert(s.storeClient.getSnapsCalls[getFakeKey(s.options)], check.Equals, 1)
+}
+
+func (s *runnerCreateSuite) TestExecCreatesImageIfThereIsNoImageInCloud(c *check.C) {
+	s.options.Release = "rolling"
+	s.options.Properties = "property1=value1"
+	s.cloudClient.doVerNotFoundErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.createCalls[getCreateKey(s.options, 0)], check.Equals, 1)
+	c.Assert(s.cloudClient.properties, check.Equals,
+		"property1=value1,tool_version="+Version+","+testSnapProperties+","+testManifestProperty(c))
+	c.Assert(s.options.Properties, check.Equals, "property1=value1")
+}
+
+func (s *runnerCreateSuite) TestExecRecordsSIVersionFor1504(c *check.C) {
+	s.options.Properties = "property1=value1"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.properties, check.Equals,
+		fmt.Sprintf("property1=value1,tool_version=%s,si_version=%d,%s", Version, s.siClient.version, testManifestProperty(c)))
+}
+
+func (s *runnerCreateSuite) TestExecSignsManifestWithGivenKey(c *check.C) {
+	keyPath, _ := writeSecretKeyring(c, true)
+	defer os.Remove(keyPath)
+	s.options.ManifestKey = keyPath
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.properties, check.Matches, ".*,"+manifestSigProperty+"=.+")
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotUploadOnManifestKeyError(c *check.C) {
+	s.options.ManifestKey = "/non/existing/keyring"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(len(s.cloudClient.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsGetVersionsErrorForNon1504(c *check.C) {
+	s.options.Release = "rolling"
+	s.cloudClient.doVerErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cloudVersionsError)
+}
+
+func (s *runnerCreateSuite) TestExecLogsPlanOnDryRun(c *check.C) {
+	s.options.DryRun = true
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.planCalls[getCreateKey(s.options, s.siClient.version)], check.Equals, 1)
+	c.Assert(buf.String(), check.Matches, "(?s).*Would execute udf call.*Would execute convert call.*")
+	imageOptions := *s.options
+	c.Assert(strings.Contains(buf.String(), "Would upload image "+cloud.GetImageID(&imageOptions, s.siClient.version)), check.Equals, true)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotCreateImagesOnDryRun(c *check.C) {
+	s.options.DryRun = true
+
+	s.subject.Exec(s.options)
+
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+	c.Assert(len(s.cloudClient.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecChecksVersionsOnDryRun(c *check.C) {
+	s.options.DryRun = true
+	s.cloudClient.version = s.siClient.version
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrVersion{})
+	c.Assert(len(s.udfDriver.planCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecSmokeTestsImageBeforeUpload(c *check.C) {
+	s.options.SmokeTest = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.verifier.verifyCalls[s.udfDriver.path], check.Equals, 1)
+	c.Assert(len(s.cloudClient.createCalls), check.Equals, 1)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotUploadIfSmokeTestFails(c *check.C) {
+	s.options.SmokeTest = true
+	s.verifier.doErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, verifyError)
+	c.Assert(len(s.cloudClient.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecVerifiesSIFilesFor1504(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.siClient.verifyFilesCalls, check.Equals, 1)
+}
+
+func (s *runnerCreateSuite) TestExecCreatesFromMirrorOfVerifiedSIFilesFor1504(c *check.C) {
+	s.options.SIServer = "http://si.example.com"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.siServer, check.Equals, testMirrorURL)
+	c.Assert(s.siClient.mirror.closed, check.Equals, true)
+	c.Assert(s.options.SIServer, check.Equals, "http://si.example.com")
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotCreateIfSIFilesVerificationFails(c *check.C) {
+	s.siClient.doVerifyErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, siVerifyFilesError)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotVerifySIFilesForNon1504(c *check.C) {
+	s.options.Release = "rolling"
+
+	s.subject.Exec(s.options)
+
+	c.Assert(s.siClient.verifyFilesCalls, check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotVerifySIFilesOnDryRun(c *check.C) {
+	s.options.DryRun = true
+
+	s.subject.Exec(s.options)
+
+	c.Assert(s.siClient.verifyFilesCalls, check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotSmokeTestByDefault(c *check.C) {
+	s.subject.Exec(s.options)
+
+	c.Assert(len(s.verifier.verifyCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotSmokeTestOnDryRun(c *check.C) {
+	s.options.SmokeTest = true
+	s.options.DryRun = true
+
+	s.subject.Exec(s.options)
+
+	c.Assert(len(s.verifier.verifyCalls), check.Equals, 0)
+}
+
 func (s *runnerCleanupSuite) TestExecGetsCloudVersions(c *check.C) {
 	s.options.Release = "1504"
 	err := s.subject.Exec(s.options)
@@ -445,13 +1033,12 @@ func (s *runnerCreateSuite) TestExecDoesNotGetCloudVersionsOnNonCleanupAction(c
 	c.Assert(len(s.cloudClient.getVersionsCalls), check.Equals, 0)
 }
 
-func (s *runnerCleanupSuite) TestExecGetVersionsReceivesReleaseWithoutDots(c *check.C) {
+func (s *runnerCleanupSuite) TestExecDoesNotModifyRelease(c *check.C) {
 	s.options.Release = "15.04"
 	s.subject.Exec(s.options)
 
-	key := getFakeKey(s.options)
-	fmt.Println(s.cloudClient.getVersionsCalls)
-	c.Assert(s.cloudClient.getVersionsCalls[key], check.Equals, 1)
+	c.Assert(s.options.Release, check.Equals, "15.04")
+	c.Assert(s.cloudClient.getVersionsCalls[getFakeKey(s.options)], check.Equals, 1)
 }
 
 func (s *runnerCleanupSuite) TestExecReturnsGetVersionsError(c *check.C) {
@@ -465,25 +1052,29 @@ func (s *runnerCleanupSuite) TestExecReturnsGetVersionsError(c *check.C) {
 func (s *runnerCleanupSuite) TestExecCallsDeleteForExcedentImages(c *check.C) {
 	excedent := 2
 	base := 10
-	for i := imagesToKeep + excedent; i >= 0; i-- {
+	for i := testImagesToKeep + excedent; i >= 0; i-- {
 		s.cloudClient.versions = append(
 			s.cloudClient.versions,
-			cloud.GetImageID(s.options, i+base))
+			getRecord(s.options, i+base))
 	}
 
 	s.subject.Exec(s.options)
 
-	expectedCall := getDeleteKey(s.cloudClient.versions[imagesToKeep:])
+	var expectedIDs []string
+	for _, item := range s.cloudClient.versions[testImagesToKeep:] {
+		expectedIDs = append(expectedIDs, item.ID)
+	}
+	expectedCall := getDeleteKey(expectedIDs)
 
 	c.Assert(s.cloudClient.deleteCalls[expectedCall], check.Equals, 1)
 }
 
 func (s *runnerCleanupSuite) TestExecDoesNotCallDeleteWithouExcedentImages(c *check.C) {
 	base := 10
-	for i := imagesToKeep - 1; i >= 0; i-- {
+	for i := testImagesToKeep - 1; i >= 0; i-- {
 		s.cloudClient.versions = append(
 			s.cloudClient.versions,
-			cloud.GetImageID(s.options, i+base))
+			getRecord(s.options, i+base))
 	}
 
 	s.subject.Exec(s.options)
@@ -493,8 +1084,8 @@ func (s *runnerCleanupSuite) TestExecDoesNotCallDeleteWithouExcedentImages(c *ch
 
 func (s *runnerCleanupSuite) TestExecDoesNotCallDeleteOnGetVersionsError(c *check.C) {
 	s.cloudClient.doVerErr = true
-	for i := imagesToKeep + 1; i >= 0; i-- {
-		s.cloudClient.versions = append(s.cloudClient.versions, "version"+strconv.Itoa(i))
+	for i := testImagesToKeep + 1; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, image.Record{ID: "id" + strconv.Itoa(i), Name: "version" + strconv.Itoa(i)})
 	}
 
 	s.subject.Exec(s.options)
@@ -504,8 +1095,8 @@ func (s *runnerCleanupSuite) TestExecDoesNotCallDeleteOnGetVersionsError(c *chec
 
 func (s *runnerCleanupSuite) TestExecReturnsDeleteError(c *check.C) {
 	s.cloudClient.doDeleteErr = true
-	for i := imagesToKeep + 1; i >= 0; i-- {
-		s.cloudClient.versions = append(s.cloudClient.versions, "version"+strconv.Itoa(i))
+	for i := testImagesToKeep + 1; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, image.Record{ID: "id" + strconv.Itoa(i), Name: "version" + strconv.Itoa(i)})
 	}
 
 	err := s.subject.Exec(s.options)
@@ -514,6 +1105,95 @@ func (s *runnerCleanupSuite) TestExecReturnsDeleteError(c *check.C) {
 	c.Assert(err.Error(), check.Equals, cloudDeleteError)
 }
 
+func (s *runnerCleanupSuite) TestExecHonoursKeepOption(c *check.C) {
+	s.options.Keep = 1
+	for i := 3; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, getRecord(s.options, i))
+	}
+
+	s.subject.Exec(s.options)
+
+	expectedCall := getDeleteKey([]string{"id-2", "id-1", "id-0"})
+	c.Assert(s.cloudClient.deleteCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *runnerCleanupSuite) TestExecRejectsNegativeKeep(c *check.C) {
+	s.options.Keep = -1
+	for i := 3; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, getRecord(s.options, i))
+	}
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &flags.ErrFlagValue{})
+	c.Assert(s.cloudClient.deleteCalls, check.HasLen, 0)
+}
+
+func (s *runnerCleanupSuite) TestExecKeepsPinnedAndInUseImages(c *check.C) {
+	for i := testImagesToKeep + 2; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, getRecord(s.options, i))
+	}
+	s.cloudClient.versions[testImagesToKeep].Tags = []string{"sometag", PinnedTag}
+	s.cloudClient.inUse = []string{s.cloudClient.versions[testImagesToKeep+1].ID}
+
+	s.subject.Exec(s.options)
+
+	c.Assert(s.cloudClient.inUseCalls, check.Equals, 1)
+	expectedCall := getDeleteKey([]string{s.cloudClient.versions[testImagesToKeep+2].ID})
+	c.Assert(s.cloudClient.deleteCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *runnerCleanupSuite) TestExecReturnsGetImagesInUseError(c *check.C) {
+	s.cloudClient.doInUseErr = true
+	for i := testImagesToKeep + 1; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, getRecord(s.options, i))
+	}
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cloudInUseError)
+	c.Assert(len(s.cloudClient.deleteCalls), check.Equals, 0)
+}
+
+func (s *runnerCleanupSuite) TestExecDoesNotCallDeleteOnDryRun(c *check.C) {
+	s.options.DryRun = true
+	for i := testImagesToKeep + 1; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, getRecord(s.options, i))
+	}
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(s.cloudClient.deleteCalls), check.Equals, 0)
+}
+
+func (s *runnerCleanupSuite) TestExecUsesRetentionConfig(c *check.C) {
+	configFile, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(configFile.Name())
+	configFile.WriteString("- release: 15.04\n  arch: amd64\n  keep: 1\n")
+	configFile.Close()
+	s.options.RetentionConfig = configFile.Name()
+	for i := 2; i >= 0; i-- {
+		s.cloudClient.versions = append(s.cloudClient.versions, getRecord(s.options, i))
+	}
+
+	s.subject.Exec(s.options)
+
+	expectedCall := getDeleteKey([]string{"id-1", "id-0"})
+	c.Assert(s.cloudClient.deleteCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *runnerCleanupSuite) TestExecReturnsRetentionConfigError(c *check.C) {
+	s.options.RetentionConfig = "/non/existing/file"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(len(s.cloudClient.getVersionsCalls), check.Equals, 0)
+}
+
 func (s *runnerPurgeSuite) TestExecCallsPurge(c *check.C) {
 	s.subject.Exec(s.options)
 
@@ -537,6 +1217,113 @@ func (s *runnerPurgeSuite) TestExecReturnsPurgeError(c *check.C) {
 	c.Assert(err.Error(), check.Equals, cloudPurgeError)
 }
 
+func (s *runnerPurgeSuite) TestExecDoesNotCallPurgeOnDryRun(c *check.C) {
+	s.options.DryRun = true
+	s.cloudClient.list = []image.Record{getRecord(s.options, 1), getRecord(s.options, 2)}
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.purgeCalls, check.Equals, 0)
+	c.Assert(s.cloudClient.listCalls, check.Equals, 1)
+}
+
+func (s *runnerPurgeSuite) TestExecReturnsListErrorOnDryRun(c *check.C) {
+	s.options.DryRun = true
+	s.cloudClient.doListErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cloudListError)
+}
+
+func (s *runnerMatrixSuite) TestExecCreatesImageForEachSpec(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.createCalls, check.DeepEquals, map[string]int{
+		"rolling - edge - amd64 - 0": 1,
+		"rolling - edge - i386 - 0":  1,
+		"16.04 - edge - armhf - 0":   1,
+	})
+	c.Assert(s.cloudClient.createCalls, check.HasLen, 3)
+}
+
+func (s *runnerMatrixSuite) TestExecContinuesAfterFailedSpec(c *check.C) {
+	s.udfDriver.failArch = "i386"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrMatrix{})
+	c.Assert(err.Error(), check.Equals, "error action failed for 1 of 3 image specs: "+
+		"release rolling, channel edge, arch i386, image type custom: "+udfCreateError)
+	c.Assert(s.udfDriver.createCalls, check.HasLen, 3)
+	c.Assert(s.cloudClient.createCalls, check.HasLen, 2)
+}
+
+func (s *runnerMatrixSuite) TestExecSkipsUpToDateSpecs(c *check.C) {
+	path := writeTempFile(c, "- arch: amd64\n- arch: i386\n- release: 15.04\n")
+	defer os.Remove(path)
+	s.options.Matrix = path
+	s.siClient.version = 100
+	s.cloudClient.version = 100
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.createCalls, check.HasLen, 2)
+	c.Assert(s.cloudClient.createCalls, check.HasLen, 2)
+}
+
+func (s *runnerMatrixSuite) TestExecDoesNotReportUpToDateSpecsAsFailed(c *check.C) {
+	path := writeTempFile(c, "- arch: amd64\n- arch: i386\n- release: 15.04\n")
+	defer os.Remove(path)
+	s.options.Matrix = path
+	s.udfDriver.failArch = "i386"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrMatrix{})
+	c.Assert(err.Error(), check.Equals, "error action failed for 1 of 3 image specs: "+
+		"release rolling, channel edge, arch i386, image type custom: "+udfCreateError)
+}
+
+func (s *runnerMatrixSuite) TestExecBuildsConcurrentlyUpToJobsLimit(c *check.C) {
+	s.udfDriver.delay = 50 * time.Millisecond
+	for _, jobs := range []int{1, 2} {
+		s.udfDriver.maxRunning = 0
+		s.options.Jobs = jobs
+
+		err := s.subject.Exec(s.options)
+
+		c.Check(err, check.IsNil)
+		c.Check(s.udfDriver.maxRunning, check.Equals, jobs)
+	}
+}
+
+func (s *runnerMatrixSuite) TestExecReportsAllFailedSpecs(c *check.C) {
+	s.options.Jobs = 3
+	s.cloudClient.doCreateErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrMatrix{})
+	c.Assert(err.Error(), check.Equals, "error action failed for 3 of 3 image specs: "+
+		"release rolling, channel edge, arch amd64, image type custom: "+cloudCreateError+"; "+
+		"release rolling, channel edge, arch i386, image type custom: "+cloudCreateError+"; "+
+		"release 16.04, channel edge, arch armhf, image type custom: "+cloudCreateError)
+}
+
+func (s *runnerMatrixSuite) TestExecReturnsMatrixConfigError(c *check.C) {
+	s.options.Matrix = "/non/existing/file"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(s.udfDriver.createCalls, check.HasLen, 0)
+}
+
 func getFakeKey(options *flags.Options) string {
 	return fmt.Sprintf("%s - %s - %s", options.Release, options.OSChannel, options.Arch)
 }
@@ -549,6 +1336,10 @@ func getFullCreateKey(path string, options *flags.Options, ver int) string {
 	return fmt.Sprintf("%s - %s", path, getCreateKey(options, ver))
 }
 
-func getDeleteKey(versions []string) string {
-	return strings.Join(versions, " ")
+func getDeleteKey(ids []string) string {
+	return strings.Join(ids, " ")
+}
+
+func getRecord(options *flags.Options, ver int) image.Record {
+	return image.Record{ID: fmt.Sprintf("id-%d", ver), Name: cloud.GetImageID(options, ver)}
 }
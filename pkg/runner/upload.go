@@ -0,0 +1,204 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+var (
+	// uploadBackoff is the wait before the first upload retry, it doubles on
+	// each subsequent retry
+	uploadBackoff = 30 * time.Second
+	sleep         = time.Sleep
+)
+
+// ErrNoFile is the type of the error returned by Exec when the upload action
+// is requested without an image file
+type ErrNoFile struct{}
+
+func (e *ErrNoFile) Error() string {
+	return "error no image file given for the upload action, use -file"
+}
+
+// ErrNoSIVersion is the type of the error returned by Exec when the system-image
+// version of a 15.04 image file to be uploaded is unknown
+type ErrNoSIVersion struct {
+	path string
+}
+
+func (e *ErrNoSIVersion) Error() string {
+	return fmt.Sprintf("error unknown system-image version of %s, use -si-version or keep the manifest written by the build action next to it", e.path)
+}
+
+// upload sends the image file to the cloud, retrying up to options.UploadRetries
+// times with exponential backoff. The cloud client removes the image left by a
+// failed attempt before retrying
+func (r *Runner) upload(path string, options *flags.Options, version int) (err error) {
+	backoff := uploadBackoff
+	for attempt := 0; ; attempt++ {
+		log.Infof("Uploading %s", path)
+		if err = r.imgDataTarget.Create(path, options, version); err == nil {
+			return
+		}
+		log.Errorf("Upload attempt %d of %s failed: %s", attempt+1, path, err)
+		if attempt >= options.UploadRetries {
+			return
+		}
+		log.Infof("Retrying upload in %s", backoff)
+		sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// uploadFile sends an existing image file to the cloud, files in a format other
+// than the requested one are converted before
+func (r *Runner) uploadFile(options *flags.Options) (err error) {
+	if options.File == "" {
+		return &ErrNoFile{}
+	}
+	target, err := image.FormatFor(options)
+	if err != nil {
+		return
+	}
+	if _, err = image.ArchFor(options); err != nil {
+		return
+	}
+	if _, err = os.Stat(options.File); err != nil {
+		return
+	}
+	format, err := r.imgDriver.DetectFormat(options.File)
+	if err != nil {
+		return
+	}
+	if !image.IsQemuFormat(format) {
+		return &ErrImageFormat{path: options.File, format: format}
+	}
+	convert := format != target.QemuFormat
+	manifest, err := readManifest(options.File + manifestSuffix)
+	if err != nil {
+		return
+	}
+	var version int
+	provenance := toolVersionProperty + "=" + Version
+	if options.Release == "15.04" {
+		if version, err = fileSIVersion(options, manifest); err != nil {
+			return
+		}
+		provenance = provenanceProperties(nil, version)
+	}
+	if manifest != nil {
+		// the build action recorded the provenance of the image in its properties
+		var properties string
+		if properties, err = manifestProperties(manifest, options.ManifestKey); err != nil {
+			return
+		}
+		provenance = joinProperties(manifest.Properties, properties)
+	}
+	imageOptions := *options
+	imageOptions.Properties = joinProperties(options.Properties, provenance)
+	options = &imageOptions
+	if err = cloud.CheckProperties(options.Properties); err != nil {
+		return
+	}
+
+	if options.DryRun {
+		if convert {
+			log.Infof("Would convert %s from %s to %s format", options.File, format, target.Name)
+		}
+		if options.SmokeTest {
+			log.Info("Would boot the image with QEMU before uploading it")
+		}
+		log.Infof("Would upload %s as image %s with properties %s", options.File,
+			cloud.GetImageID(options, version), options.Properties)
+		return
+	}
+	path := options.File
+	if convert {
+		var tmpDir string
+		path, tmpDir, err = r.imgDriver.Convert(options, options.File)
+		defer removeImageFile(path, tmpDir, options)
+		if err != nil {
+			return
+		}
+	}
+	if err = r.verify(path, options); err != nil {
+		return
+	}
+	return r.upload(path, options, version)
+}
+
+// removeImageFile removes the temporary directory of the created image file
+// unless it was requested to keep the file
+func removeImageFile(path, tmpDir string, options *flags.Options) {
+	if options.KeepImage && path != "" {
+		log.Infof("Keeping image file %s, it can be uploaded with -action upload -file %s", path, path)
+		return
+	}
+	removeTmpDir(tmpDir)
+}
+
+// removeTmpDir removes the temporary directory of a driver and all its contents
+func removeTmpDir(tmpDir string) {
+	if tmpDir == "" {
+		return
+	}
+	if err := os.RemoveAll(tmpDir); err != nil {
+		log.Warnf("Error removing temporary directory %s: %s", tmpDir, err)
+	}
+}
+
+// readManifest returns the manifest written by the build action at path, or nil
+// if there is none
+func readManifest(path string) (*image.Manifest, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest image.Manifest
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// fileSIVersion returns the system-image version of the 15.04 image file to be
+// uploaded, the one given with -si-version or else the one recorded in its manifest
+func fileSIVersion(options *flags.Options, manifest *image.Manifest) (int, error) {
+	if options.SIVersion != 0 {
+		return options.SIVersion, nil
+	}
+	if manifest == nil || manifest.SIVersion == 0 {
+		return 0, &ErrNoSIVersion{path: options.File}
+	}
+	return manifest.SIVersion, nil
+}
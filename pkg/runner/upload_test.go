@@ -0,0 +1,437 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+)
+
+var _ = check.Suite(&runnerUploadSuite{})
+
+type runnerUploadSuite struct {
+	subject     *Runner
+	options     *flags.Options
+	siClient    *fakeSiClient
+	cloudClient *fakeCloudClient
+	udfDriver   *fakeImgDriver
+	verifier    *fakeVerifier
+	file        string
+	sleeps      []time.Duration
+	backSleep   func(time.Duration)
+}
+
+func (s *runnerUploadSuite) SetUpSuite(c *check.C) {
+	s.siClient = &fakeSiClient{}
+	s.cloudClient = &fakeCloudClient{}
+	s.udfDriver = &fakeImgDriver{}
+	s.verifier = &fakeVerifier{}
+	s.subject = NewRunner(s.siClient, s.cloudClient, s.udfDriver,
+		&fakeStoreClient{getSnapsCalls: make(map[string]int)}, s.verifier)
+	s.backSleep = sleep
+	sleep = func(d time.Duration) { s.sleeps = append(s.sleeps, d) }
+}
+
+func (s *runnerUploadSuite) TearDownSuite(c *check.C) {
+	sleep = s.backSleep
+}
+
+func (s *runnerUploadSuite) SetUpTest(c *check.C) {
+	s.siClient.getVersionCalls = make(map[string]int)
+	s.siClient.version = 2
+	s.cloudClient.createCalls = make(map[string]int)
+	s.cloudClient.getVersionsCalls = make(map[string]int)
+	s.cloudClient.doCreateErr = false
+	s.cloudClient.doDeleteErr = false
+	s.cloudClient.totalCreateCalls = 0
+	s.cloudClient.failingCreateCalls = 0
+	s.udfDriver.createCalls = make(map[string]int)
+	s.udfDriver.convertCalls = make(map[string]int)
+	s.udfDriver.format = "qcow2"
+	s.udfDriver.doErr = false
+	s.udfDriver.doFormatErr = false
+	s.cloudClient.properties = ""
+	s.verifier.verifyCalls = make(map[string]int)
+	s.verifier.doErr = false
+	s.sleeps = nil
+
+	file, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	file.Close()
+	s.file = file.Name()
+	s.udfDriver.path = s.file
+
+	s.udfDriver.tmpDir = ""
+	s.udfDriver.convertDir = writeTmpDir(c)
+	s.udfDriver.convertPath = filepath.Join(s.udfDriver.convertDir, "udf.img")
+
+	s.options = &flags.Options{
+		Action:        "upload",
+		Release:       "rolling",
+		OSChannel:     "edge",
+		KernelChannel: "edge",
+		GadgetChannel: "edge",
+		Arch:          "amd64",
+		File:          s.file,
+		UploadRetries: 3}
+}
+
+func (s *runnerUploadSuite) TearDownTest(c *check.C) {
+	os.Remove(s.file)
+	os.RemoveAll(s.udfDriver.convertDir)
+}
+
+func (s *runnerUploadSuite) TestUploadRetriesWithExponentialBackoff(c *check.C) {
+	s.cloudClient.failingCreateCalls = 2
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 3)
+	c.Assert(s.sleeps, check.DeepEquals, []time.Duration{uploadBackoff, 2 * uploadBackoff})
+}
+
+func (s *runnerUploadSuite) TestUploadReturnsErrorAfterRetries(c *check.C) {
+	s.cloudClient.doCreateErr = true
+	s.options.UploadRetries = 2
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cloudCreateError)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 3)
+	c.Assert(s.sleeps, check.HasLen, 2)
+}
+
+func (s *runnerUploadSuite) TestUploadActionUploadsFile(c *check.C) {
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.createCalls[getFullCreateKey(s.file, s.options, 0)], check.Equals, 1)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+	_, err = os.Stat(s.file)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *runnerUploadSuite) TestUploadActionConvertsRawFiles(c *check.C) {
+	s.udfDriver.format = "raw"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.convertCalls[s.file], check.Equals, 1)
+	c.Assert(s.cloudClient.createCalls[getFullCreateKey(s.udfDriver.convertPath, s.options, 0)], check.Equals, 1)
+}
+
+func (s *runnerUploadSuite) TestUploadActionRemovesConvertedFile(c *check.C) {
+	s.udfDriver.format = "raw"
+
+	s.subject.Exec(s.options)
+
+	_, err := os.Stat(s.udfDriver.convertDir)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(s.file)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *runnerUploadSuite) TestUploadActionRemovesTmpDirOfConvertedFileOnError(c *check.C) {
+	s.udfDriver.format = "raw"
+	s.cloudClient.doCreateErr = true
+	s.options.UploadRetries = 0
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.NotNil)
+	_, err = os.Stat(s.udfDriver.convertDir)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerUploadSuite) TestUploadActionDoesNotConvertQCOW2Files(c *check.C) {
+	s.subject.Exec(s.options)
+
+	c.Assert(len(s.udfDriver.convertCalls), check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionConvertsToRequestedFormat(c *check.C) {
+	s.options.ImageFormat = "vhd"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.convertCalls[s.file], check.Equals, 1)
+	c.Assert(s.cloudClient.createCalls[getFullCreateKey(s.udfDriver.convertPath, s.options, 0)], check.Equals, 1)
+}
+
+func (s *runnerUploadSuite) TestUploadActionDoesNotConvertFilesInRequestedFormat(c *check.C) {
+	s.options.ImageFormat = "vhd"
+	s.udfDriver.format = "vpc"
+
+	s.subject.Exec(s.options)
+
+	c.Assert(len(s.udfDriver.convertCalls), check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsUnknownImageFormatError(c *check.C) {
+	s.options.ImageFormat = "iso"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &image.ErrUnknownFormat{})
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsConvertError(c *check.C) {
+	s.udfDriver.format = "raw"
+	s.udfDriver.doErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, convertError)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsDetectFormatError(c *check.C) {
+	s.udfDriver.doFormatErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, detectFormatError)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsErrImageFormat(c *check.C) {
+	s.udfDriver.format = "iso"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrImageFormat{})
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionSetsProperties(c *check.C) {
+	s.options.Properties = "property1=value1"
+
+	s.subject.Exec(s.options)
+
+	c.Assert(s.cloudClient.properties, check.Equals, "property1=value1,tool_version="+Version)
+}
+
+func (s *runnerUploadSuite) TestUploadActionSetsSIVersionPropertyFor1504(c *check.C) {
+	s.options.Release = "15.04"
+	s.options.SIVersion = 2
+
+	s.subject.Exec(s.options)
+
+	c.Assert(s.cloudClient.properties, check.Equals, "tool_version="+Version+",si_version=2")
+}
+
+func (s *runnerUploadSuite) TestUploadActionUsesGivenSIVersionFor1504(c *check.C) {
+	s.options.Release = "15.04"
+	s.options.SIVersion = 5
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.siClient.getVersionCalls[getFakeKey(s.options)], check.Equals, 0)
+	c.Assert(s.cloudClient.createCalls[getFullCreateKey(s.file, s.options, 5)], check.Equals, 1)
+}
+
+func (s *runnerUploadSuite) TestUploadActionUsesManifestSIVersionFor1504(c *check.C) {
+	s.options.Release = "15.04"
+	manifestPath := s.file + manifestSuffix
+	err := ioutil.WriteFile(manifestPath, []byte(`{"release": "15.04", "si_version": 7, "properties": "tool_version=1.0,si_version=7"}`), 0644)
+	c.Assert(err, check.IsNil)
+	defer os.Remove(manifestPath)
+
+	err = s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.siClient.getVersionCalls[getFakeKey(s.options)], check.Equals, 0)
+	c.Assert(s.cloudClient.createCalls[getFullCreateKey(s.file, s.options, 7)], check.Equals, 1)
+	c.Assert(s.cloudClient.properties, check.Matches, "tool_version=1.0,si_version=7,manifest=.*")
+}
+
+func (s *runnerUploadSuite) TestUploadActionUsesManifestPropertiesAndAttachesManifest(c *check.C) {
+	s.options.Properties = "property1=value1"
+	manifest := *testManifest
+	manifest.Properties = "property0=value0,tool_version=1.0," + testSnapProperties
+	writeTestManifest(c, s.file+manifestSuffix, &manifest)
+	defer os.Remove(s.file + manifestSuffix)
+	expected, err := manifestProperties(&manifest, "")
+	c.Assert(err, check.IsNil)
+
+	err = s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.properties, check.Equals, "property1=value1,"+manifest.Properties+","+expected)
+}
+
+func (s *runnerUploadSuite) TestUploadActionDoesNotRetryReservedProperties(c *check.C) {
+	s.options.Properties = "name=myimage"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &cloud.ErrReservedProperty{})
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+	c.Assert(s.sleeps, check.HasLen, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionChecksManifestProperties(c *check.C) {
+	manifest := *testManifest
+	manifest.Properties = "visibility=public"
+	writeTestManifest(c, s.file+manifestSuffix, &manifest)
+	defer os.Remove(s.file + manifestSuffix)
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &cloud.ErrReservedProperty{})
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsErrNoSIVersionFor1504(c *check.C) {
+	s.options.Release = "15.04"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoSIVersion{})
+	c.Assert(s.siClient.getVersionCalls[getFakeKey(s.options)], check.Equals, 0)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsErrNoSIVersionForManifestsWithoutIt(c *check.C) {
+	s.options.Release = "15.04"
+	manifestPath := s.file + manifestSuffix
+	err := ioutil.WriteFile(manifestPath, []byte(`{"release": "15.04"}`), 0644)
+	c.Assert(err, check.IsNil)
+	defer os.Remove(manifestPath)
+
+	err = s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoSIVersion{})
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsErrNoFile(c *check.C) {
+	s.options.File = ""
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoFile{})
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionReturnsMissingFileError(c *check.C) {
+	s.options.File = "/non/existing/file"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestUploadActionDoesNotUploadOnDryRun(c *check.C) {
+	s.options.DryRun = true
+	s.udfDriver.format = "raw"
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+	c.Assert(len(s.udfDriver.convertCalls), check.Equals, 0)
+}
+
+func (s *runnerUploadSuite) TestCreateKeepsImageFileIfRequested(c *check.C) {
+	s.options.Action = "create"
+	s.options.KeepImage = true
+	s.cloudClient.doVerNotFoundErr = true
+	defer func() { s.cloudClient.doVerNotFoundErr = false }()
+	s.cloudClient.versions = []image.Record{}
+	s.udfDriver.tmpDir = writeTmpDir(c)
+	defer os.RemoveAll(s.udfDriver.tmpDir)
+	s.udfDriver.path = filepath.Join(s.udfDriver.tmpDir, "udf.img")
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(s.udfDriver.path)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *runnerUploadSuite) TestCreateWritesManifestOfKeptImageFile(c *check.C) {
+	s.options.Action = "create"
+	s.options.KeepImage = true
+	s.cloudClient.doVerNotFoundErr = true
+	defer func() { s.cloudClient.doVerNotFoundErr = false }()
+	s.cloudClient.versions = []image.Record{}
+	defer os.Remove(s.file + manifestSuffix)
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	created := s.cloudClient.properties
+	manifest, err := readManifest(s.file + manifestSuffix)
+	c.Assert(err, check.IsNil)
+	c.Assert(manifest, check.NotNil)
+	c.Assert(manifest.Image, check.Equals, filepath.Base(s.file))
+	c.Assert(manifest.Tools, check.DeepEquals, testManifest.Tools)
+
+	s.options.Action = "upload"
+	s.options.KeepImage = false
+	err = s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.SplitN(s.cloudClient.properties, ",manifest=", 2)[0], check.Equals,
+		strings.SplitN(created, ",manifest=", 2)[0])
+}
+
+// writeTestManifest stores manifest as the build action does
+func writeTestManifest(c *check.C, path string, manifest *image.Manifest) {
+	content, err := json.Marshal(manifest)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(path, content, 0644), check.IsNil)
+}
+
+func (s *runnerUploadSuite) TestUploadActionSmokeTestsConvertedFile(c *check.C) {
+	s.udfDriver.format = "raw"
+	s.options.SmokeTest = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.verifier.verifyCalls[s.udfDriver.convertPath], check.Equals, 1)
+}
+
+func (s *runnerUploadSuite) TestUploadActionDoesNotUploadIfSmokeTestFails(c *check.C) {
+	s.options.SmokeTest = true
+	s.verifier.doErr = true
+
+	err := s.subject.Exec(s.options)
+
+	c.Assert(err.Error(), check.Equals, verifyError)
+	c.Assert(s.cloudClient.totalCreateCalls, check.Equals, 0)
+}
@@ -0,0 +1,100 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package si
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+// mirror is a local HTTP server that serves the verified index and files of a
+// system-image version from a temporary directory. The rest of the requests,
+// like the ones of the keyrings and signatures, are passed to the server
+type mirror struct {
+	server     string
+	httpClient web.Getter
+	dir        string
+	files      map[string]string
+	listener   net.Listener
+}
+
+func newMirror(server string, httpClient web.Getter) (*mirror, error) {
+	dir, err := ioutil.TempDir("", "si-mirror")
+	if err != nil {
+		return nil, err
+	}
+	return &mirror{server: server, httpClient: httpClient, dir: dir, files: make(map[string]string)}, nil
+}
+
+// add stores the given content to be served at path
+func (m *mirror) add(path string, content []byte) error {
+	local := filepath.Join(m.dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(local, content, 0644); err != nil {
+		return err
+	}
+	m.files[path] = local
+	return nil
+}
+
+// start listens on a free port of the loopback interface
+func (m *mirror) start() (err error) {
+	if m.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return
+	}
+	go http.Serve(m.listener, m)
+	return
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if local, ok := m.files[r.URL.Path]; ok {
+		http.ServeFile(w, r, local)
+		return
+	}
+	log.Debugf("Passing request of %s to the system-image server", r.URL.Path)
+	content, err := m.httpClient.Get(m.server + r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Write(content)
+}
+
+// URL returns the base URL of the mirror
+func (m *mirror) URL() string {
+	return "http://" + m.listener.Addr().String()
+}
+
+// Close stops the mirror and removes its files
+func (m *mirror) Close() error {
+	if m.listener != nil {
+		m.listener.Close()
+	}
+	return os.RemoveAll(m.dir)
+}
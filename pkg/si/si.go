@@ -21,18 +21,58 @@
 package si
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
 
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
 )
 
 const (
-	baseURL      = "http://system-image.ubuntu.com/ubuntu-core"
-	dataFileName = "index.json"
+	defaultServer        = "http://system-image.ubuntu.com"
+	defaultChannelPrefix = "ubuntu-core"
+	devicePattern        = "generic_%s"
+	dataFileName         = "index.json"
 )
 
+// ErrVersionNotInIndex is the type of the error returned by VerifyFiles when
+// the index has no full image with the requested version
+type ErrVersionNotInIndex struct {
+	version int
+}
+
+func (e *ErrVersionNotInIndex) Error() string {
+	return fmt.Sprintf("error no full image with version %d in the system-image index", e.version)
+}
+
+// ErrChecksum is the type of the error returned by VerifyFiles when the sha256
+// of a file doesn't match the one in the index
+type ErrChecksum struct {
+	path, expected, actual string
+}
+
+func (e *ErrChecksum) Error() string {
+	return fmt.Sprintf("error checksum %s of system-image file %s doesn't match %s", e.actual, e.path, e.expected)
+}
+
+// ErrSignature is the type of the error returned by VerifyFiles when the GPG
+// signature of a file can't be verified with the given keyring
+type ErrSignature struct {
+	path, msg string
+}
+
+func (e *ErrSignature) Error() string {
+	return fmt.Sprintf("error verifying signature of system-image file %s: %s", e.path, e.msg)
+}
+
 // Client is the default implementation of Driver
 type Client struct {
 	httpClient web.Getter
@@ -43,62 +83,252 @@ func NewClient(httpClient web.Getter) *Client {
 	return &Client{httpClient}
 }
 
-type response struct {
-	Global interface{}
-	Images images
+// Index is the index of a system-image channel
+type Index struct {
+	Global map[string]interface{} `json:"global"`
+	Images []Image                `json:"images"`
 }
 
-type images []image
-
-type image struct {
-	Description   string
-	Type          string
-	Version       int
+// Image is an entry of the index, either a full image or a delta from the
+// version given in Base
+type Image struct {
+	Description   string `json:"description"`
+	Type          string `json:"type"`
+	Version       int    `json:"version"`
 	VersionDetail string `json:"version_detail"`
-	Files         files
+	Base          int    `json:"base,omitempty"`
+	Files         []File `json:"files"`
+}
+
+// File is one of the files of an image
+type File struct {
+	Checksum  string `json:"checksum"`
+	Order     int    `json:"order"`
+	Path      string `json:"path"`
+	Signature string `json:"signature"`
+	Size      int64  `json:"size"`
+}
+
+// Latest holds the latest full image of a channel and the chain of deltas
+// that update it to the newest version, if any
+type Latest struct {
+	Full   Image
+	Deltas []Image
+}
+
+// ErrNoFullImage is the type of the error returned when the index of a channel
+// is empty or only has deltas
+type ErrNoFullImage struct {
+	url string
+}
+
+func (e *ErrNoFullImage) Error() string {
+	return fmt.Sprintf("error no full image in the system-image index %s", e.url)
 }
 
-type files []file
+// Size returns the sum of the sizes of the files of the image
+func (i *Image) Size() (size int64) {
+	for _, item := range i.Files {
+		size += item.Size
+	}
+	return
+}
+
+// Version returns the newest version of the channel, the one of the last delta
+// or of the full image if there are no deltas
+func (l *Latest) Version() int {
+	if len(l.Deltas) == 0 {
+		return l.Full.Version
+	}
+	return l.Deltas[len(l.Deltas)-1].Version
+}
+
+// latestFull returns the full image with the highest version, nil if there is none
+func (i *Index) latestFull() *Image {
+	var latest *Image
+	for j := range i.Images {
+		if i.Images[j].Type == "full" && (latest == nil || i.Images[j].Version > latest.Version) {
+			latest = &i.Images[j]
+		}
+	}
+	return latest
+}
+
+// deltasFrom returns the chain of deltas starting at the given version, taking
+// from each version the delta to the highest one
+func (i *Index) deltasFrom(version int) (deltas []Image) {
+	for {
+		var next *Image
+		for j := range i.Images {
+			item := &i.Images[j]
+			if item.Type == "delta" && item.Base == version && item.Version > version &&
+				(next == nil || item.Version > next.Version) {
+				next = item
+			}
+		}
+		if next == nil {
+			return
+		}
+		deltas = append(deltas, *next)
+		version = next.Version
+	}
+}
 
-type file struct {
-	CheckSum  string
-	Order     int
-	Path      string
-	Signature string
-	Size      int
+// GetLatest returns the latest full image from the system image server for the
+// given release, channel and arch and the deltas published after it
+func (c *Client) GetLatest(options *flags.Options) (*Latest, error) {
+	url, err := generateURL(options)
+	if err != nil {
+		return nil, err
+	}
+	index, err := c.getIndex(url)
+	if err != nil {
+		return nil, err
+	}
+	full := index.latestFull()
+	if full == nil {
+		return nil, &ErrNoFullImage{url: url}
+	}
+	return &Latest{Full: *full, Deltas: index.deltasFrom(full.Version)}, nil
 }
 
-// GetLatestVersion returns the highest version from the system image server for the given
-// release, channel and arch, or an error in case something goes wrong
+// GetLatestVersion returns the version of the latest full image from the system image
+// server for the given release, channel and arch, or an error in case something goes wrong
 func (c *Client) GetLatestVersion(options *flags.Options) (ver int, err error) {
-	url := generateURL(options)
+	latest, err := c.GetLatest(options)
+	if err != nil {
+		return
+	}
+	log.Debugf("Latest full system-image version %d (%s)", latest.Full.Version, latest.Full.VersionDetail)
+	if len(latest.Deltas) > 0 {
+		log.Infof("System-image version %d has %d deltas up to version %d, using the full image", latest.Full.Version, len(latest.Deltas), latest.Version())
+	}
+	return latest.Full.Version, nil
+}
+
+// VerifyFiles downloads the files of the full image with the given version and
+// checks them against the checksums of the index. If options.SIKeyring is given
+// their GPG signatures are verified with the keys in it. The returned mirror
+// serves the index and the verified files, so that they are the ones used for
+// building the image
+func (c *Client) VerifyFiles(options *flags.Options, version int) (mirror image.SIMirror, err error) {
+	url, err := generateURL(options)
+	if err != nil {
+		return
+	}
 	content, err := c.httpClient.Get(url)
 	if err != nil {
 		return
 	}
-	var res response
-	err = json.Unmarshal(content, &res)
+	index, err := parseIndex(content)
+	if err != nil {
+		return
+	}
+	var target *Image
+	for i := range index.Images {
+		if index.Images[i].Type == "full" && index.Images[i].Version == version {
+			target = &index.Images[i]
+		}
+	}
+	if target == nil {
+		return nil, &ErrVersionNotInIndex{version: version}
+	}
+	var keyring openpgp.EntityList
+	if options.SIKeyring == "" {
+		log.Warn("No system-image keyring given, the signatures of the files are not verified")
+	} else if keyring, err = image.ReadKeyring(options.SIKeyring); err != nil {
+		return
+	}
+	server := serverURL(options)
+	m, err := newMirror(server, c.httpClient)
 	if err != nil {
 		return
 	}
+	if err = m.add(strings.TrimPrefix(url, server), content); err != nil {
+		m.Close()
+		return
+	}
+	for _, item := range target.Files {
+		if err = c.verifyFile(server, item, keyring, m); err != nil {
+			m.Close()
+			return
+		}
+		log.Debugf("Verified system-image file %s", item.Path)
+	}
+	if err = m.start(); err != nil {
+		m.Close()
+		return
+	}
+	return m, nil
+}
 
-	index := len(res.Images) - 1
-	if index >= 0 {
-		for {
-			if res.Images[index].Type == "full" {
-				break
-			}
-			index--
+// verifyFile downloads the given file and checks it, verified files are added
+// to the mirror
+func (c *Client) verifyFile(server string, item File, keyring openpgp.EntityList, m *mirror) error {
+	content, err := c.httpClient.Get(server + item.Path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	if actual := hex.EncodeToString(sum[:]); actual != item.Checksum {
+		return &ErrChecksum{path: item.Path, expected: item.Checksum, actual: actual}
+	}
+	if keyring != nil {
+		signature, err := c.httpClient.Get(server + item.Signature)
+		if err != nil {
+			return err
+		}
+		if _, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(signature)); err != nil {
+			return &ErrSignature{path: item.Path, msg: err.Error()}
+		}
+		if err = m.add(item.Signature, signature); err != nil {
+			return err
 		}
-		ver = res.Images[index].Version
 	}
-	return
+	return m.add(item.Path, content)
 }
 
-func generateURL(options *flags.Options) string {
-	if options.Arch == "arm" {
-		options.Arch += "hf"
+func (c *Client) getIndex(url string) (*Index, error) {
+	content, err := c.httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	return parseIndex(content)
+}
+
+func parseIndex(content []byte) (*Index, error) {
+	var index Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// serverURL returns the system-image server given in options, the official one
+// by default
+func serverURL(options *flags.Options) string {
+	if options.SIServer == "" {
+		return defaultServer
+	}
+	return strings.TrimRight(options.SIServer, "/")
+}
+
+// generateURL returns the URL of the index of the channel given in options, which
+// is <server>/<channel prefix>/<release>/<channel>/<device>/index.json. The device
+// defaults to the generic one of the arch
+func generateURL(options *flags.Options) (string, error) {
+	device := options.SIDevice
+	if device == "" {
+		arch, err := image.ArchFor(options)
+		if err != nil {
+			return "", err
+		}
+		device = fmt.Sprintf(devicePattern, arch.SISuffix)
+	}
+	prefix := options.SIChannelPrefix
+	if prefix == "" {
+		prefix = defaultChannelPrefix
 	}
-	return fmt.Sprintf("%s/%s/%s/generic_%s/%s",
-		baseURL, options.Release, options.OSChannel, options.Arch, dataFileName)
+	return fmt.Sprintf("%s/%s/%s/%s/%s/%s", serverURL(options), strings.Trim(prefix, "/"),
+		options.Release, options.OSChannel, device, dataFileName), nil
 }
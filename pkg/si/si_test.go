@@ -20,12 +20,22 @@
 package si
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
+	"golang.org/x/crypto/openpgp"
 	"gopkg.in/check.v1"
 
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
 )
 
@@ -40,6 +50,7 @@ const (
 	testDefaultChannel = "edge"
 	testDefaultArch    = "amd64"
 	testImageVersion   = 198
+	testBaseURL        = defaultServer + "/" + defaultChannelPrefix
 	responseBase       = `{
     "global": {
         "generated_at": "Wed Oct 21 06:11:44 UTC 2015"
@@ -77,6 +88,21 @@ const (
             "version": %d,
             "version_detail": "ubuntu=20150831,raw-device=20150831,version=157"
         }`
+	deltaBase = `{
+            "base": %d,
+            "description": "delta",
+            "files": [
+                {
+                    "checksum": "0fd13110a11d439da22080fce91467b2aac80074073938dcba59d862dda66326",
+                    "order": 0,
+                    "path": "/pool/ubuntu-delta.tar.xz",
+                    "signature": "/pool/ubuntu-delta.tar.xz.asc",
+                    "size": 1024
+                }
+            ],
+            "type": "delta",
+            "version": %d
+        }`
 )
 
 type siSuite struct {
@@ -88,9 +114,10 @@ type siSuite struct {
 func Test(t *testing.T) { check.TestingT(t) }
 
 type fakeWebGetter struct {
-	calls  map[string]int
-	error  bool
-	output []byte
+	calls     map[string]int
+	error     bool
+	output    []byte
+	responses map[string][]byte
 }
 
 func (w *fakeWebGetter) Get(url string) (output []byte, err error) {
@@ -98,6 +125,9 @@ func (w *fakeWebGetter) Get(url string) (output []byte, err error) {
 	if w.error {
 		err = &web.ErrHTTPGet{}
 	}
+	if response, ok := w.responses[url]; ok {
+		return response, err
+	}
 	return w.output, err
 }
 
@@ -110,6 +140,7 @@ func (s *siSuite) SetUpTest(c *check.C) {
 	s.webGetter.calls = make(map[string]int)
 	s.webGetter.error = false
 	s.webGetter.output = []byte(validJSONResponse)
+	s.webGetter.responses = make(map[string][]byte)
 	s.defaultOptions = &flags.Options{
 		Release:   testDefaultRelease,
 		OSChannel: testDefaultChannel,
@@ -121,18 +152,21 @@ func (s *siSuite) TestGetLatestVersionQueriesTheRightUrl(c *check.C) {
 	testCases := []struct {
 		release, channel, arch, expected string
 	}{
-		{"15.04", "alpha", "amd64", baseURL + "/15.04/alpha/generic_amd64/" + dataFileName},
-		{"15.04", "alpha", "arm", baseURL + "/15.04/alpha/generic_armhf/" + dataFileName},
-		{"15.04", "edge", "amd64", baseURL + "/15.04/edge/generic_amd64/" + dataFileName},
-		{"15.04", "edge", "arm", baseURL + "/15.04/edge/generic_armhf/" + dataFileName},
-		{"15.04", "stable", "amd64", baseURL + "/15.04/stable/generic_amd64/" + dataFileName},
-		{"15.04", "stable", "arm", baseURL + "/15.04/stable/generic_armhf/" + dataFileName},
-		{"rolling", "alpha", "amd64", baseURL + "/rolling/alpha/generic_amd64/" + dataFileName},
-		{"rolling", "alpha", "arm", baseURL + "/rolling/alpha/generic_armhf/" + dataFileName},
-		{"rolling", "edge", "amd64", baseURL + "/rolling/edge/generic_amd64/" + dataFileName},
-		{"rolling", "edge", "arm", baseURL + "/rolling/edge/generic_armhf/" + dataFileName},
-		{"rolling", "stable", "amd64", baseURL + "/rolling/stable/generic_amd64/" + dataFileName},
-		{"rolling", "stable", "arm", baseURL + "/rolling/stable/generic_armhf/" + dataFileName},
+		{"15.04", "alpha", "amd64", testBaseURL + "/15.04/alpha/generic_amd64/" + dataFileName},
+		{"15.04", "alpha", "arm", testBaseURL + "/15.04/alpha/generic_armhf/" + dataFileName},
+		{"15.04", "edge", "amd64", testBaseURL + "/15.04/edge/generic_amd64/" + dataFileName},
+		{"15.04", "edge", "arm", testBaseURL + "/15.04/edge/generic_armhf/" + dataFileName},
+		{"15.04", "stable", "amd64", testBaseURL + "/15.04/stable/generic_amd64/" + dataFileName},
+		{"15.04", "stable", "arm", testBaseURL + "/15.04/stable/generic_armhf/" + dataFileName},
+		{"rolling", "alpha", "amd64", testBaseURL + "/rolling/alpha/generic_amd64/" + dataFileName},
+		{"rolling", "alpha", "arm", testBaseURL + "/rolling/alpha/generic_armhf/" + dataFileName},
+		{"rolling", "edge", "amd64", testBaseURL + "/rolling/edge/generic_amd64/" + dataFileName},
+		{"rolling", "edge", "arm", testBaseURL + "/rolling/edge/generic_armhf/" + dataFileName},
+		{"rolling", "stable", "amd64", testBaseURL + "/rolling/stable/generic_amd64/" + dataFileName},
+		{"rolling", "stable", "arm", testBaseURL + "/rolling/stable/generic_armhf/" + dataFileName},
+		{"rolling", "beta", "armhf", testBaseURL + "/rolling/beta/generic_armhf/" + dataFileName},
+		{"rolling", "edge", "arm64", testBaseURL + "/rolling/edge/generic_arm64/" + dataFileName},
+		{"rolling", "edge", "i386", testBaseURL + "/rolling/edge/generic_i386/" + dataFileName},
 	}
 	for _, item := range testCases {
 		options := &flags.Options{
@@ -142,11 +176,71 @@ func (s *siSuite) TestGetLatestVersionQueriesTheRightUrl(c *check.C) {
 		}
 		_, err := s.subject.GetLatestVersion(options)
 
+		c.Check(err, check.IsNil)
+		c.Check(s.webGetter.calls[item.expected], check.Equals, 1)
+		c.Check(options.Arch, check.Equals, item.arch)
+	}
+}
+
+func (s *siSuite) TestGetLatestVersionUsesGivenServerPrefixAndDevice(c *check.C) {
+	testCases := []struct {
+		server, prefix, device, expected string
+	}{
+		{"https://si.example.com", "", "", "https://si.example.com/ubuntu-core/rolling/edge/generic_amd64/" + dataFileName},
+		{"https://si.example.com/", "/staging/", "", "https://si.example.com/staging/rolling/edge/generic_amd64/" + dataFileName},
+		{"", "", "mydevice", testBaseURL + "/rolling/edge/mydevice/" + dataFileName},
+		{"http://localhost:8080/mirror", "core", "pc", "http://localhost:8080/mirror/core/rolling/edge/pc/" + dataFileName},
+	}
+	for _, item := range testCases {
+		s.defaultOptions.SIServer = item.server
+		s.defaultOptions.SIChannelPrefix = item.prefix
+		s.defaultOptions.SIDevice = item.device
+
+		_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
 		c.Check(err, check.IsNil)
 		c.Check(s.webGetter.calls[item.expected], check.Equals, 1)
 	}
 }
 
+func (s *siSuite) TestVerifyFilesUsesGivenServer(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+	s.webGetter.responses["https://si.example.com"+testFilePath] = []byte(testFileContent)
+	s.defaultOptions.SIServer = "https://si.example.com/"
+
+	_, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.webGetter.calls["https://si.example.com"+testFilePath], check.Equals, 1)
+	c.Assert(s.webGetter.calls[defaultServer+testFilePath], check.Equals, 0)
+}
+
+func (s *siSuite) TestGetLatestVersionFromLocalServer(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ubuntu-core/rolling/edge/generic_amd64/"+dataFileName {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, validJSONResponse)
+	}))
+	defer server.Close()
+	s.defaultOptions.SIServer = server.URL
+
+	version, err := NewClient(&web.Client{}).GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(version, check.Equals, testImageVersion)
+}
+
+func (s *siSuite) TestGetLatestVersionReturnsErrorForUnknownArch(c *check.C) {
+	s.defaultOptions.Arch = "sparc"
+
+	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &image.ErrUnknownArch{})
+	c.Assert(s.webGetter.calls, check.HasLen, 0)
+}
+
 func (s *siSuite) TestGetLatestVersionReturnshttpGetterError(c *check.C) {
 	s.webGetter.error = true
 
@@ -193,6 +287,76 @@ func (s *siSuite) TestGetLatestVersionHonoursDeltas(c *check.C) {
 	c.Assert(output, check.Equals, testImageVersion)
 }
 
+func (s *siSuite) TestGetLatestVersionReturnsErrNoFullImage(c *check.C) {
+	for _, images := range []string{"", fmt.Sprintf(deltaBase, testImageVersion-1, testImageVersion)} {
+		s.webGetter.output = []byte(fmt.Sprintf(responseBase, images))
+
+		_, err := s.subject.GetLatestVersion(s.defaultOptions)
+
+		c.Check(err, check.FitsTypeOf, &ErrNoFullImage{})
+	}
+}
+
+func (s *siSuite) TestGetLatestReturnsFullImageRecord(c *check.C) {
+	latest, err := s.subject.GetLatest(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(latest.Full.Version, check.Equals, testImageVersion)
+	c.Assert(latest.Full.VersionDetail, check.Equals, "ubuntu=20150831,raw-device=20150831,version=157")
+	c.Assert(latest.Full.Description, check.Equals, "ubuntu=20150831,raw-device=20150831,version=157")
+	c.Assert(latest.Full.Files, check.HasLen, 3)
+	c.Assert(latest.Full.Files[1], check.DeepEquals, File{
+		Checksum:  "970b64173315c0723b8ca64d5ee3f5afc7ee758c94936ce6f5524780609c6727",
+		Order:     1,
+		Path:      "/pool/device-2ca4079697ab7806e8154d9aa4991cfd7e6825db59ef43a6f535a720fc72eddd.tar.xz",
+		Signature: "/pool/device-2ca4079697ab7806e8154d9aa4991cfd7e6825db59ef43a6f535a720fc72eddd.tar.xz.asc",
+		Size:      88374184})
+	c.Assert(latest.Full.Size(), check.Equals, int64(50434700+88374184+432))
+	c.Assert(latest.Deltas, check.HasLen, 0)
+	c.Assert(latest.Version(), check.Equals, testImageVersion)
+}
+
+func (s *siSuite) TestGetLatestReturnsDeltaChain(c *check.C) {
+	images := []string{
+		fmt.Sprintf(imageBase, "full", testImageVersion-1),
+		fmt.Sprintf(deltaBase, testImageVersion-1, testImageVersion),
+		fmt.Sprintf(imageBase, "full", testImageVersion),
+		fmt.Sprintf(deltaBase, testImageVersion-1, testImageVersion+1),
+		fmt.Sprintf(deltaBase, testImageVersion, testImageVersion+1),
+		fmt.Sprintf(deltaBase, testImageVersion+1, testImageVersion+2),
+		fmt.Sprintf(deltaBase, testImageVersion+5, testImageVersion+6),
+	}
+	s.webGetter.output = []byte(fmt.Sprintf(responseBase, strings.Join(images, ",")))
+
+	latest, err := s.subject.GetLatest(s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(latest.Full.Version, check.Equals, testImageVersion)
+	c.Assert(latest.Deltas, check.HasLen, 2)
+	c.Assert(latest.Deltas[0].Base, check.Equals, testImageVersion)
+	c.Assert(latest.Deltas[0].Version, check.Equals, testImageVersion+1)
+	c.Assert(latest.Deltas[1].Version, check.Equals, testImageVersion+2)
+	c.Assert(latest.Deltas[1].Size(), check.Equals, int64(1024))
+	c.Assert(latest.Version(), check.Equals, testImageVersion+2)
+}
+
+func (s *siSuite) TestGetLatestReturnsErrNoFullImageForDeltaOnlyIndex(c *check.C) {
+	s.webGetter.output = []byte(fmt.Sprintf(responseBase, fmt.Sprintf(deltaBase, testImageVersion-1, testImageVersion)))
+
+	latest, err := s.subject.GetLatest(s.defaultOptions)
+
+	c.Assert(latest, check.IsNil)
+	c.Assert(err, check.FitsTypeOf, &ErrNoFullImage{})
+}
+
+func (s *siSuite) TestGetLatestReturnsHttpGetterError(c *check.C) {
+	s.webGetter.error = true
+
+	_, err := s.subject.GetLatest(s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &web.ErrHTTPGet{})
+}
+
 func (s *siSuite) TestGetLatestVersionReturnsUnmarshalError(c *check.C) {
 	s.webGetter.output = []byte("{{Not a valid JSON 'string']")
 
@@ -200,3 +364,158 @@ func (s *siSuite) TestGetLatestVersionReturnsUnmarshalError(c *check.C) {
 
 	c.Assert(err, check.NotNil)
 }
+
+const (
+	testFilePath      = "/pool/ubuntu-test.tar.xz"
+	testFileContent   = "system-image file content"
+	verifyImageFormat = `{
+            "files": [
+                {
+                    "checksum": "%s",
+                    "order": 0,
+                    "path": "` + testFilePath + `",
+                    "signature": "` + testFilePath + `.asc",
+                    "size": 25
+                }
+            ],
+            "type": "full",
+            "version": %d
+        }`
+)
+
+// setVerifyResponses makes the index list a full image with one file with the given checksum
+func (s *siSuite) setVerifyResponses(checksum string) {
+	s.webGetter.output = []byte(fmt.Sprintf(responseBase, fmt.Sprintf(verifyImageFormat, checksum, testImageVersion)))
+	s.webGetter.responses[defaultServer+testFilePath] = []byte(testFileContent)
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeKeyring creates a new key, stores its public part in a keyring file and
+// returns the path of the file and the armored signature of content
+func writeKeyring(c *check.C, content string) (path, signature string) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	c.Assert(err, check.IsNil)
+	file, err := ioutil.TempFile("", "")
+	c.Assert(err, check.IsNil)
+	defer file.Close()
+	c.Assert(entity.Serialize(file), check.IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(openpgp.ArmoredDetachSign(&buf, entity, bytes.NewReader([]byte(content)), nil), check.IsNil)
+	return file.Name(), buf.String()
+}
+
+func (s *siSuite) TestVerifyFilesChecksChecksums(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+
+	mirror, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.IsNil)
+	defer mirror.Close()
+	c.Assert(s.webGetter.calls[defaultServer+testFilePath], check.Equals, 1)
+	c.Assert(s.webGetter.calls[defaultServer+testFilePath+".asc"], check.Equals, 0)
+}
+
+func (s *siSuite) TestVerifyFilesReturnsChecksumError(c *check.C) {
+	s.setVerifyResponses(sha256Hex("other content"))
+
+	_, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.FitsTypeOf, &ErrChecksum{})
+}
+
+func (s *siSuite) TestVerifyFilesReturnsErrorForMissingVersion(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+
+	_, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion+1)
+
+	c.Assert(err, check.FitsTypeOf, &ErrVersionNotInIndex{})
+}
+
+func (s *siSuite) TestVerifyFilesChecksSignatures(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+	keyring, signature := writeKeyring(c, testFileContent)
+	defer os.Remove(keyring)
+	s.webGetter.responses[defaultServer+testFilePath+".asc"] = []byte(signature)
+	s.defaultOptions.SIKeyring = keyring
+
+	mirror, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.IsNil)
+	defer mirror.Close()
+	c.Assert(s.webGetter.calls[defaultServer+testFilePath+".asc"], check.Equals, 1)
+}
+
+func (s *siSuite) TestVerifyFilesReturnsSignatureError(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+	keyring, signature := writeKeyring(c, "other content")
+	defer os.Remove(keyring)
+	s.webGetter.responses[defaultServer+testFilePath+".asc"] = []byte(signature)
+	s.defaultOptions.SIKeyring = keyring
+
+	_, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *siSuite) TestVerifyFilesMirrorServesVerifiedFiles(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+
+	mirror, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+	c.Assert(err, check.IsNil)
+	defer mirror.Close()
+	s.webGetter.responses[defaultServer+testFilePath] = []byte("changed content")
+
+	c.Assert(getMirrorFile(c, mirror.URL()+testFilePath), check.Equals, testFileContent)
+	c.Assert(s.webGetter.calls[defaultServer+testFilePath], check.Equals, 1)
+}
+
+func (s *siSuite) TestVerifyFilesMirrorServesVerifiedIndex(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+	index := string(s.webGetter.output)
+	indexURL, err := generateURL(s.defaultOptions)
+	c.Assert(err, check.IsNil)
+
+	mirror, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+	c.Assert(err, check.IsNil)
+	defer mirror.Close()
+	s.webGetter.output = []byte("changed index")
+
+	c.Assert(getMirrorFile(c, mirror.URL()+strings.TrimPrefix(indexURL, defaultServer)), check.Equals, index)
+}
+
+func (s *siSuite) TestVerifyFilesMirrorPassesOtherRequestsToServer(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+	otherPath := "/gpg/image-master.tar.xz"
+	s.webGetter.responses[defaultServer+otherPath] = []byte("keyring")
+
+	mirror, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+	c.Assert(err, check.IsNil)
+	defer mirror.Close()
+
+	c.Assert(getMirrorFile(c, mirror.URL()+otherPath), check.Equals, "keyring")
+}
+
+func (s *siSuite) TestVerifyFilesMirrorIsClosed(c *check.C) {
+	s.setVerifyResponses(sha256Hex(testFileContent))
+
+	mirror, err := s.subject.VerifyFiles(s.defaultOptions, testImageVersion)
+	c.Assert(err, check.IsNil)
+	c.Assert(mirror.Close(), check.IsNil)
+
+	_, err = http.Get(mirror.URL() + testFilePath)
+	c.Assert(err, check.NotNil)
+}
+
+func getMirrorFile(c *check.C, url string) string {
+	resp, err := http.Get(url)
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	return string(content)
+}